@@ -363,6 +363,32 @@ class AppBase:
 
         # Takes a workflow execution as argument
         # Returns a string if the result is single, or a list if it's a list
+        # What failed before this node if an error branch started it. Same as the worker
+        def get_error_input(execution_data):
+            try:
+                for branch in execution_data["workflow"]["branches"]:
+                    if not branch.get("has_errors") or branch["destination_id"] != action["id"]:
+                        continue
+
+                    for result in execution_data["results"]:
+                        if result["action"]["id"] != branch["source_id"] or result["status"] != "FAILURE":
+                            continue
+
+                        return json.dumps({
+                            "action_id": result["action"]["id"],
+                            "label": result["action"]["label"],
+                            "app_name": result["action"]["app_name"],
+                            "name": result["action"]["name"],
+                            "status": result["status"],
+                            "result": result["result"],
+                            "started_at": result["started_at"],
+                            "completed_at": result["completed_at"],
+                        })
+            except (KeyError, TypeError) as e:
+                print("Error finding failed parent: %s" % e)
+
+            return ""
+
         def get_json_value(execution_data, input_data):
             parsersplit = input_data.split(".")
             actionname = parsersplit[0][1:].replace(" ", "_", -1)
@@ -374,6 +400,8 @@ class AppBase:
             try: 
                 if actionname_lower == "exec": 
                     baseresult = execution_data["execution_argument"]
+                elif actionname_lower == "error":
+                    baseresult = get_error_input(execution_data)
                 else:
                     for result in execution_data["results"]:
                         resultlabel = result["action"]["label"].replace(" ", "_", -1).lower()
@@ -642,6 +670,10 @@ class AppBase:
             return False
 
         def check_branch_conditions(action, fullexecution):
+            # The worker already checked them before starting the app
+            if os.getenv("BRANCHES_CHECKED", "") == "true":
+                return True, ""
+
             # relevantbranches = workflow.branches where destination = action
             try:
                 if fullexecution["workflow"]["branches"] == None or len(fullexecution["workflow"]["branches"]) == 0:
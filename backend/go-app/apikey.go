@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Only the hash of the key is stored. The key itself is shown once on creation
+type UserApikey struct {
+	Id        string   `json:"id" datastore:"id"`
+	Name      string   `json:"name" datastore:"name"`
+	UserId    string   `json:"user_id" datastore:"user_id"`
+	OrgId     string   `json:"org_id" datastore:"org_id"`
+	Hash      string   `json:"-" datastore:"hash"`
+	Prefix    string   `json:"prefix" datastore:"prefix,noindex"`
+	Scopes    []string `json:"scopes" datastore:"scopes,noindex"`
+	Workflows []string `json:"workflows" datastore:"workflows,noindex"`
+	Created   int64    `json:"created" datastore:"created"`
+	Expires   int64    `json:"expires" datastore:"expires,noindex"`
+	LastUsed  int64    `json:"last_used" datastore:"last_used,noindex"`
+	Revoked   bool     `json:"revoked" datastore:"revoked"`
+}
+
+// all = everything the user can do
+// read = GET requests only
+// execute = running workflows and reading their executions
+var apikeyScopes = []string{"all", "read", "execute"}
+
+func hashApikey(apikey string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(apikey))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func getUserApikey(ctx context.Context, id string) (*UserApikey, error) {
+	key := datastore.NameKey("user_apikeys", id, nil)
+	apikey := &UserApikey{}
+	if err := dbclient.Get(ctx, key, apikey); err != nil {
+		return &UserApikey{}, err
+	}
+
+	return apikey, nil
+}
+
+func setUserApikey(ctx context.Context, apikey UserApikey) error {
+	key := datastore.NameKey("user_apikeys", apikey.Id, nil)
+	if _, err := dbclient.Put(ctx, key, &apikey); err != nil {
+		log.Printf("Error adding apikey %s: %s", apikey.Id, err)
+		return err
+	}
+
+	return nil
+}
+
+func getUserApikeys(ctx context.Context, userId string) ([]UserApikey, error) {
+	q := datastore.NewQuery("user_apikeys").Filter("user_id =", userId)
+	var apikeys []UserApikey
+	_, err := dbclient.GetAll(ctx, q, &apikeys)
+	if err != nil {
+		return []UserApikey{}, err
+	}
+
+	return apikeys, nil
+}
+
+// Finds the stored key based on the raw apikey from a request
+func getApikey(ctx context.Context, apikey string) (*UserApikey, error) {
+	q := datastore.NewQuery("user_apikeys").Filter("hash =", hashApikey(apikey)).Limit(1)
+	var apikeys []UserApikey
+	_, err := dbclient.GetAll(ctx, q, &apikeys)
+	if err != nil {
+		log.Printf("Error getting apikey: %s", err)
+		return &UserApikey{}, err
+	}
+
+	if len(apikeys) == 0 {
+		return &UserApikey{}, errors.New("Apikey doesn't exist")
+	}
+
+	if apikeys[0].Revoked {
+		return &UserApikey{}, errors.New("Apikey is revoked")
+	}
+
+	if apikeys[0].Expires > 0 && apikeys[0].Expires < time.Now().Unix() {
+		return &UserApikey{}, errors.New("Apikey is expired")
+	}
+
+	return &apikeys[0], nil
+}
+
+// Stores a given apikey for the user in their active org
+func addUserApikey(ctx context.Context, user User, name, apikey string, scopes, workflows []string, expires int64) (*UserApikey, error) {
+	if len(scopes) == 0 {
+		scopes = []string{"all"}
+	}
+
+	for _, scope := range scopes {
+		if !arrayContainsString(apikeyScopes, scope) {
+			return &UserApikey{}, errors.New(fmt.Sprintf("Scope %s is not valid. Use one of %s", scope, strings.Join(apikeyScopes, ", ")))
+		}
+	}
+
+	if workflows == nil {
+		workflows = []string{}
+	}
+
+	prefix := apikey
+	if len(prefix) > 8 {
+		prefix = prefix[0:8]
+	}
+
+	newApikey := UserApikey{
+		Id:        uuid.NewV4().String(),
+		Name:      name,
+		UserId:    user.Id,
+		OrgId:     user.ActiveOrg.Id,
+		Hash:      hashApikey(apikey),
+		Prefix:    prefix,
+		Scopes:    scopes,
+		Workflows: workflows,
+		Created:   time.Now().Unix(),
+		Expires:   expires,
+	}
+
+	err := setUserApikey(ctx, newApikey)
+	if err != nil {
+		return &UserApikey{}, err
+	}
+
+	return &newApikey, nil
+}
+
+// Returns the raw apikey. This is the only time it's available
+func createUserApikey(ctx context.Context, user User, name string, scopes, workflows []string, expires int64) (string, *UserApikey, error) {
+	apikey := uuid.NewV4().String()
+	newApikey, err := addUserApikey(ctx, user, name, apikey, scopes, workflows, expires)
+	if err != nil {
+		return "", newApikey, err
+	}
+
+	return apikey, newApikey, nil
+}
+
+func revokeUserApikeys(ctx context.Context, userId, name string) error {
+	apikeys, err := getUserApikeys(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, apikey := range apikeys {
+		if apikey.Name != name || apikey.Revoked {
+			continue
+		}
+
+		apikey.Revoked = true
+		err = setUserApikey(ctx, apikey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces the users' default apikey. Used by the old single apikey endpoints
+func generateApikey(ctx context.Context, userInfo User) (string, error) {
+	err := revokeUserApikeys(ctx, userInfo.Id, "default")
+	if err != nil {
+		log.Printf("Failed revoking old apikey: %s", err)
+		return "", err
+	}
+
+	apikey, _, err := createUserApikey(ctx, userInfo, "default", []string{"all"}, []string{}, 0)
+	if err != nil {
+		log.Printf("Failed updating apikey: %s", err)
+		return "", err
+	}
+
+	return apikey, nil
+}
+
+// The routes each scope can use. Anything not in here needs "all". Some GETs
+// change things (e.g. generateapikey), so this isn't based on the method
+var apikeyScopeRoutes = map[string][]string{
+	"read": []string{
+		"GET /api/v1/users/apikeys",
+		"GET /api/v1/users/sessions",
+		"GET /api/v1/users/getinfo",
+		"GET /api/v1/getinfo",
+		"GET /api/v1/getenvironments",
+		"GET /api/v1/orgs",
+		"GET /api/v1/orgs/invites",
+		"GET /api/v1/orgs/{key}",
+		"GET /api/v1/audit",
+		"GET /api/v1/docs",
+		"GET /api/v1/docs/{key}",
+		"GET /api/v1/approvals",
+		"GET /api/v1/apps",
+		"GET /api/v1/apps/{key}/config",
+		"GET /api/v1/workflows",
+		"GET /api/v1/workflows/apps",
+		"GET /api/v1/workflows/schedules",
+		"GET /api/v1/workflows/{key}",
+		"GET /api/v1/workflows/{key}/export",
+		"GET /api/v1/workflows/{key}/validate",
+		"GET /api/v1/workflows/{key}/tests",
+		"GET /api/v1/workflows/{key}/executions",
+		"GET /api/v1/workflows/{key}/executions/{key}/diff",
+		"GET /api/v1/workflows/{key}/revisions",
+		"GET /api/v1/workflows/{key}/revisions/{key}",
+		"GET /api/v1/workflows/{key}/revisions/{key}/diff/{key}",
+		"GET /api/v1/triggers/{key}",
+		"GET /api/v1/stats/{key}",
+		"GET /api/v1/get_openapi/{key}",
+	},
+	"execute": []string{
+		"GET /api/v1/workflows/{key}/execute",
+		"POST /api/v1/workflows/{key}/execute",
+		"GET /api/v1/workflows/{key}/executions",
+		"POST /api/v1/workflows/{key}/executions/{key}/rerun",
+		"POST /api/v1/workflows/{key}/executions/{key}/replay",
+		"POST /api/v1/workflows/{key}/executions/{key}/pause",
+		"POST /api/v1/workflows/{key}/executions/{key}/resume",
+		"POST /api/v1/workflows/{key}/tests/run",
+	},
+}
+
+// Routes are "METHOD /path". {key} matches any one part of the path
+func matchApikeyRoute(route, method, path string) bool {
+	routeParts := strings.SplitN(route, " ", 2)
+	if len(routeParts) != 2 || (routeParts[0] != method && method != "OPTIONS") {
+		return false
+	}
+
+	routeLocation := strings.Split(routeParts[1], "/")
+	location := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(routeLocation) != len(location) {
+		return false
+	}
+
+	for index, part := range routeLocation {
+		if strings.HasPrefix(part, "{") {
+			if len(location[index]) == 0 {
+				return false
+			}
+
+			continue
+		}
+
+		if part != location[index] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Checks whether the request is allowed by the scopes of the key
+func checkApikeyScope(apikey UserApikey, request *http.Request) error {
+	path := request.URL.Path
+	location := strings.Split(path, "/")
+
+	if len(apikey.Workflows) > 0 {
+		if !strings.HasPrefix(path, "/api/v1/workflows/") || len(location) < 5 || !arrayContainsString(apikey.Workflows, location[4]) {
+			return errors.New("Apikey is limited to specific workflows")
+		}
+	}
+
+	for _, scope := range apikey.Scopes {
+		if scope == "all" {
+			return nil
+		}
+
+		for _, route := range apikeyScopeRoutes[scope] {
+			if matchApikeyRoute(route, request.Method, path) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Apikey scopes %s don't allow %s %s", strings.Join(apikey.Scopes, ", "), request.Method, path))
+}
+
+// Moves the old plaintext apikeys to hashed keys
+func migrateUserApikeys(ctx context.Context) {
+	q := datastore.NewQuery("Users").Filter("apikey >", "")
+	var users []User
+	_, err := dbclient.GetAll(ctx, q, &users)
+	if err != nil {
+		log.Printf("Failed getting users for apikey migration: %s", err)
+		return
+	}
+
+	for _, user := range users {
+		if len(user.ApiKey) == 0 {
+			continue
+		}
+
+		_, err = addUserApikey(ctx, user, "default", user.ApiKey, []string{"all"}, []string{}, 0)
+		if err != nil {
+			log.Printf("Failed migrating apikey for %s: %s", user.Username, err)
+			continue
+		}
+
+		err = DeleteKey(ctx, "apikey", user.ApiKey)
+		if err != nil {
+			log.Printf("Failed deleting old apikey for %s: %s", user.Username, err)
+		}
+
+		user.ApiKey = ""
+		err = setUser(ctx, &user)
+		if err != nil {
+			log.Printf("Failed updating user %s after apikey migration: %s", user.Username, err)
+			continue
+		}
+
+		log.Printf("Migrated apikey for %s", user.Username)
+	}
+}
+
+func handleGetApikeys(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get apikeys: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	apikeys, err := getUserApikeys(ctx, user.Id)
+	if err != nil {
+		log.Printf("Failed getting apikeys for %s: %s", user.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(apikeys)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking apikeys"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func handleNewApikey(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in new apikey: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	type newApikeyData struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		Workflows []string `json:"workflows"`
+		Expires   int64    `json:"expires"`
+	}
+
+	var data newApikeyData
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		log.Printf("Failed unmarshalling new apikey: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling data"}`))
+		return
+	}
+
+	if len(data.Name) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Missing field: name"}`))
+		return
+	}
+
+	if data.Expires > 0 && data.Expires < time.Now().Unix() {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Expires has to be in the future"}`))
+		return
+	}
+
+	ctx := context.Background()
+	for _, workflowId := range data.Workflows {
+		workflow, err := getWorkflow(ctx, workflowId)
+		if err != nil || workflow.OrgId != user.ActiveOrg.Id || (workflow.Owner != user.Id && user.Role != "admin") {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can't access workflow %s"}`, workflowId)))
+			return
+		}
+	}
+
+	apikey, newApikey, err := createUserApikey(ctx, user, data.Name, data.Scopes, data.Workflows, data.Expires)
+	if err != nil {
+		log.Printf("Failed creating apikey for %s: %s", user.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "apikey.create", "apikey", newApikey.Id, nil, newApikey)
+
+	log.Printf("Created apikey %s for %s", newApikey.Id, user.Username)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "apikey": "%s"}`, newApikey.Id, apikey)))
+}
+
+func handleRevokeApikey(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in revoke apikey: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 5 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[5]
+	}
+
+	if len(fileId) != 36 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Apikey ID is not valid"}`))
+		return
+	}
+
+	ctx := context.Background()
+	apikey, err := getUserApikey(ctx, fileId)
+	if err != nil || apikey.UserId != user.Id {
+		log.Printf("Failed getting apikey %s for %s: %s", fileId, user.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	apikey.Revoked = true
+	err = setUserApikey(ctx, *apikey)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed revoking apikey"}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "apikey.revoke", "apikey", fileId, map[string]bool{"revoked": false}, map[string]bool{"revoked": true})
+
+	log.Printf("Revoked apikey %s for %s", fileId, user.Username)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
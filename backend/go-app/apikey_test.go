@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchApikeyRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  string
+		method string
+		path   string
+		want   bool
+	}{
+		{"exact path", "GET /api/v1/workflows", "GET", "/api/v1/workflows", true},
+		{"trailing slash", "GET /api/v1/workflows", "GET", "/api/v1/workflows/", true},
+		{"other method", "GET /api/v1/workflows", "POST", "/api/v1/workflows", false},
+		{"preflight for any method", "POST /api/v1/workflows/{key}/execute", "OPTIONS", "/api/v1/workflows/abc/execute", true},
+		{"key matches one part", "GET /api/v1/workflows/{key}", "GET", "/api/v1/workflows/abc", true},
+		{"key doesn't match an empty part", "GET /api/v1/workflows/{key}/export", "GET", "/api/v1/workflows//export", false},
+		{"key doesn't match several parts", "GET /api/v1/workflows/{key}", "GET", "/api/v1/workflows/abc/export", false},
+		{"shorter path", "GET /api/v1/workflows/{key}/export", "GET", "/api/v1/workflows/abc", false},
+		{"other path", "GET /api/v1/workflows/{key}", "GET", "/api/v1/users/abc", false},
+		{"prefix isn't enough", "GET /api/v1/apps", "GET", "/api/v1/apps/abc/delete", false},
+		{"route without a method", "/api/v1/workflows", "GET", "/api/v1/workflows", false},
+	}
+
+	for _, test := range tests {
+		got := matchApikeyRoute(test.route, test.method, test.path)
+		if got != test.want {
+			t.Errorf("%s: matchApikeyRoute(%s, %s, %s) = %t, want %t", test.name, test.route, test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestCheckApikeyScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		scopes    []string
+		workflows []string
+		method    string
+		path      string
+		allowed   bool
+	}{
+		{"all allows writes", []string{"all"}, nil, "POST", "/api/v1/workflows/abc", true},
+		{"all allows admin routes", []string{"all"}, nil, "DELETE", "/api/v1/users/abc", true},
+		{"read allows listed reads", []string{"read"}, nil, "GET", "/api/v1/workflows/abc", true},
+		{"read denies writes", []string{"read"}, nil, "POST", "/api/v1/workflows/abc", false},
+		{"read denies unlisted reads", []string{"read"}, nil, "GET", "/api/v1/users/getusers", false},
+		{"read denies executing", []string{"read"}, nil, "POST", "/api/v1/workflows/abc/execute", false},
+		{"execute allows executing", []string{"execute"}, nil, "POST", "/api/v1/workflows/abc/execute", true},
+		{"execute allows reading executions", []string{"execute"}, nil, "GET", "/api/v1/workflows/abc/executions", true},
+		{"execute denies saving", []string{"execute"}, nil, "PUT", "/api/v1/workflows/abc", false},
+		{"execute denies aborting through the abort route", []string{"execute"}, nil, "GET", "/api/v1/workflows/abc/executions/def/abort", false},
+		{"scopes add up", []string{"read", "execute"}, nil, "POST", "/api/v1/workflows/abc/execute", true},
+		{"no scopes allow nothing", []string{}, nil, "GET", "/api/v1/workflows/abc", false},
+		{"unknown scope allows nothing", []string{"admin"}, nil, "GET", "/api/v1/workflows/abc", false},
+		{"listed workflow", []string{"all"}, []string{"abc"}, "POST", "/api/v1/workflows/abc/execute", true},
+		{"other workflow", []string{"all"}, []string{"abc"}, "POST", "/api/v1/workflows/def/execute", false},
+		{"workflow list with a workflow key", []string{"all"}, []string{"abc"}, "GET", "/api/v1/workflows", false},
+		{"workflow key outside workflows", []string{"all"}, []string{"abc"}, "GET", "/api/v1/users/getinfo", false},
+		{"workflow key still needs the scope", []string{"read"}, []string{"abc"}, "POST", "/api/v1/workflows/abc/execute", false},
+	}
+
+	for _, test := range tests {
+		apikey := UserApikey{Scopes: test.scopes, Workflows: test.workflows}
+		request := httptest.NewRequest(test.method, test.path, nil)
+		err := checkApikeyScope(apikey, request)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %s %s was denied: %s", test.name, test.method, test.path, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%s: %s %s was allowed", test.name, test.method, test.path)
+		}
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	newscheduler "github.com/carlescere/scheduler"
+	uuid "github.com/satori/go.uuid"
+)
+
+// How long an approval waits for someone before the default outcome is used
+var defaultApprovalExpiry = 86400
+
+// Seconds between checks for approvals nobody answered in time
+var approvalExpiryInterval = 60
+
+var approvalOutcomes = []string{"approve", "deny"}
+
+type ApprovalValue struct {
+	Name  string `json:"name" datastore:"name"`
+	Value string `json:"value" datastore:"value,noindex"`
+}
+
+// A decision an approval node waits for. Status is pending, approved or denied.
+// ResultSent is set when the node has the decision as its result. The secret
+// signs the links and is never returned from the API
+type Approval struct {
+	Id             string          `json:"id" datastore:"id"`
+	Secret         string          `json:"-" datastore:"secret,noindex"`
+	ExecutionId    string          `json:"execution_id" datastore:"execution_id"`
+	ActionId       string          `json:"action_id" datastore:"action_id"`
+	WorkflowId     string          `json:"workflow_id" datastore:"workflow_id"`
+	OrgId          string          `json:"org_id" datastore:"org_id"`
+	Label          string          `json:"label" datastore:"label"`
+	Message        string          `json:"message" datastore:"message,noindex"`
+	Fields         []string        `json:"fields" datastore:"fields,noindex"`
+	Approvers      []string        `json:"approvers" datastore:"approvers,noindex"`
+	DefaultOutcome string          `json:"default_outcome" datastore:"default_outcome"`
+	Status         string          `json:"status" datastore:"status"`
+	Approver       string          `json:"approver" datastore:"approver"`
+	Values         []ApprovalValue `json:"values" datastore:"values,noindex"`
+	Expired        bool            `json:"expired" datastore:"expired"`
+	Created        int64           `json:"created" datastore:"created"`
+	Expires        int64           `json:"expires" datastore:"expires"`
+	Decided        int64           `json:"decided" datastore:"decided"`
+	ResultSent     bool            `json:"result_sent" datastore:"result_sent"`
+}
+
+// Sent by the worker when it reaches an approval node. Approvers and fields
+// are comma separated, expiry is in seconds
+type ApprovalRequest struct {
+	ExecutionId   string `json:"execution_id"`
+	Authorization string `json:"authorization"`
+	ActionId      string `json:"action_id"`
+	Message       string `json:"message"`
+	Approvers     string `json:"approvers"`
+	Fields        string `json:"fields"`
+	Expiry        string `json:"expiry"`
+	Default       string `json:"default"`
+}
+
+type ApprovalDecision struct {
+	Values map[string]string `json:"values"`
+}
+
+func getApproval(ctx context.Context, id string) (*Approval, error) {
+	key := datastore.NameKey("approvals", id, nil)
+	approval := &Approval{}
+	if err := dbclient.Get(ctx, key, approval); err != nil {
+		return &Approval{}, err
+	}
+
+	return approval, nil
+}
+
+func setApproval(ctx context.Context, approval Approval) error {
+	key := datastore.NameKey("approvals", approval.Id, nil)
+	if _, err := dbclient.Put(ctx, key, &approval); err != nil {
+		log.Printf("Error setting approval %s: %s", approval.Id, err)
+		return err
+	}
+
+	return nil
+}
+
+func getExecutionApprovals(ctx context.Context, executionId string) ([]Approval, error) {
+	q := datastore.NewQuery("approvals").Filter("execution_id =", executionId)
+	var approvals []Approval
+	_, err := dbclient.GetAll(ctx, q, &approvals)
+	if err != nil {
+		return []Approval{}, err
+	}
+
+	return approvals, nil
+}
+
+func isApprovalAction(action Action) bool {
+	return arrayContainsString(builtinApps, action.AppID) && action.Name == "approval"
+}
+
+// Each link only works for its own decision
+func getApprovalToken(approval Approval, decision string) string {
+	mac := hmac.New(sha256.New, []byte(approval.Secret))
+	mac.Write([]byte(fmt.Sprintf("%s:%s", approval.Id, decision)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkApprovalToken(approval Approval, decision, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	return hmac.Equal([]byte(getApprovalToken(approval, decision)), []byte(token))
+}
+
+// Links are sent to people outside Shuffle, so they use the external URL in
+// SHUFFLE_BASE_URL. Without it, the host the request came in on is used
+func getApprovalBaseUrl(request *http.Request) string {
+	baseUrl := strings.TrimRight(os.Getenv("SHUFFLE_BASE_URL"), "/")
+	if len(baseUrl) > 0 {
+		return baseUrl
+	}
+
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, request.Host)
+}
+
+func getApprovalLink(baseUrl string, approval Approval, decision string) string {
+	return fmt.Sprintf("%s/api/v1/approvals/%s/%s?token=%s", baseUrl, approval.Id, decision, getApprovalToken(approval, decision))
+}
+
+func getCommaList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Approvers are usernames or user IDs. Anyone with the link can decide if
+// there are none
+func canApprove(approval Approval, user User) bool {
+	if len(approval.Approvers) == 0 {
+		return true
+	}
+
+	if len(user.Id) == 0 {
+		return false
+	}
+
+	for _, approver := range approval.Approvers {
+		if approver == user.Id || strings.EqualFold(approver, user.Username) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Records the decision and gives the waiting node its result. Approved is
+// SUCCESS, denied is FAILURE so error branches can handle it. Only the first
+// decision counts, so two clicks or a click racing the expiry can't both
+// finish the node
+func setApprovalDecision(ctx context.Context, approval Approval, decision, approver string, values []ApprovalValue, expired bool) (Approval, error) {
+	key := datastore.NameKey("approvals", approval.Id, nil)
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &approval); err != nil {
+			return err
+		}
+
+		if approval.Status != "pending" {
+			return errors.New(fmt.Sprintf("Approval %s is already %s", approval.Id, approval.Status))
+		}
+
+		approval.Status = "denied"
+		if decision == "approve" {
+			approval.Status = "approved"
+		}
+
+		approval.Approver = approver
+		approval.Values = values
+		approval.Expired = expired
+		approval.Decided = time.Now().Unix()
+		_, err := tx.Put(key, &approval)
+		return err
+	})
+	if err != nil {
+		return approval, err
+	}
+
+	// The decision stands even if the node doesn't get it now. It's sent
+	// again by the expiry timer
+	log.Printf("[INFO] Approval %s for %s in %s was %s by %s", approval.Id, approval.ActionId, approval.ExecutionId, approval.Status, approver)
+	sendApprovalResult(ctx, approval)
+	return approval, nil
+}
+
+// Gives the waiting node the decision. If it fails, the expiry timer tries
+// again until it works, so the execution doesn't wait forever
+func sendApprovalResult(ctx context.Context, approval Approval) error {
+	status := "FAILURE"
+	if approval.Status == "approved" {
+		status = "SUCCESS"
+	}
+
+	parsedValues := map[string]string{}
+	for _, value := range approval.Values {
+		parsedValues[value.Name] = value.Value
+	}
+
+	result, err := json.Marshal(map[string]interface{}{
+		"success":     approval.Status == "approved",
+		"approval_id": approval.Id,
+		"decision":    approval.Status,
+		"approver":    approval.Approver,
+		"values":      parsedValues,
+		"expired":     approval.Expired,
+		"decided_at":  approval.Decided,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = setParentResult(ctx, approval.ExecutionId, approval.ActionId, string(result), status)
+	if err != nil {
+		log.Printf("Failed sending the decision of approval %s: %s", approval.Id, err)
+		return err
+	}
+
+	approval.ResultSent = true
+	return setApproval(ctx, approval)
+}
+
+// Approvals nobody answered in time get their default outcome. The worker
+// isn't running while the node waits, so this runs on its own timer. It also
+// sends decisions again that didn't reach their node
+func startApprovalExpiry() {
+	job := func() {
+		ctx := context.Background()
+		q := datastore.NewQuery("approvals").Filter("result_sent =", false)
+		var approvals []Approval
+		_, err := dbclient.GetAll(ctx, q, &approvals)
+		if err != nil {
+			log.Printf("Failed getting approvals without results: %s", err)
+			return
+		}
+
+		for _, approval := range approvals {
+			if approval.Status != "pending" {
+				sendApprovalResult(ctx, approval)
+				continue
+			}
+
+			if approval.Expires > time.Now().Unix() {
+				continue
+			}
+
+			_, err = setApprovalDecision(ctx, approval, approval.DefaultOutcome, "", []ApprovalValue{}, true)
+			if err != nil {
+				log.Printf("Failed expiring approval %s: %s", approval.Id, err)
+			}
+		}
+	}
+
+	_, err := newscheduler.Every(approvalExpiryInterval).Seconds().NotImmediately().Run(job)
+	if err != nil {
+		log.Printf("Failed starting approval expiry: %s", err)
+	}
+}
+
+// Called by the worker when it reaches an approval node. Asking again for the
+// same node gives the approval that already exists
+func handleCreateApproval(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for approval")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var approvalRequest ApprovalRequest
+	err = json.Unmarshal(body, &approvalRequest)
+	if err != nil {
+		log.Printf("Failed approval unmarshaling: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflowExecution, err := getWorkflowExecution(ctx, approvalRequest.ExecutionId)
+	if err != nil || workflowExecution.Authorization != approvalRequest.Authorization {
+		log.Printf("Bad authorization key when starting approval in %s", approvalRequest.ExecutionId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad authorization key or execution_id might not exist."}`))
+		return
+	}
+
+	if workflowExecution.Status != "EXECUTING" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution has status %s"}`, workflowExecution.Status)))
+		return
+	}
+
+	action := Action{}
+	for _, curAction := range workflowExecution.Workflow.Actions {
+		if curAction.ID == approvalRequest.ActionId {
+			action = curAction
+			break
+		}
+	}
+
+	if !isApprovalAction(action) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s isn't an approval node"}`, approvalRequest.ActionId)))
+		return
+	}
+
+	expiry := defaultApprovalExpiry
+	if len(approvalRequest.Expiry) > 0 {
+		expiry, err = strconv.Atoi(approvalRequest.Expiry)
+		if err != nil || expiry <= 0 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Expiry has to be a number of seconds"}`))
+			return
+		}
+	}
+
+	defaultOutcome := strings.ToLower(approvalRequest.Default)
+	if len(defaultOutcome) == 0 {
+		defaultOutcome = "deny"
+	} else if !arrayContainsString(approvalOutcomes, defaultOutcome) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Default has to be approve or deny"}`))
+		return
+	}
+
+	approvals, err := getExecutionApprovals(ctx, workflowExecution.ExecutionId)
+	if err != nil {
+		log.Printf("Failed getting approvals for %s: %s", workflowExecution.ExecutionId, err)
+	}
+
+	approval := Approval{}
+	for _, oldApproval := range approvals {
+		if oldApproval.ActionId == action.ID {
+			approval = oldApproval
+			break
+		}
+	}
+
+	if len(approval.Id) == 0 {
+		approval = Approval{
+			Id:             uuid.NewV4().String(),
+			Secret:         uuid.NewV4().String(),
+			ExecutionId:    workflowExecution.ExecutionId,
+			ActionId:       action.ID,
+			WorkflowId:     workflowExecution.Workflow.ID,
+			OrgId:          workflowExecution.Workflow.OrgId,
+			Label:          action.Label,
+			Message:        approvalRequest.Message,
+			Fields:         getCommaList(approvalRequest.Fields),
+			Approvers:      getCommaList(approvalRequest.Approvers),
+			DefaultOutcome: defaultOutcome,
+			Status:         "pending",
+			Values:         []ApprovalValue{},
+			Created:        time.Now().Unix(),
+			Expires:        time.Now().Unix() + int64(expiry),
+		}
+
+		err = setApproval(ctx, approval)
+		if err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed saving the approval"}`))
+			return
+		}
+
+		log.Printf("[INFO] Waiting for approval %s of %s in %s", approval.Id, action.Label, workflowExecution.ExecutionId)
+	}
+
+	baseUrl := getApprovalBaseUrl(request)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "approval_id": "%s", "status": "%s", "expires": %d, "approve_url": "%s", "deny_url": "%s"}`, approval.Id, approval.Status, approval.Expires, getApprovalLink(baseUrl, approval, "approve"), getApprovalLink(baseUrl, approval, "deny"))))
+}
+
+// GET /api/v1/approvals - pending approvals in the org that the user can decide, with their links
+// GET /api/v1/approvals/{id}?token= - one approval, for the org or anyone with one of its links
+func handleGetApprovals(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := context.Background()
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) > 4 && len(location[4]) > 0 {
+		approval, err := getApproval(ctx, location[4])
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Approval doesn't exist"}`))
+			return
+		}
+
+		token := request.URL.Query().Get("token")
+		if !checkApprovalToken(*approval, "approve", token) && !checkApprovalToken(*approval, "deny", token) {
+			user, err := handleApiAuthentication(resp, request)
+			if err != nil || user.ActiveOrg.Id != approval.OrgId {
+				resp.WriteHeader(401)
+				resp.Write([]byte(`{"success": false}`))
+				return
+			}
+		}
+
+		newjson, err := json.Marshal(approval)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed unpacking approval"}`))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write(newjson)
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get approvals: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	q := datastore.NewQuery("approvals").Filter("org_id =", user.ActiveOrg.Id).Filter("status =", "pending")
+	var approvals []Approval
+	_, err = dbclient.GetAll(ctx, q, &approvals)
+	if err != nil {
+		log.Printf("Failed getting approvals for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting approvals"}`))
+		return
+	}
+
+	type approvalLinks struct {
+		Approval
+		ApproveUrl string `json:"approve_url"`
+		DenyUrl    string `json:"deny_url"`
+	}
+
+	baseUrl := getApprovalBaseUrl(request)
+	pending := []approvalLinks{}
+	for _, approval := range approvals {
+		if !canApprove(approval, user) {
+			continue
+		}
+
+		pending = append(pending, approvalLinks{
+			Approval:   approval,
+			ApproveUrl: getApprovalLink(baseUrl, approval, "approve"),
+			DenyUrl:    getApprovalLink(baseUrl, approval, "deny"),
+		})
+	}
+
+	newjson, err := json.Marshal(pending)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking approvals"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// The page an approval link opens. Following the link only shows it, so mail
+// scanners that open links can't decide anything. The form POSTs back to it
+func getApprovalPage(approval Approval, decision, location string) string {
+	fields := ""
+	for _, field := range approval.Fields {
+		fields += fmt.Sprintf(`<p><label>%s<br><input type="text" name="%s"></label></p>`, html.EscapeString(field), html.EscapeString(field))
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>Shuffle approval</title></head>
+<body>
+<h3>%s</h3>
+<p>%s</p>
+<form method="POST" action="%s">
+%s
+<button type="submit">%s</button>
+</form>
+</body>
+</html>`, html.EscapeString(approval.Label), html.EscapeString(approval.Message), html.EscapeString(location), fields, strings.Title(decision))
+}
+
+func writeApprovalPage(resp http.ResponseWriter, status int, message string) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.WriteHeader(status)
+	resp.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>Shuffle approval</title></head>
+<body><p>%s</p></body>
+</html>`, html.EscapeString(message))))
+}
+
+// GET /api/v1/approvals/{id}/approve?token= - a page to confirm the decision
+// POST /api/v1/approvals/{id}/approve?token=
+// POST /api/v1/approvals/{id}/deny?token=
+// The link only works once. Form fields go in the body as {"values": {...}},
+// or as form values when posted from the page
+func handleDecideApproval(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	// Links opened in a browser get pages back, the API gets JSON
+	isPage := request.Method == "GET" || strings.HasPrefix(request.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	fail := func(status int, reason string) {
+		if isPage {
+			writeApprovalPage(resp, status, reason)
+			return
+		}
+
+		newjson, _ := json.Marshal(map[string]interface{}{"success": false, "reason": reason})
+		resp.WriteHeader(status)
+		resp.Write(newjson)
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 || !arrayContainsString(approvalOutcomes, location[5]) {
+		fail(401, "Decision has to be approve or deny")
+		return
+	}
+
+	ctx := context.Background()
+	decision := location[5]
+	approval, err := getApproval(ctx, location[4])
+	if err != nil || !checkApprovalToken(*approval, decision, request.URL.Query().Get("token")) {
+		log.Printf("Bad approval link for %s", location[4])
+		fail(401, "Bad approval link")
+		return
+	}
+
+	if approval.Status != "pending" {
+		fail(401, fmt.Sprintf("The approval is already %s", approval.Status))
+		return
+	}
+
+	if request.Method == "GET" {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.WriteHeader(200)
+		resp.Write([]byte(getApprovalPage(*approval, decision, request.URL.RequestURI())))
+		return
+	}
+
+	// Logging in is only needed when there are approvers
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		user = User{}
+	}
+
+	if !canApprove(*approval, user) {
+		log.Printf("User %s isn't an approver of %s", user.Username, approval.Id)
+		fail(401, "You aren't an approver")
+		return
+	}
+
+	workflowExecution, err := getWorkflowExecution(ctx, approval.ExecutionId)
+	if err != nil || (workflowExecution.Status != "EXECUTING" && workflowExecution.Status != "PAUSED") {
+		fail(401, "The execution isn't running anymore")
+		return
+	}
+
+	waiting := false
+	for _, result := range workflowExecution.Results {
+		if result.Action.ID == approval.ActionId && result.Status == "EXECUTING" {
+			waiting = true
+			break
+		}
+	}
+
+	if !waiting {
+		fail(401, "The node isn't waiting for a decision")
+		return
+	}
+
+	if approval.Expires <= time.Now().Unix() {
+		newApproval, err := setApprovalDecision(ctx, *approval, approval.DefaultOutcome, "", []ApprovalValue{}, true)
+		if err != nil {
+			log.Printf("Failed expiring approval %s: %s", approval.Id, err)
+		}
+
+		fail(401, fmt.Sprintf("The approval expired and was %s", newApproval.Status))
+		return
+	}
+
+	var approvalDecision ApprovalDecision
+	if isPage {
+		err = request.ParseForm()
+		if err != nil {
+			fail(400, "Failed parsing form")
+			return
+		}
+
+		approvalDecision.Values = map[string]string{}
+		for name := range request.PostForm {
+			approvalDecision.Values[name] = request.PostForm.Get(name)
+		}
+	} else {
+		body, err := ioutil.ReadAll(request.Body)
+		if err == nil && len(body) > 0 {
+			err = json.Unmarshal(body, &approvalDecision)
+			if err != nil {
+				fail(401, "Failed parsing body")
+				return
+			}
+		}
+	}
+
+	values := []ApprovalValue{}
+	for _, field := range approval.Fields {
+		values = append(values, ApprovalValue{
+			Name:  field,
+			Value: approvalDecision.Values[field],
+		})
+	}
+
+	for name := range approvalDecision.Values {
+		if !arrayContainsString(approval.Fields, name) {
+			fail(401, fmt.Sprintf("%s isn't a field of the approval", name))
+			return
+		}
+	}
+
+	approver := user.Username
+	if len(approver) == 0 {
+		approver = "anonymous"
+	}
+
+	newApproval, err := setApprovalDecision(ctx, *approval, decision, approver, values, false)
+	if err != nil {
+		log.Printf("Failed deciding approval %s: %s", approval.Id, err)
+		fail(500, "Failed saving the decision")
+		return
+	}
+
+	addOrgAuditLog(ctx, request, user, approval.OrgId, fmt.Sprintf("approval.%s", decision), "execution", approval.ExecutionId, nil, map[string]interface{}{"approval_id": approval.Id, "action_id": approval.ActionId, "approver": approver, "values": values})
+
+	if isPage {
+		writeApprovalPage(resp, 200, fmt.Sprintf("The approval was %s. You can close this page.", newApproval.Status))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "status": "%s"}`, newApproval.Status)))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Append only. Nothing updates or deletes these
+type AuditLog struct {
+	Id         string `json:"id" datastore:"id"`
+	OrgId      string `json:"org_id" datastore:"org_id"`
+	UserId     string `json:"user_id" datastore:"user_id"`
+	Username   string `json:"username" datastore:"username"`
+	Action     string `json:"action" datastore:"action"`
+	TargetType string `json:"target_type" datastore:"target_type"`
+	TargetId   string `json:"target_id" datastore:"target_id"`
+	Diff       string `json:"diff" datastore:"diff,noindex"`
+	Ip         string `json:"ip" datastore:"ip"`
+	Timestamp  int64  `json:"timestamp" datastore:"timestamp"`
+}
+
+// Workflows are logged without their credentials and secret variables
+func getAuditValue(value interface{}) interface{} {
+	switch workflow := value.(type) {
+	case Workflow:
+		return stripWorkflowSecrets(workflow)
+	case *Workflow:
+		if workflow != nil {
+			return stripWorkflowSecrets(*workflow)
+		}
+	}
+
+	return value
+}
+
+// Returns the top level fields that changed as {"field": {"before": x, "after": y}}
+func getAuditDiff(before, after interface{}) string {
+	before = getAuditValue(before)
+	after = getAuditValue(after)
+
+	beforeMap := map[string]interface{}{}
+	afterMap := map[string]interface{}{}
+	if before != nil {
+		data, err := json.Marshal(before)
+		if err == nil {
+			json.Unmarshal(data, &beforeMap)
+		}
+	}
+
+	if after != nil {
+		data, err := json.Marshal(after)
+		if err == nil {
+			json.Unmarshal(data, &afterMap)
+		}
+	}
+
+	diff := map[string]map[string]interface{}{}
+	for key, value := range beforeMap {
+		if !reflect.DeepEqual(value, afterMap[key]) {
+			diff[key] = map[string]interface{}{"before": value, "after": afterMap[key]}
+		}
+	}
+
+	for key, value := range afterMap {
+		if _, ok := beforeMap[key]; !ok {
+			diff[key] = map[string]interface{}{"before": nil, "after": value}
+		}
+	}
+
+	// Never keep secrets in the log
+	for _, key := range []string{"password", "session", "apikey", "verification_token"} {
+		delete(diff, key)
+	}
+
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return "{}"
+	}
+
+	return string(data)
+}
+
+// Only what's needed to know which auth it was. The fields are secrets
+func getAuditAppAuth(appAuth AppAuthenticationStorage) map[string]interface{} {
+	fields := []string{}
+	for _, field := range appAuth.Fields {
+		fields = append(fields, field.Key)
+	}
+
+	return map[string]interface{}{
+		"label":  appAuth.Label,
+		"app":    appAuth.App.Name,
+		"fields": fields,
+	}
+}
+
+// Writes an entry for a change. before/after can be nil for creation and deletion.
+// Failing to write is logged, but doesn't stop the request.
+func addAuditLog(ctx context.Context, request *http.Request, user User, action, targetType, targetId string, before, after interface{}) {
+	auditLog := AuditLog{
+		Id:         uuid.NewV4().String(),
+		OrgId:      user.ActiveOrg.Id,
+		UserId:     user.Id,
+		Username:   user.Username,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Diff:       getAuditDiff(before, after),
+		Timestamp:  time.Now().Unix(),
+	}
+
+	if request != nil {
+		auditLog.Ip = getRequestIp(request)
+	}
+
+	key := datastore.NameKey("audit_logs", auditLog.Id, nil)
+	if _, err := dbclient.Put(ctx, key, &auditLog); err != nil {
+		log.Printf("Failed adding audit log for %s on %s %s: %s", action, targetType, targetId, err)
+	}
+}
+
+// For changes to an org that may not be the users' active one
+func addOrgAuditLog(ctx context.Context, request *http.Request, user User, orgId, action, targetType, targetId string, before, after interface{}) {
+	user.ActiveOrg.Id = orgId
+	addAuditLog(ctx, request, user, action, targetType, targetId, before, after)
+}
+
+// The newest entries of the org first. Every filter is in the query, with
+// indexes for them in index.yaml
+func getAuditLogs(ctx context.Context, orgId string, query url.Values, since, until int64, limit int) ([]AuditLog, error) {
+	q := datastore.NewQuery("audit_logs").Filter("org_id =", orgId)
+	for _, field := range []string{"user_id", "action", "target_type", "target_id"} {
+		if len(query.Get(field)) > 0 {
+			q = q.Filter(fmt.Sprintf("%s =", field), query.Get(field))
+		}
+	}
+
+	if since > 0 {
+		q = q.Filter("timestamp >=", since)
+	}
+
+	if until > 0 {
+		q = q.Filter("timestamp <=", until)
+	}
+
+	q = q.Order("-timestamp").Limit(limit)
+
+	auditLogs := []AuditLog{}
+	_, err := dbclient.GetAll(ctx, q, &auditLogs)
+	if err != nil {
+		return []AuditLog{}, err
+	}
+
+	return auditLogs, nil
+}
+
+// Admins can see the log of their org. Filters: user_id, action, target_type,
+// target_id, since, until and limit. format=jsonl gives one entry per line.
+func handleGetAuditLogs(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get audit logs: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You need to be admin to see the audit log"}`))
+		return
+	}
+
+	query := request.URL.Query()
+	limit := 100
+	if len(query.Get("limit")) > 0 {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+	}
+
+	var since, until int64
+	if len(query.Get("since")) > 0 {
+		since, _ = strconv.ParseInt(query.Get("since"), 10, 64)
+	}
+
+	if len(query.Get("until")) > 0 {
+		until, _ = strconv.ParseInt(query.Get("until"), 10, 64)
+	}
+
+	ctx := context.Background()
+	newLogs, err := getAuditLogs(ctx, user.ActiveOrg.Id, query, since, until, limit)
+	if err != nil {
+		log.Printf("Failed getting audit logs: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting audit logs"}`))
+		return
+	}
+
+	// IP lockouts where nobody knows which user was tried have no org. They
+	// show other orgs' IPs, so only admins of the instance see them
+	if isGlobalAdmin(user) && len(query.Get("user_id")) == 0 && (len(query.Get("action")) == 0 || query.Get("action") == "ip.lockout") && (len(query.Get("target_type")) == 0 || query.Get("target_type") == "ip") {
+		lockoutQuery := url.Values{}
+		lockoutQuery.Set("action", "ip.lockout")
+		lockoutQuery.Set("target_id", query.Get("target_id"))
+		lockoutLogs, err := getAuditLogs(ctx, "", lockoutQuery, since, until, limit)
+		if err != nil {
+			log.Printf("Failed getting lockout audit logs: %s", err)
+		}
+
+		newLogs = append(newLogs, lockoutLogs...)
+
+		sort.Slice(newLogs, func(i, j int) bool {
+			return newLogs[i].Timestamp > newLogs[j].Timestamp
+		})
+
+		if len(newLogs) > limit {
+			newLogs = newLogs[:limit]
+		}
+	}
+
+	if query.Get("format") == "jsonl" {
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+		resp.WriteHeader(200)
+		for _, item := range newLogs {
+			data, err := json.Marshal(item)
+			if err != nil {
+				continue
+			}
+
+			resp.Write(data)
+			resp.Write([]byte("\n"))
+		}
+
+		return
+	}
+
+	newjson, err := json.Marshal(newLogs)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking audit logs"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
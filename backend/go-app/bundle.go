@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Bumped when the format changes in a way older versions can't read
+const bundleVersion = 1
+
+// Everything needed to move a workflow to another Shuffle instance or org.
+// Secrets are never part of it.
+type WorkflowBundle struct {
+	Version        int          `json:"version"`
+	Exported       int64        `json:"exported"`
+	Workflow       Workflow     `json:"workflow"`
+	Apps           []BundleApp  `json:"apps"`
+	Triggers       []Trigger    `json:"triggers"`
+	Authentication []BundleAuth `json:"authentication"`
+}
+
+type BundleApp struct {
+	Name       string `json:"name"`
+	AppVersion string `json:"app_version"`
+}
+
+// An auth the workflow used. Id is from the exporting side and has to be
+// mapped to an auth that exists where it's imported.
+type BundleAuth struct {
+	Id         string   `json:"id"`
+	Label      string   `json:"label"`
+	AppName    string   `json:"app_name"`
+	AppVersion string   `json:"app_version"`
+	Fields     []string `json:"fields"`
+	Nodes      []string `json:"nodes"`
+}
+
+// Used when importing. Auth maps bundle auth IDs to local ones. An empty
+// value imports the nodes without auth.
+type BundleImport struct {
+	Bundle WorkflowBundle    `json:"bundle"`
+	Auth   map[string]string `json:"auth"`
+}
+
+// Variables with names like these have their values removed on export
+var secretNames = []string{"secret", "password", "passwd", "token", "key", "credential"}
+
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secretName := range secretNames {
+		if strings.Contains(name, secretName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes anything that can be a secret. Configuration parameters are
+// filled in from app auth when saving.
+func stripWorkflowSecrets(workflow Workflow) Workflow {
+	newActions := []Action{}
+	for _, action := range workflow.Actions {
+		newParams := []WorkflowAppActionParameter{}
+		for _, param := range action.Parameters {
+			if param.Configuration {
+				param.Value = ""
+			}
+
+			newParams = append(newParams, param)
+		}
+
+		action.Parameters = newParams
+		newActions = append(newActions, action)
+	}
+
+	workflow.Actions = newActions
+
+	// The variable slices are shared with the original
+	workflow.WorkflowVariables = append(workflow.WorkflowVariables[:0:0], workflow.WorkflowVariables...)
+	workflow.ExecutionVariables = append(workflow.ExecutionVariables[:0:0], workflow.ExecutionVariables...)
+	for index, variable := range workflow.WorkflowVariables {
+		if isSecretName(variable.Name) {
+			workflow.WorkflowVariables[index].Value = ""
+		}
+	}
+
+	for index := range workflow.ExecutionVariables {
+		workflow.ExecutionVariables[index].Value = ""
+	}
+
+	return workflow
+}
+
+// Puts back what stripWorkflowSecrets removed, from the stored version of the
+// same workflow. Matched by node ID and parameter name, and variable name
+func restoreWorkflowSecrets(workflow, oldWorkflow Workflow) Workflow {
+	oldParams := map[string]string{}
+	for _, action := range oldWorkflow.Actions {
+		for _, param := range action.Parameters {
+			if param.Configuration {
+				oldParams[fmt.Sprintf("%s_%s", action.ID, param.Name)] = param.Value
+			}
+		}
+	}
+
+	newActions := []Action{}
+	for _, action := range workflow.Actions {
+		newParams := []WorkflowAppActionParameter{}
+		for _, param := range action.Parameters {
+			if param.Configuration && len(param.Value) == 0 {
+				param.Value = oldParams[fmt.Sprintf("%s_%s", action.ID, param.Name)]
+			}
+
+			newParams = append(newParams, param)
+		}
+
+		action.Parameters = newParams
+		newActions = append(newActions, action)
+	}
+
+	workflow.Actions = newActions
+
+	for index, variable := range workflow.WorkflowVariables {
+		if !isSecretName(variable.Name) || len(variable.Value) > 0 {
+			continue
+		}
+
+		for _, oldVariable := range oldWorkflow.WorkflowVariables {
+			if oldVariable.Name == variable.Name {
+				workflow.WorkflowVariables[index].Value = oldVariable.Value
+				break
+			}
+		}
+	}
+
+	for index, variable := range workflow.ExecutionVariables {
+		if len(variable.Value) > 0 {
+			continue
+		}
+
+		for _, oldVariable := range oldWorkflow.ExecutionVariables {
+			if oldVariable.Name == variable.Name {
+				workflow.ExecutionVariables[index].Value = oldVariable.Value
+				break
+			}
+		}
+	}
+
+	return workflow
+}
+
+func getWorkflowBundle(ctx context.Context, workflow Workflow) (WorkflowBundle, error) {
+	bundle := WorkflowBundle{
+		Version:        bundleVersion,
+		Exported:       time.Now().Unix(),
+		Apps:           []BundleApp{},
+		Triggers:       []Trigger{},
+		Authentication: []BundleAuth{},
+	}
+
+	allAuths, err := getAllWorkflowAppAuth(ctx, workflow.OrgId)
+	if err != nil {
+		return bundle, err
+	}
+
+	// Copies, so the stripping doesn't change the slices of the original
+	workflowData, err := json.Marshal(workflow)
+	if err != nil {
+		return bundle, err
+	}
+
+	var newWorkflow Workflow
+	err = json.Unmarshal(workflowData, &newWorkflow)
+	if err != nil {
+		return bundle, err
+	}
+
+	authIndex := map[string]int{}
+	handledApps := []string{}
+	for _, action := range newWorkflow.Actions {
+		appKey := fmt.Sprintf("%s_%s", action.AppName, action.AppVersion)
+		if !arrayContainsString(handledApps, appKey) {
+			handledApps = append(handledApps, appKey)
+			bundle.Apps = append(bundle.Apps, BundleApp{
+				Name:       action.AppName,
+				AppVersion: action.AppVersion,
+			})
+		}
+
+		if len(action.AuthenticationId) == 0 {
+			continue
+		}
+
+		if index, ok := authIndex[action.AuthenticationId]; ok {
+			bundle.Authentication[index].Nodes = append(bundle.Authentication[index].Nodes, action.ID)
+			continue
+		}
+
+		bundleAuth := BundleAuth{
+			Id:         action.AuthenticationId,
+			AppName:    action.AppName,
+			AppVersion: action.AppVersion,
+			Fields:     []string{},
+			Nodes:      []string{action.ID},
+		}
+
+		for _, auth := range allAuths {
+			if auth.Id == action.AuthenticationId {
+				bundleAuth.Label = auth.Label
+				for _, field := range auth.Fields {
+					bundleAuth.Fields = append(bundleAuth.Fields, field.Key)
+				}
+
+				break
+			}
+		}
+
+		authIndex[action.AuthenticationId] = len(bundle.Authentication)
+		bundle.Authentication = append(bundle.Authentication, bundleAuth)
+	}
+
+	// Nothing is running where it's imported
+	for _, trigger := range newWorkflow.Triggers {
+		trigger.Status = "uninitialized"
+		bundle.Triggers = append(bundle.Triggers, trigger)
+	}
+
+	newWorkflow = stripWorkflowSecrets(newWorkflow)
+	newWorkflow.Triggers = []Trigger{}
+	newWorkflow.Schedules = []Schedule{}
+	newWorkflow.Owner = ""
+	newWorkflow.OrgId = ""
+	newWorkflow.Org = []Org{}
+	newWorkflow.ExecutingOrg = Org{}
+	newWorkflow.Revision = 0
+	newWorkflow.Published = 0
+	newWorkflow.PublishedRevisions = []int64{}
+	bundle.Workflow = newWorkflow
+
+	return bundle, nil
+}
+
+// Gives every node, branch and variable a new ID, so the same bundle can be
+// imported many times.
+func remapBundleIds(bundle WorkflowBundle) Workflow {
+	workflow := bundle.Workflow
+	idMap := map[string]string{}
+	getNewId := func(oldId string) string {
+		if len(oldId) == 0 {
+			return oldId
+		}
+
+		if newId, ok := idMap[oldId]; ok {
+			return newId
+		}
+
+		idMap[oldId] = uuid.NewV4().String()
+		return idMap[oldId]
+	}
+
+	workflow.ID = uuid.NewV4().String()
+	newActions := []Action{}
+	for _, action := range workflow.Actions {
+		action.ID = getNewId(action.ID)
+		newActions = append(newActions, action)
+	}
+
+	newTriggers := []Trigger{}
+	for _, trigger := range bundle.Triggers {
+		trigger.ID = getNewId(trigger.ID)
+		newTriggers = append(newTriggers, trigger)
+	}
+
+	newBranches := []Branch{}
+	for _, branch := range workflow.Branches {
+		branch.ID = getNewId(branch.ID)
+		branch.SourceID = getNewId(branch.SourceID)
+		branch.DestinationID = getNewId(branch.DestinationID)
+		newBranches = append(newBranches, branch)
+	}
+
+	for index, variable := range workflow.WorkflowVariables {
+		workflow.WorkflowVariables[index].ID = getNewId(variable.ID)
+	}
+
+	workflow.Start = getNewId(workflow.Start)
+	workflow.Actions = newActions
+	workflow.Triggers = newTriggers
+	workflow.Branches = newBranches
+	return workflow
+}
+
+func handleExportWorkflow(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in export workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting workflow to export: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	bundle, err := getWorkflowBundle(ctx, *workflow)
+	if err != nil {
+		log.Printf("Failed making bundle for %s: %s", workflow.ID, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making bundle"}`))
+		return
+	}
+
+	newjson, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking bundle"}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "workflow.export", "workflow", workflow.ID, nil, nil)
+
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, workflow.ID))
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Imports a bundle as a new workflow in the active org. Without mappings for
+// every auth in the bundle, it returns what needs to be mapped instead.
+// Missing apps don't stop the import, but their nodes are marked invalid.
+func handleImportWorkflow(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in import workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var bundleImport BundleImport
+	err = json.Unmarshal(body, &bundleImport)
+	if err != nil {
+		log.Printf("Failed bundle unmarshaling: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing bundle"}`))
+		return
+	}
+
+	bundle := bundleImport.Bundle
+	if bundle.Version == 0 || bundle.Version > bundleVersion {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Bundle version %d is not supported"}`, bundle.Version)))
+		return
+	}
+
+	ctx := context.Background()
+	allAuths, err := getAllWorkflowAppAuth(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("Failed getting app auth for import: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	// Asks for the auth that isn't mapped yet
+	if bundleImport.Auth == nil {
+		bundleImport.Auth = map[string]string{}
+	}
+
+	missingAuth := []BundleAuth{}
+	for _, bundleAuth := range bundle.Authentication {
+		newId, ok := bundleImport.Auth[bundleAuth.Id]
+		if !ok {
+			missingAuth = append(missingAuth, bundleAuth)
+			continue
+		}
+
+		if len(newId) == 0 {
+			continue
+		}
+
+		found := false
+		for _, auth := range allAuths {
+			if auth.Id == newId {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "App auth %s doesn't exist"}`, newId)))
+			return
+		}
+	}
+
+	if len(missingAuth) > 0 {
+		type availableAuth struct {
+			Id         string `json:"id"`
+			Label      string `json:"label"`
+			AppName    string `json:"app_name"`
+			AppVersion string `json:"app_version"`
+		}
+
+		available := []availableAuth{}
+		for _, auth := range allAuths {
+			available = append(available, availableAuth{
+				Id:         auth.Id,
+				Label:      auth.Label,
+				AppName:    auth.App.Name,
+				AppVersion: auth.App.AppVersion,
+			})
+		}
+
+		missingJson, _ := json.Marshal(missingAuth)
+		availableJson, _ := json.Marshal(available)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Map the app auth in the bundle to existing auth", "auth_required": %s, "available_auth": %s}`, string(missingJson), string(availableJson))))
+		return
+	}
+
+	workflowApps, err := getAllWorkflowApps(ctx)
+	if err != nil {
+		log.Printf("Failed getting apps for import: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	workflow := remapBundleIds(bundle)
+	missingApps := []BundleApp{}
+	newActions := []Action{}
+	for _, action := range workflow.Actions {
+		found := false
+		for _, app := range workflowApps {
+			if app.Name == action.AppName && app.AppVersion == action.AppVersion {
+				action.AppID = app.ID
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			action.IsValid = false
+
+			missing := BundleApp{Name: action.AppName, AppVersion: action.AppVersion}
+			alreadyMissing := false
+			for _, app := range missingApps {
+				if app == missing {
+					alreadyMissing = true
+					break
+				}
+			}
+
+			if !alreadyMissing {
+				missingApps = append(missingApps, missing)
+			}
+		}
+
+		if len(action.AuthenticationId) > 0 {
+			action.AuthenticationId = bundleImport.Auth[action.AuthenticationId]
+		}
+
+		newActions = append(newActions, action)
+	}
+
+	workflow.Actions = newActions
+	workflow.Owner = user.Id
+	workflow.OrgId = user.ActiveOrg.Id
+	workflow.Sharing = "private"
+	workflow.Schedules = []Schedule{}
+	workflow.Published = 0
+	workflow.PublishedRevisions = []int64{}
+	workflow, err = getValidatedWorkflow(ctx, workflow, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("Failed validating imported workflow %s: %s", workflow.ID, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	// It can't run before the apps are there
+	for _, app := range missingApps {
+		workflow.Errors = append(workflow.Errors, fmt.Sprintf("App %s:%s is missing", app.Name, app.AppVersion))
+		workflow.IsValid = false
+	}
+
+	workflow, err = setWorkflowRevision(ctx, user, workflow, "Imported from bundle")
+	if err != nil {
+		log.Printf("Failed setting imported workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	go syncGitWorkflow(user, workflow)
+
+	err = increaseStatisticsField(ctx, "total_workflows", workflow.ID, 1)
+	if err != nil {
+		log.Printf("Failed to increase total workflows stats: %s", err)
+	}
+
+	addAuditLog(ctx, request, user, "workflow.import", "workflow", workflow.ID, nil, workflow)
+
+	missingJson, _ := json.Marshal(missingApps)
+	log.Printf("Imported workflow %s from bundle with %d missing app(s)", workflow.ID, len(missingApps))
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "missing_apps": %s}`, workflow.ID, string(missingJson))))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Seconds without any activity before a running execution stops counting
+// against the limits. A worker that died leaves its execution EXECUTING
+var staleExecutionTimeout int64 = 3600
+
+// Priority from the request, or from the start node. Higher runs first
+func getExecutionPriority(workflow Workflow, start string, priority int) int {
+	if priority != 0 {
+		return priority
+	}
+
+	if len(start) == 0 {
+		start = workflow.Start
+	}
+
+	for _, action := range workflow.Actions {
+		if action.ID == start {
+			return action.Priority
+		}
+	}
+
+	return 0
+}
+
+// Running executions of the org that weren't stale. Only the keys are read,
+// as Orborus asks for every environment a few seconds apart
+func getRunningExecutionIds(ctx context.Context, orgId string, filter string, value string) ([]string, error) {
+	q := datastore.NewQuery("workflowexecution").Filter("org_id =", orgId).Filter("status =", "EXECUTING").Filter(filter, value)
+	q = q.Filter("last_activity >", time.Now().Unix()-staleExecutionTimeout).KeysOnly()
+	keys, err := dbclient.GetAll(ctx, q, nil)
+	if err != nil {
+		return []string{}, err
+	}
+
+	executionIds := []string{}
+	for _, key := range keys {
+		executionIds = append(executionIds, key.Name)
+	}
+
+	return executionIds, nil
+}
+
+// Executions that released their worker while waiting for subflows, loops
+// or approvals. They don't hold a worker until they're queued again
+func getWaitingExecutionIds(ctx context.Context, executionIds []string) (map[string]bool, error) {
+	waiting := map[string]bool{}
+	for start := 0; start < len(executionIds); start += 1000 {
+		end := start + 1000
+		if end > len(executionIds) {
+			end = len(executionIds)
+		}
+
+		keys := []*datastore.Key{}
+		for _, executionId := range executionIds[start:end] {
+			keys = append(keys, datastore.NameKey("waiting_executions", strings.ToLower(executionId), nil))
+		}
+
+		waitingExecutions := make([]WaitingExecution, len(keys))
+		err := dbclient.GetMulti(ctx, keys, waitingExecutions)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return waiting, err
+		}
+
+		for index, key := range keys {
+			if isMulti && multiErr[index] != nil {
+				if multiErr[index] != datastore.ErrNoSuchEntity {
+					return waiting, multiErr[index]
+				}
+
+				continue
+			}
+
+			waiting[key.Name] = true
+		}
+	}
+
+	return waiting, nil
+}
+
+// The last time the execution or one of its nodes started or finished
+func getLastActivity(workflowExecution WorkflowExecution) int64 {
+	lastActivity := workflowExecution.StartedAt
+	for _, result := range workflowExecution.Results {
+		if result.StartedAt > lastActivity {
+			lastActivity = result.StartedAt
+		}
+
+		if result.CompletedAt > lastActivity {
+			lastActivity = result.CompletedAt
+		}
+	}
+
+	return lastActivity
+}
+
+// Kept indexed on the execution, so the limits can be counted with queries
+// instead of loading the workflows and results
+func setConcurrencyFields(workflowExecution *WorkflowExecution) {
+	environments := []string{}
+	for _, action := range workflowExecution.Workflow.Actions {
+		environment := strings.ToLower(action.Environment)
+		if len(environment) > 0 && !arrayContainsString(environments, environment) {
+			environments = append(environments, environment)
+		}
+	}
+
+	workflowExecution.Environments = environments
+	workflowExecution.LastActivity = getLastActivity(*workflowExecution)
+}
+
+// The requests Orborus can start now, highest priority first. Executions
+// that are still queued, wait without a worker or went stale don't count as
+// running. The rest wait in the queue until something finishes
+func getRunnableRequests(ctx context.Context, orgId, environment string, executionRequests []ExecutionRequest) []ExecutionRequest {
+	requests := make([]ExecutionRequest, len(executionRequests))
+	copy(requests, executionRequests)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Priority > requests[j].Priority
+	})
+
+	maxConcurrency := 0
+	if len(environment) > 0 {
+		environments, err := getEnvironments(ctx, orgId)
+		if err == nil {
+			for _, env := range environments {
+				if strings.EqualFold(env.Name, environment) {
+					maxConcurrency = env.MaxConcurrency
+					break
+				}
+			}
+		}
+	}
+
+	// Aborts never wait. They don't start anything
+	aborts := []ExecutionRequest{}
+	starts := []ExecutionRequest{}
+	for _, request := range requests {
+		if request.Status == "ABORT" {
+			aborts = append(aborts, request)
+		} else {
+			starts = append(starts, request)
+		}
+	}
+
+	requests = starts
+	limited := maxConcurrency > 0
+	queued := map[string]bool{}
+	for _, request := range requests {
+		queued[request.ExecutionId] = true
+		if request.WorkflowConcurrency > 0 {
+			limited = true
+		}
+	}
+
+	if !limited {
+		return append(aborts, requests...)
+	}
+
+	var err error
+	environmentIds := []string{}
+	if maxConcurrency > 0 {
+		environmentIds, err = getRunningExecutionIds(ctx, orgId, "environments =", strings.ToLower(environment))
+		if err != nil {
+			log.Printf("Failed getting running executions for %s in %s: %s", orgId, environment, err)
+			return aborts
+		}
+	}
+
+	runningIds := environmentIds
+	workflowIds := map[string][]string{}
+	for _, request := range requests {
+		if request.WorkflowConcurrency <= 0 {
+			continue
+		}
+
+		if _, ok := workflowIds[request.WorkflowId]; ok {
+			continue
+		}
+
+		executionIds, err := getRunningExecutionIds(ctx, orgId, "workflow_id =", request.WorkflowId)
+		if err != nil {
+			log.Printf("Failed getting running executions for workflow %s: %s", request.WorkflowId, err)
+			return aborts
+		}
+
+		workflowIds[request.WorkflowId] = executionIds
+		runningIds = append(runningIds, executionIds...)
+	}
+
+	waiting, err := getWaitingExecutionIds(ctx, runningIds)
+	if err != nil {
+		log.Printf("Failed getting waiting executions: %s", err)
+	}
+
+	isRunning := func(executionId string) bool {
+		return !queued[executionId] && !waiting[strings.ToLower(executionId)]
+	}
+
+	environmentRunning := 0
+	for _, executionId := range environmentIds {
+		if isRunning(executionId) {
+			environmentRunning += 1
+		}
+	}
+
+	workflowRunning := map[string]int{}
+	for workflowId, executionIds := range workflowIds {
+		for _, executionId := range executionIds {
+			if isRunning(executionId) {
+				workflowRunning[workflowId] += 1
+			}
+		}
+	}
+
+	runnable := aborts
+	for _, request := range requests {
+		if maxConcurrency > 0 && environmentRunning >= maxConcurrency {
+			break
+		}
+
+		if request.WorkflowConcurrency > 0 && workflowRunning[request.WorkflowId] >= request.WorkflowConcurrency {
+			continue
+		}
+
+		environmentRunning += 1
+		workflowRunning[request.WorkflowId] += 1
+		runnable = append(runnable, request)
+	}
+
+	if len(runnable)-len(aborts) < len(requests) {
+		log.Printf("[INFO] Holding back %d of %d queued executions in %s because of concurrency limits", len(requests)-len(runnable)+len(aborts), len(requests), environment)
+	}
+
+	return runnable
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// What an action returns in a dry run instead of running the app. ActionId
+// can also be the label. Status is SUCCESS unless set, e.g. to FAILURE to try
+// error branches
+type ActionMock struct {
+	ActionId string `json:"action_id" datastore:"action_id"`
+	Status   string `json:"status" datastore:"status"`
+	Result   string `json:"result" datastore:"result,noindex"`
+}
+
+// Dry runs don't count in the statistics
+func increaseExecutionStatistics(ctx context.Context, workflowExecution WorkflowExecution, fieldname string, amount int64) error {
+	if workflowExecution.DryRun {
+		return nil
+	}
+
+	return increaseStatisticsField(ctx, fieldname, workflowExecution.Workflow.ID, amount)
+}
+
+// The example the app gives for what the action returns
+func getDryRunExample(apps []WorkflowApp, action Action) string {
+	for _, app := range apps {
+		if app.ID != action.AppID && (app.Name != action.AppName || app.AppVersion != action.AppVersion) {
+			continue
+		}
+
+		for _, appAction := range app.Actions {
+			if appAction.Name == action.Name {
+				return appAction.Returns.Example
+			}
+		}
+	}
+
+	return ""
+}
+
+// Fills in the examples the worker returns for actions without one. Built-in
+// actions run like normal, so they don't need any
+func setDryRunExamples(ctx context.Context, actions []Action) []Action {
+	apps := []WorkflowApp{}
+	newActions := []Action{}
+	for _, action := range actions {
+		if len(strings.TrimSpace(action.Example)) == 0 && !arrayContainsString(builtinApps, action.AppID) {
+			if len(apps) == 0 {
+				apps, _ = getAllWorkflowApps(ctx)
+			}
+
+			action.Example = getDryRunExample(apps, action)
+		}
+
+		newActions = append(newActions, action)
+	}
+
+	return newActions
+}
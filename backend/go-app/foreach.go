@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var maxForeachItems = 1000
+var maxForeachConcurrency = 20
+
+// Results above this are replaced, as an entity can't be more than 1MB
+var maxForeachResultSize = 512000
+
+// One per for-each node in an execution. Every item runs the nodes under it
+// once, in an execution of the same workflow. Items up to Next have been
+// started. The items themselves are ForeachItems, so the state stays small
+type ForeachState struct {
+	ExecutionId string `json:"execution_id" datastore:"execution_id"`
+	ActionId    string `json:"action_id" datastore:"action_id"`
+	Concurrency int    `json:"concurrency" datastore:"concurrency"`
+	Total       int    `json:"total" datastore:"total"`
+	Next        int    `json:"next" datastore:"next"`
+	Running     int    `json:"running" datastore:"running"`
+	Done        int    `json:"done" datastore:"done"`
+	Finished    bool   `json:"finished" datastore:"finished"`
+	Created     int64  `json:"created" datastore:"created"`
+}
+
+// An item of a for-each node. Status is empty until its execution starts
+type ForeachItem struct {
+	ExecutionId     string `json:"execution_id" datastore:"execution_id"`
+	ActionId        string `json:"action_id" datastore:"action_id"`
+	Index           int    `json:"index" datastore:"index"`
+	Item            string `json:"item" datastore:"item,noindex"`
+	ItemExecutionId string `json:"item_execution_id" datastore:"item_execution_id"`
+	Status          string `json:"status" datastore:"status"`
+	Result          string `json:"result" datastore:"result,noindex"`
+}
+
+type ForeachRequest struct {
+	ExecutionId   string   `json:"execution_id"`
+	Authorization string   `json:"authorization"`
+	ActionId      string   `json:"action_id"`
+	Items         []string `json:"items"`
+	Concurrency   int      `json:"concurrency"`
+}
+
+func getForeachKey(executionId, actionId string) *datastore.Key {
+	return datastore.NameKey("foreach", fmt.Sprintf("%s_%s", executionId, actionId), nil)
+}
+
+func getForeachItemKey(executionId, actionId string, index int) *datastore.Key {
+	return datastore.NameKey("foreach_items", fmt.Sprintf("%s_%s_%d", executionId, actionId, index), nil)
+}
+
+func getForeachState(ctx context.Context, executionId, actionId string) (*ForeachState, error) {
+	state := &ForeachState{}
+	if err := dbclient.Get(ctx, getForeachKey(executionId, actionId), state); err != nil {
+		return &ForeachState{}, err
+	}
+
+	return state, nil
+}
+
+func getForeachItem(ctx context.Context, executionId, actionId string, index int) (*ForeachItem, error) {
+	item := &ForeachItem{}
+	if err := dbclient.Get(ctx, getForeachItemKey(executionId, actionId, index), item); err != nil {
+		return &ForeachItem{}, err
+	}
+
+	return item, nil
+}
+
+// Every item of the loop, in order. Gets are limited to 1000 keys at a time
+func getForeachItems(ctx context.Context, state ForeachState) ([]ForeachItem, error) {
+	items := make([]ForeachItem, state.Total)
+	for start := 0; start < state.Total; start += 1000 {
+		end := start + 1000
+		if end > state.Total {
+			end = state.Total
+		}
+
+		keys := []*datastore.Key{}
+		for index := start; index < end; index++ {
+			keys = append(keys, getForeachItemKey(state.ExecutionId, state.ActionId, index))
+		}
+
+		if err := dbclient.GetMulti(ctx, keys, items[start:end]); err != nil {
+			return []ForeachItem{}, err
+		}
+	}
+
+	return items, nil
+}
+
+// Puts are limited to 500 entities at a time
+func setForeachItems(ctx context.Context, items []ForeachItem) error {
+	for start := 0; start < len(items); start += 500 {
+		end := start + 500
+		if end > len(items) {
+			end = len(items)
+		}
+
+		keys := []*datastore.Key{}
+		for _, item := range items[start:end] {
+			keys = append(keys, getForeachItemKey(item.ExecutionId, item.ActionId, item.Index))
+		}
+
+		if _, err := dbclient.PutMulti(ctx, keys, items[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isForeachItemDone(item ForeachItem) bool {
+	return len(item.Status) > 0 && item.Status != "EXECUTING"
+}
+
+// Changes the item at index, if any, and the state in a transaction. update
+// returns whether it finished the item. The items that can start next are
+// claimed here, so only this change starts them. Returns the state, the
+// items to start and whether this change finished the loop
+func updateForeachState(ctx context.Context, executionId, actionId string, index int, update func(item *ForeachItem) bool) (ForeachState, []int, bool, error) {
+	key := getForeachKey(executionId, actionId)
+	state := ForeachState{}
+	start := []int{}
+	finished := false
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		state = ForeachState{}
+		start = []int{}
+		finished = false
+		if err := tx.Get(key, &state); err != nil {
+			return err
+		}
+
+		if state.Finished {
+			return nil
+		}
+
+		if index >= 0 && index < state.Next {
+			itemKey := getForeachItemKey(executionId, actionId, index)
+			item := ForeachItem{}
+			if err := tx.Get(itemKey, &item); err != nil {
+				return err
+			}
+
+			wasDone := isForeachItemDone(item)
+			if update(&item) && !wasDone && isForeachItemDone(item) {
+				state.Running -= 1
+				state.Done += 1
+			}
+
+			if len(item.Result) > maxForeachResultSize {
+				item.Result = fmt.Sprintf("The result of item %d was more than %d bytes", index, maxForeachResultSize)
+				item.Status = "FAILURE"
+			}
+
+			if _, err := tx.Put(itemKey, &item); err != nil {
+				return err
+			}
+		}
+
+		for state.Running < state.Concurrency && state.Next < state.Total {
+			start = append(start, state.Next)
+			state.Next += 1
+			state.Running += 1
+		}
+
+		if state.Done >= state.Total {
+			state.Finished = true
+			finished = true
+		}
+
+		_, err := tx.Put(key, &state)
+		return err
+	})
+
+	return state, start, finished, err
+}
+
+// Applies the change, then starts the items it claimed and finishes the node
+// if it was the last change
+func runForeachUpdate(ctx context.Context, executionId, actionId string, index int, update func(item *ForeachItem) bool) error {
+	state, start, finished, err := updateForeachState(ctx, executionId, actionId, index, update)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range start {
+		startForeachItem(ctx, state, index)
+	}
+
+	if finished {
+		return finishForeach(ctx, state)
+	}
+
+	return nil
+}
+
+// Runs the nodes under the for-each node with the item as the node's result
+func startForeachExecution(workflowExecution WorkflowExecution, actionId string, index int, item string) (WorkflowExecution, string, error) {
+	executionBody, err := json.Marshal(ExecutionRequest{
+		ExecutionArgument:   item,
+		ExecutionSource:     "foreach",
+		Start:               actionId,
+		ParentExecutionId:   workflowExecution.ExecutionId,
+		ParentActionId:      actionId,
+		ParentAuthorization: workflowExecution.Authorization,
+		ForeachIndex:        index,
+		DryRun:              workflowExecution.DryRun,
+		Mocks:               workflowExecution.Mocks,
+	})
+	if err != nil {
+		return WorkflowExecution{}, "Failed making foreach request", err
+	}
+
+	executionRequest, err := http.NewRequest("POST", fmt.Sprintf("/api/v1/workflows/%s/execute", workflowExecution.Workflow.ID), bytes.NewReader(executionBody))
+	if err != nil {
+		return WorkflowExecution{}, "Failed making foreach request", err
+	}
+
+	return handleExecution(workflowExecution.Workflow.ID, workflowExecution.Workflow, executionRequest)
+}
+
+// Starts one item, unless the execution stopped since the item was claimed
+func startForeachItem(ctx context.Context, state ForeachState, index int) {
+	status := "EXECUTING"
+	result := ""
+	itemExecutionId := ""
+	workflowExecution, err := getWorkflowExecution(ctx, state.ExecutionId)
+	item, itemErr := getForeachItem(ctx, state.ExecutionId, state.ActionId, index)
+	if err != nil || itemErr != nil {
+		status = "FAILURE"
+		result = fmt.Sprintf("Failed getting item %d of execution %s", index, state.ExecutionId)
+	} else if workflowExecution.Status != "EXECUTING" {
+		status = "ABORTED"
+		result = fmt.Sprintf("Execution has status %s", workflowExecution.Status)
+	} else {
+		itemExecution, executionResp, err := startForeachExecution(*workflowExecution, state.ActionId, index, item.Item)
+		if err != nil {
+			log.Printf("Failed starting item %d of foreach %s: %s", index, state.ActionId, err)
+			status = "FAILURE"
+			result = executionResp
+		} else {
+			itemExecutionId = itemExecution.ExecutionId
+		}
+	}
+
+	// The item might already be done
+	err = runForeachUpdate(ctx, state.ExecutionId, state.ActionId, index, func(item *ForeachItem) bool {
+		if len(itemExecutionId) > 0 {
+			item.ItemExecutionId = itemExecutionId
+		}
+
+		if len(item.Status) > 0 {
+			return false
+		}
+
+		item.Status = status
+		item.Result = result
+		return true
+	})
+
+	if err != nil {
+		log.Printf("Failed updating item %d of foreach %s: %s", index, state.ActionId, err)
+	}
+}
+
+// Stores the result of an item's execution, starts the next items and
+// finishes the node when every item is done
+func setForeachResult(ctx context.Context, workflowExecution WorkflowExecution) error {
+	return runForeachUpdate(ctx, workflowExecution.ParentExecutionId, workflowExecution.ParentActionId, workflowExecution.ForeachIndex, func(item *ForeachItem) bool {
+		if isForeachItemDone(*item) {
+			return false
+		}
+
+		if len(item.ItemExecutionId) > 0 && item.ItemExecutionId != workflowExecution.ExecutionId {
+			return false
+		}
+
+		item.ItemExecutionId = workflowExecution.ExecutionId
+		item.Status = workflowExecution.Status
+		item.Result = workflowExecution.Result
+		return true
+	})
+}
+
+// JSON results stay JSON
+func getForeachValue(result string) interface{} {
+	var parsed interface{}
+	err := json.Unmarshal([]byte(result), &parsed)
+	if err != nil {
+		return result
+	}
+
+	return parsed
+}
+
+// Results are in the same order as the items
+func getForeachResult(items []ForeachItem) (string, string) {
+	status := "SUCCESS"
+	results := []interface{}{}
+	for _, item := range items {
+		if item.Status != "FINISHED" {
+			status = "FAILURE"
+		}
+
+		results = append(results, getForeachValue(item.Result))
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return "[]", "FAILURE"
+	}
+
+	return string(data), status
+}
+
+// An item's execution only runs what's under the for-each node. The node
+// has the item as its result. Nodes before it keep their results from the
+// parent so they can be referenced, and the rest are skipped
+func getForeachItemResults(workflowExecution WorkflowExecution, parentExecution WorkflowExecution, childNodes []string) []ActionResult {
+	results := []ActionResult{}
+	for _, action := range workflowExecution.Workflow.Actions {
+		if action.ID != workflowExecution.Start && arrayContainsString(childNodes, action.ID) {
+			continue
+		}
+
+		result := ActionResult{
+			Action:        action,
+			ExecutionId:   workflowExecution.ExecutionId,
+			Authorization: workflowExecution.Authorization,
+			Result:        "Skipped because it's not in the loop",
+			Status:        "SKIPPED",
+		}
+
+		if action.ID == workflowExecution.Start {
+			result.Result = workflowExecution.ExecutionArgument
+			result.StartedAt = workflowExecution.StartedAt
+			result.CompletedAt = workflowExecution.StartedAt
+			result.Status = "SUCCESS"
+		} else {
+			for _, parentResult := range parentExecution.Results {
+				if parentResult.Action.ID == action.ID && (parentResult.Status == "SUCCESS" || parentResult.Status == "FINISHED") {
+					result.Result = parentResult.Result
+					result.StartedAt = parentResult.StartedAt
+					result.CompletedAt = parentResult.CompletedAt
+					result.Status = parentResult.Status
+					result.Decisions = parentResult.Decisions
+					break
+				}
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Gives every node under the for-each node the list of its results from the
+// items, then the for-each node the result of every item. The worker doesn't
+// run the nodes under it in this execution
+func finishForeach(ctx context.Context, state ForeachState) error {
+	parentExecution, err := getWorkflowExecution(ctx, state.ExecutionId)
+	if err != nil {
+		return err
+	}
+
+	if parentExecution.Status != "EXECUTING" && parentExecution.Status != "PAUSED" {
+		log.Printf("Not finishing foreach %s as %s has status %s", state.ActionId, parentExecution.ExecutionId, parentExecution.Status)
+		return nil
+	}
+
+	items, err := getForeachItems(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	itemExecutions := make([]*WorkflowExecution, len(items))
+	for index, item := range items {
+		if len(item.ItemExecutionId) == 0 {
+			continue
+		}
+
+		itemExecution, err := getWorkflowExecution(ctx, item.ItemExecutionId)
+		if err != nil {
+			log.Printf("Failed getting item %d of foreach %s: %s", index, state.ActionId, err)
+			continue
+		}
+
+		itemExecutions[index] = itemExecution
+	}
+
+	for _, nodeId := range findChildNodes(*parentExecution, state.ActionId) {
+		if nodeId == state.ActionId {
+			continue
+		}
+
+		action := Action{}
+		for _, curAction := range parentExecution.Workflow.Actions {
+			if curAction.ID == nodeId {
+				action = curAction
+				break
+			}
+		}
+
+		if len(action.ID) == 0 {
+			continue
+		}
+
+		// Null for items that didn't run the node
+		values := []interface{}{}
+		for _, itemExecution := range itemExecutions {
+			var value interface{}
+			if itemExecution != nil {
+				for _, result := range itemExecution.Results {
+					if result.Action.ID == nodeId && result.Status != "SKIPPED" {
+						value = getForeachValue(result.Result)
+						break
+					}
+				}
+			}
+
+			values = append(values, value)
+		}
+
+		data, err := json.Marshal(values)
+		if err != nil {
+			data = []byte("[]")
+		}
+
+		err = setExecutionResult(ActionResult{
+			Action:        action,
+			ExecutionId:   parentExecution.ExecutionId,
+			Authorization: parentExecution.Authorization,
+			Result:        string(data),
+			StartedAt:     state.Created,
+			CompletedAt:   int64(time.Now().Unix()),
+			Status:        "SUCCESS",
+		})
+		if err != nil {
+			log.Printf("Failed setting loop result of %s in %s: %s", action.Label, parentExecution.ExecutionId, err)
+		}
+	}
+
+	result, status := getForeachResult(items)
+	return setParentResult(ctx, state.ExecutionId, state.ActionId, result, status)
+}
+
+// Called by the worker when it reaches a for-each node
+func handleRunForeach(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for foreach")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var foreach ForeachRequest
+	err = json.Unmarshal(body, &foreach)
+	if err != nil {
+		log.Printf("Failed foreach unmarshaling: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflowExecution, err := getWorkflowExecution(ctx, foreach.ExecutionId)
+	if err != nil || workflowExecution.Authorization != foreach.Authorization {
+		log.Printf("Bad authorization key when starting foreach from %s", foreach.ExecutionId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad authorization key or execution_id might not exist."}`))
+		return
+	}
+
+	if workflowExecution.Status != "EXECUTING" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution has status %s"}`, workflowExecution.Status)))
+		return
+	}
+
+	if len(foreach.Items) == 0 || len(foreach.Items) > maxForeachItems {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can loop over 1 to %d items"}`, maxForeachItems)))
+		return
+	}
+
+	depth := getSubflowDepth(ctx, *workflowExecution)
+	if depth >= maxSubflowDepth {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Loops and subflows can only be %d levels deep"}`, maxSubflowDepth)))
+		return
+	}
+
+	if foreach.Concurrency <= 0 {
+		foreach.Concurrency = 1
+	} else if foreach.Concurrency > maxForeachConcurrency {
+		foreach.Concurrency = maxForeachConcurrency
+	}
+
+	state := ForeachState{
+		ExecutionId: workflowExecution.ExecutionId,
+		ActionId:    foreach.ActionId,
+		Concurrency: foreach.Concurrency,
+		Total:       len(foreach.Items),
+		Created:     int64(time.Now().Unix()),
+	}
+
+	// Stored first so a second request for the node is refused. Nothing
+	// starts before the items are stored
+	key := getForeachKey(state.ExecutionId, state.ActionId)
+	_, err = dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := tx.Get(key, &ForeachState{})
+		if err == nil {
+			return errors.New("The foreach is already running")
+		}
+
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err = tx.Put(key, &state)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Failed storing foreach %s in %s: %s", foreach.ActionId, workflowExecution.ExecutionId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	items := []ForeachItem{}
+	for index, item := range foreach.Items {
+		items = append(items, ForeachItem{
+			ExecutionId: state.ExecutionId,
+			ActionId:    state.ActionId,
+			Index:       index,
+			Item:        item,
+		})
+	}
+
+	err = setForeachItems(ctx, items)
+	if err != nil {
+		log.Printf("Failed storing items of foreach %s in %s: %s", foreach.ActionId, workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed storing the items"}`))
+		return
+	}
+
+	err = runForeachUpdate(ctx, state.ExecutionId, state.ActionId, -1, func(item *ForeachItem) bool { return false })
+	if err != nil {
+		log.Printf("Failed starting foreach %s in %s: %s", foreach.ActionId, workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed starting the items"}`))
+		return
+	}
+
+	log.Printf("[INFO] Started foreach %s over %d items in %s", foreach.ActionId, len(foreach.Items), workflowExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "items": %d, "concurrency": %d}`, len(foreach.Items), foreach.Concurrency)))
+}
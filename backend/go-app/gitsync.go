@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	newscheduler "github.com/carlescere/scheduler"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// Seconds between pulls. Override with GIT_SYNC_INTERVAL
+var gitSyncInterval = 300
+
+// One sync at a time, so pushes and pulls don't race each other
+var gitSyncLock sync.Mutex
+
+// Per org. Key = org id. The token is never returned from the API
+type GitSync struct {
+	OrgId      string   `json:"org_id" datastore:"org_id"`
+	Enabled    bool     `json:"enabled" datastore:"enabled"`
+	Url        string   `json:"url" datastore:"url,noindex"`
+	Branch     string   `json:"branch" datastore:"branch,noindex"`
+	Folder     string   `json:"folder" datastore:"folder,noindex"`
+	Username   string   `json:"username" datastore:"username,noindex"`
+	Token      string   `json:"-" datastore:"token,noindex"`
+	CreatedBy  string   `json:"created_by" datastore:"created_by,noindex"`
+	LastSync   int64    `json:"last_sync" datastore:"last_sync,noindex"`
+	LastCommit string   `json:"last_commit" datastore:"last_commit,noindex"`
+	LastError  string   `json:"last_error" datastore:"last_error,noindex"`
+	Conflicts  []string `json:"conflicts" datastore:"conflicts,noindex"`
+}
+
+// What was last synced for a workflow. Key = <org id>_<workflow id>.
+// Both sides changing since then is a conflict.
+type gitSyncState struct {
+	FileHash string `datastore:"file_hash,noindex"`
+	Revision int64  `datastore:"revision,noindex"`
+}
+
+func getGitSync(ctx context.Context, orgId string) (*GitSync, error) {
+	key := datastore.NameKey("git_sync", orgId, nil)
+	gitSync := &GitSync{}
+	if err := dbclient.Get(ctx, key, gitSync); err != nil {
+		return &GitSync{}, err
+	}
+
+	return gitSync, nil
+}
+
+func setGitSync(ctx context.Context, gitSync GitSync) error {
+	key := datastore.NameKey("git_sync", gitSync.OrgId, nil)
+	if _, err := dbclient.Put(ctx, key, &gitSync); err != nil {
+		log.Printf("Error setting git sync for %s: %s", gitSync.OrgId, err)
+		return err
+	}
+
+	return nil
+}
+
+func getGitSyncState(ctx context.Context, orgId, workflowId string) (*gitSyncState, error) {
+	key := datastore.NameKey("git_sync_state", fmt.Sprintf("%s_%s", orgId, workflowId), nil)
+	state := &gitSyncState{}
+	if err := dbclient.Get(ctx, key, state); err != nil {
+		return &gitSyncState{}, err
+	}
+
+	return state, nil
+}
+
+func setGitSyncState(ctx context.Context, orgId, workflowId string, state gitSyncState) error {
+	key := datastore.NameKey("git_sync_state", fmt.Sprintf("%s_%s", orgId, workflowId), nil)
+	if _, err := dbclient.Put(ctx, key, &state); err != nil {
+		log.Printf("Error setting git sync state for %s: %s", workflowId, err)
+		return err
+	}
+
+	return nil
+}
+
+func getGitSyncPath(gitSync GitSync, workflowId string) string {
+	return strings.TrimPrefix(path.Join(gitSync.Folder, fmt.Sprintf("%s.json", workflowId)), "/")
+}
+
+func (gitSync *GitSync) addConflict(workflowId string) {
+	if !arrayContainsString(gitSync.Conflicts, workflowId) {
+		gitSync.Conflicts = append(gitSync.Conflicts, workflowId)
+	}
+}
+
+func (gitSync *GitSync) removeConflict(workflowId string) {
+	newConflicts := []string{}
+	for _, item := range gitSync.Conflicts {
+		if item != workflowId {
+			newConflicts = append(newConflicts, item)
+		}
+	}
+
+	gitSync.Conflicts = newConflicts
+}
+
+// Clones the branch into memory. An empty repo gets initialized with the branch
+func cloneGitSync(gitSync GitSync) (*git.Repository, billy.Filesystem, error) {
+	fs := memfs.New()
+	storer := memory.NewStorage()
+	branch := plumbing.NewBranchReferenceName(gitSync.Branch)
+
+	cloneOptions := &git.CloneOptions{
+		URL:           gitSync.Url,
+		ReferenceName: branch,
+		SingleBranch:  true,
+	}
+
+	if len(gitSync.Token) > 0 {
+		cloneOptions.Auth = &githttp.BasicAuth{
+			Username: gitSync.Username,
+			Password: gitSync.Token,
+		}
+	}
+
+	repo, err := git.Clone(storer, fs, cloneOptions)
+	if err == nil {
+		return repo, fs, nil
+	}
+
+	if err != transport.ErrEmptyRemoteRepository {
+		return repo, fs, err
+	}
+
+	repo, err = git.Init(storer, fs)
+	if err != nil {
+		return repo, fs, err
+	}
+
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{gitSync.Url},
+	})
+	if err != nil {
+		return repo, fs, err
+	}
+
+	err = storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+	return repo, fs, err
+}
+
+// The hash of a file in the last commit. Empty if it's not there
+func getGitFileHash(repo *git.Repository, filename string) string {
+	ref, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return ""
+	}
+
+	file, err := commit.File(filename)
+	if err != nil {
+		return ""
+	}
+
+	return file.Hash.String()
+}
+
+// What's committed. IDs are kept, so pulling maps back to the same workflow
+func getGitWorkflowData(workflow Workflow) ([]byte, error) {
+	workflow = stripWorkflowSecrets(workflow)
+	workflow.OrgId = ""
+	workflow.Owner = ""
+	workflow.Schedules = []Schedule{}
+	workflow.Org = []Org{}
+	workflow.ExecutingOrg = Org{}
+	workflow.Published = 0
+	workflow.PublishedRevisions = []int64{}
+	workflow.RevisionMessage = ""
+
+	return json.MarshalIndent(workflow, "", "  ")
+}
+
+// Commits and pushes a workflow. Refuses if the file changed upstream since
+// the last sync, unless force is set.
+func pushGitWorkflow(ctx context.Context, gitSync *GitSync, user User, workflow Workflow, force bool) error {
+	repo, fs, err := cloneGitSync(*gitSync)
+	if err != nil {
+		return err
+	}
+
+	filename := getGitSyncPath(*gitSync, workflow.ID)
+	state, _ := getGitSyncState(ctx, gitSync.OrgId, workflow.ID)
+	remoteHash := getGitFileHash(repo, filename)
+	if !force && len(remoteHash) > 0 && remoteHash != state.FileHash {
+		gitSync.addConflict(workflow.ID)
+		return errors.New(fmt.Sprintf("Workflow %s changed in git since the last sync", workflow.ID))
+	}
+
+	data, err := getGitWorkflowData(workflow)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(path.Dir("/"+filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteFile(fs, filename, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	_, err = worktree.Add(filename)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Update %s (revision %d)", workflow.Name, workflow.Revision)
+	if len(workflow.RevisionMessage) > 0 {
+		message = fmt.Sprintf("%s\n\n%s", message, workflow.RevisionMessage)
+	}
+
+	author := user.Username
+	if len(author) == 0 {
+		author = "Shuffle"
+	}
+
+	hash, err := worktree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  author,
+			Email: fmt.Sprintf("%s@shuffle", user.Id),
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	pushOptions := &git.PushOptions{}
+	if len(gitSync.Token) > 0 {
+		pushOptions.Auth = &githttp.BasicAuth{
+			Username: gitSync.Username,
+			Password: gitSync.Token,
+		}
+	}
+
+	err = repo.Push(pushOptions)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	gitSync.removeConflict(workflow.ID)
+	gitSync.LastCommit = hash.String()
+	return setGitSyncState(ctx, gitSync.OrgId, workflow.ID, gitSyncState{
+		FileHash: getGitFileHash(repo, filename),
+		Revision: workflow.Revision,
+	})
+}
+
+// Runs after a workflow is saved. Errors end up in the sync config
+func syncGitWorkflow(user User, workflow Workflow) {
+	ctx := context.Background()
+	gitSync, err := getGitSync(ctx, workflow.OrgId)
+	if err != nil || !gitSync.Enabled {
+		return
+	}
+
+	gitSyncLock.Lock()
+	defer gitSyncLock.Unlock()
+
+	err = pushGitWorkflow(ctx, gitSync, user, workflow, false)
+	if err != nil {
+		log.Printf("Failed pushing workflow %s to git: %s", workflow.ID, err)
+		gitSync.LastError = err.Error()
+	} else {
+		gitSync.LastError = ""
+	}
+
+	setGitSync(ctx, *gitSync)
+}
+
+// Stores a workflow from git as a new revision
+func applyGitWorkflow(ctx context.Context, gitSync *GitSync, workflow Workflow, oldWorkflow *Workflow, commitHash string) error {
+	workflow.OrgId = gitSync.OrgId
+	workflow.Owner = gitSync.CreatedBy
+	workflow.Published = 0
+	workflow.PublishedRevisions = []int64{}
+	workflow.Schedules = []Schedule{}
+	if oldWorkflow != nil {
+		workflow.Owner = oldWorkflow.Owner
+		workflow.Schedules = oldWorkflow.Schedules
+
+		// Git only has the workflow without its secrets
+		workflow = restoreWorkflowSecrets(workflow, *oldWorkflow)
+	}
+
+	short := commitHash
+	if len(short) > 8 {
+		short = short[0:8]
+	}
+
+	_, err := setWorkflowRevision(ctx, User{Username: "git"}, workflow, fmt.Sprintf("Synced from git commit %s", short))
+	return err
+}
+
+// Applies upstream changes. Workflows that also changed here since the last
+// sync are marked as conflicts and left alone.
+func pullGitSync(ctx context.Context, gitSync *GitSync) error {
+	repo, _, err := cloneGitSync(*gitSync)
+	if err != nil {
+		return err
+	}
+
+	ref, err := repo.Head()
+	if err != nil {
+		// Nothing committed yet
+		return nil
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+
+	folder := strings.Trim(gitSync.Folder, "/")
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+
+	err = files.ForEach(func(file *object.File) error {
+		if !strings.HasSuffix(file.Name, ".json") || (len(folder) > 0 && path.Dir(file.Name) != folder) || (len(folder) == 0 && strings.Contains(file.Name, "/")) {
+			return nil
+		}
+
+		workflowId := strings.TrimSuffix(path.Base(file.Name), ".json")
+		state, stateErr := getGitSyncState(ctx, gitSync.OrgId, workflowId)
+		if stateErr == nil && state.FileHash == file.Hash.String() {
+			return nil
+		}
+
+		contents, err := file.Contents()
+		if err != nil {
+			return nil
+		}
+
+		var workflow Workflow
+		err = json.Unmarshal([]byte(contents), &workflow)
+		if err != nil || workflow.ID != workflowId {
+			log.Printf("Skipping %s in git sync for %s: not a workflow for this file", file.Name, gitSync.OrgId)
+			return nil
+		}
+
+		oldWorkflow, err := getWorkflow(ctx, workflowId)
+		if err != nil {
+			oldWorkflow = nil
+		} else if oldWorkflow.OrgId != gitSync.OrgId {
+			log.Printf("Workflow %s from git already exists in another org. Skipping.", workflowId)
+			return nil
+		} else if stateErr != nil || oldWorkflow.Revision > state.Revision {
+			gitSync.addConflict(workflowId)
+			return nil
+		}
+
+		err = applyGitWorkflow(ctx, gitSync, workflow, oldWorkflow, commit.Hash.String())
+		if err != nil {
+			log.Printf("Failed applying workflow %s from git: %s", workflowId, err)
+			return nil
+		}
+
+		newWorkflow, err := getWorkflow(ctx, workflowId)
+		if err != nil {
+			return nil
+		}
+
+		gitSync.removeConflict(workflowId)
+		setGitSyncState(ctx, gitSync.OrgId, workflowId, gitSyncState{
+			FileHash: file.Hash.String(),
+			Revision: newWorkflow.Revision,
+		})
+
+		log.Printf("Applied workflow %s from git for org %s", workflowId, gitSync.OrgId)
+		return nil
+	})
+
+	gitSync.LastCommit = commit.Hash.String()
+	return err
+}
+
+func runGitSync(ctx context.Context, gitSync *GitSync) {
+	gitSyncLock.Lock()
+	defer gitSyncLock.Unlock()
+
+	err := pullGitSync(ctx, gitSync)
+	if err != nil {
+		log.Printf("Failed pulling git sync for %s: %s", gitSync.OrgId, err)
+		gitSync.LastError = err.Error()
+	} else {
+		gitSync.LastError = ""
+	}
+
+	gitSync.LastSync = time.Now().Unix()
+	setGitSync(ctx, *gitSync)
+}
+
+// Pulls for every org with sync enabled
+func startGitSync() {
+	if len(os.Getenv("GIT_SYNC_INTERVAL")) > 0 {
+		interval, err := strconv.Atoi(os.Getenv("GIT_SYNC_INTERVAL"))
+		if err == nil && interval > 0 {
+			gitSyncInterval = interval
+		}
+	}
+
+	job := func() {
+		ctx := context.Background()
+		q := datastore.NewQuery("git_sync").Filter("enabled =", true)
+		var gitSyncs []GitSync
+		_, err := dbclient.GetAll(ctx, q, &gitSyncs)
+		if err != nil {
+			log.Printf("Failed getting git syncs: %s", err)
+			return
+		}
+
+		for _, gitSync := range gitSyncs {
+			runGitSync(ctx, &gitSync)
+		}
+	}
+
+	_, err := newscheduler.Every(gitSyncInterval).Seconds().NotImmediately().Run(job)
+	if err != nil {
+		log.Printf("Failed starting git sync: %s", err)
+	}
+}
+
+// Gets the org in the path. Only admins in it can touch the sync
+func getGitSyncOrg(ctx context.Context, user User, location []string) (*Org, error) {
+	if len(location) <= 4 {
+		return &Org{}, errors.New("Missing org ID")
+	}
+
+	org, err := getOrg(ctx, location[4])
+	if err != nil {
+		return &Org{}, err
+	}
+
+	if getOrgRole(*org, user.Id) != "admin" {
+		return &Org{}, errors.New(fmt.Sprintf("%s is not admin in org %s", user.Username, org.Id))
+	}
+
+	return org, nil
+}
+
+// GET returns the config. POST sets it
+func handleGitSyncConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in git sync config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getGitSyncOrg(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting org for git sync: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	gitSync, err := getGitSync(ctx, org.Id)
+	if err != nil {
+		gitSync = &GitSync{OrgId: org.Id, Branch: "master", Conflicts: []string{}}
+	}
+
+	if request.Method == "GET" {
+		newjson, err := json.Marshal(gitSync)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed unpacking git sync"}`))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write(newjson)
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	// The token is only changed when one is sent
+	var t struct {
+		Enabled  bool   `json:"enabled"`
+		Url      string `json:"url"`
+		Branch   string `json:"branch"`
+		Folder   string `json:"folder"`
+		Username string `json:"username"`
+		Token    string `json:"token"`
+	}
+
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling data"}`))
+		return
+	}
+
+	if t.Enabled && !strings.HasPrefix(t.Url, "https://") && !strings.HasPrefix(t.Url, "http://") {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "The URL has to be http(s)"}`))
+		return
+	}
+
+	before := *gitSync
+	gitSync.Enabled = t.Enabled
+	gitSync.Url = t.Url
+	gitSync.Branch = t.Branch
+	gitSync.Folder = strings.Trim(t.Folder, "/")
+	gitSync.Username = t.Username
+	gitSync.CreatedBy = user.Id
+	if len(gitSync.Branch) == 0 {
+		gitSync.Branch = "master"
+	}
+
+	if len(t.Token) > 0 {
+		gitSync.Token = t.Token
+	}
+
+	err = setGitSync(ctx, *gitSync)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving git sync"}`))
+		return
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.git_sync", "org", org.Id, before, gitSync)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Pulls now. With workflow_id and keep = local or remote, it solves a conflict
+func handleGitSyncRun(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in git sync: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getGitSyncOrg(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting org for git sync: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	gitSync, err := getGitSync(ctx, org.Id)
+	if err != nil || !gitSync.Enabled {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Git sync isn't enabled for the org"}`))
+		return
+	}
+
+	var t struct {
+		WorkflowId string `json:"workflow_id"`
+		Keep       string `json:"keep"`
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &t)
+		if err != nil {
+			log.Printf("Failed unmarshaling git sync run: %s", err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+			return
+		}
+	}
+
+	if len(t.WorkflowId) > 0 {
+		workflow, err := getWorkflow(ctx, t.WorkflowId)
+		if err != nil || workflow.OrgId != org.Id {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Workflow doesn't exist"}`))
+			return
+		}
+
+		gitSyncLock.Lock()
+		if t.Keep == "local" {
+			err = pushGitWorkflow(ctx, gitSync, user, *workflow, true)
+		} else if t.Keep == "remote" {
+			// Makes the next pull see only the change in git
+			err = setGitSyncState(ctx, org.Id, workflow.ID, gitSyncState{Revision: workflow.Revision})
+		} else {
+			err = errors.New("Keep has to be local or remote")
+		}
+		gitSyncLock.Unlock()
+
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
+		addOrgAuditLog(ctx, request, user, org.Id, "workflow.git_resolve", "workflow", workflow.ID, nil, map[string]string{"keep": t.Keep})
+	}
+
+	runGitSync(ctx, gitSync)
+
+	newjson, err := json.Marshal(gitSync)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking git sync"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
@@ -0,0 +1,87 @@
+package main
+
+// How a node with more than one parent decides to run. Has to match the worker.
+// all (default) needs every parent to succeed. any runs once, as soon as one
+// parent succeeded, and ignores the rest. first is the same as any. count runs
+// as soon as join_count parents succeeded
+var joinModes = []string{"", "all", "any", "first", "count"}
+
+// Returns "run", "skip" or "wait" based on how many incoming branches are
+// active, inactive or still waiting for their parent
+func getJoinDecision(action Action, active, inactive, pending int) string {
+	total := active + inactive + pending
+	if total == 0 {
+		return "run"
+	}
+
+	needed := total
+	switch action.JoinMode {
+	case "any", "first":
+		needed = 1
+	case "count":
+		needed = action.JoinCount
+		if needed <= 0 {
+			needed = 1
+		} else if needed > total {
+			needed = total
+		}
+	}
+
+	if active >= needed {
+		return "run"
+	}
+
+	if active+pending < needed {
+		return "skip"
+	}
+
+	return "wait"
+}
+
+// The backend doesn't evaluate conditions, so a parent that succeeded counts
+// as an active branch
+func getResultJoin(workflowExecution WorkflowExecution, action Action) string {
+	active := 0
+	inactive := 0
+	pending := 0
+	for _, branch := range workflowExecution.Workflow.Branches {
+		if branch.DestinationID != action.ID {
+			continue
+		}
+
+		isAction := false
+		for _, parent := range workflowExecution.Workflow.Actions {
+			if parent.ID == branch.SourceID {
+				isAction = true
+				break
+			}
+		}
+
+		if !isAction {
+			continue
+		}
+
+		status := ""
+		for _, result := range workflowExecution.Results {
+			if result.Action.ID == branch.SourceID {
+				status = result.Status
+				break
+			}
+		}
+
+		if status == "SUCCESS" || status == "FINISHED" {
+			active += 1
+		} else if status == "SKIPPED" || status == "FAILURE" || status == "ABORTED" {
+			inactive += 1
+		} else {
+			pending += 1
+		}
+	}
+
+	// Nodes without parents are only skipped on purpose, e.g. above the start node
+	if active+inactive+pending == 0 {
+		return "skip"
+	}
+
+	return getJoinDecision(action, active, inactive, pending)
+}
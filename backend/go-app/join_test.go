@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetJoinDecision(t *testing.T) {
+	tests := []struct {
+		name      string
+		joinMode  string
+		joinCount int
+		active    int
+		inactive  int
+		pending   int
+		want      string
+	}{
+		{"no parents", "", 0, 0, 0, 0, "run"},
+		{"single parent done", "", 0, 1, 0, 0, "run"},
+		{"single parent skipped", "", 0, 0, 1, 0, "skip"},
+
+		// A -> B, A -> C, B -> D, C -> D
+		{"diamond all waits for the other side", "all", 0, 1, 0, 1, "wait"},
+		{"diamond all runs when both are done", "all", 0, 2, 0, 0, "run"},
+		{"diamond default is all", "", 0, 1, 0, 1, "wait"},
+		{"diamond any runs on the first side", "any", 0, 1, 0, 1, "run"},
+		{"diamond first runs on the first side", "first", 0, 1, 0, 1, "run"},
+		{"diamond any waits for both", "any", 0, 0, 0, 2, "wait"},
+
+		// Three parents into one node
+		{"fan-in all waits for the last parent", "all", 0, 2, 0, 1, "wait"},
+		{"fan-in all runs with every parent", "all", 0, 3, 0, 0, "run"},
+		{"fan-in any runs on the first parent", "any", 0, 1, 0, 2, "run"},
+		{"fan-in count runs at the count", "count", 2, 2, 0, 1, "run"},
+		{"fan-in count waits below the count", "count", 2, 1, 0, 2, "wait"},
+		{"fan-in count above the parents needs all", "count", 5, 2, 0, 1, "wait"},
+		{"fan-in count without a count needs one", "count", 0, 1, 0, 2, "run"},
+
+		// Parents skipped by their own branches or conditions
+		{"skipped parent stops all", "all", 0, 1, 1, 0, "skip"},
+		{"skipped parent stops all while waiting", "all", 0, 0, 1, 1, "skip"},
+		{"skipped parent doesn't stop any", "any", 0, 1, 1, 0, "run"},
+		{"skipped parent and a pending one make any wait", "any", 0, 0, 1, 1, "wait"},
+		{"every parent skipped skips any", "any", 0, 0, 3, 0, "skip"},
+		{"skipped parents make count impossible", "count", 2, 1, 2, 0, "skip"},
+
+		// Parents that failed count the same as skipped ones
+		{"failed parent stops all", "all", 0, 2, 1, 0, "skip"},
+		{"failed parent and a success run any", "any", 0, 1, 1, 0, "run"},
+		{"failed parent and a pending one make any wait", "any", 0, 0, 1, 1, "wait"},
+		{"every parent failed skips first", "first", 0, 0, 2, 0, "skip"},
+		{"failed parent with enough left for count waits", "count", 2, 1, 1, 1, "wait"},
+	}
+
+	for _, test := range tests {
+		action := Action{JoinMode: test.joinMode, JoinCount: test.joinCount}
+		got := getJoinDecision(action, test.active, test.inactive, test.pending)
+		if got != test.want {
+			t.Errorf("%s: getJoinDecision(%s, %d, %d, %d) = %s, want %s", test.name, test.joinMode, test.active, test.inactive, test.pending, got, test.want)
+		}
+	}
+}
+
+// A node with the given parents, and results for the parents that have a status
+func getJoinExecution(joinMode string, parents map[string]string) (WorkflowExecution, Action) {
+	child := Action{ID: "child", JoinMode: joinMode}
+	workflowExecution := WorkflowExecution{}
+	workflowExecution.Workflow.Actions = []Action{child}
+	for parentId, status := range parents {
+		parent := Action{ID: parentId}
+		workflowExecution.Workflow.Actions = append(workflowExecution.Workflow.Actions, parent)
+		workflowExecution.Workflow.Branches = append(workflowExecution.Workflow.Branches, Branch{SourceID: parentId, DestinationID: child.ID})
+		if len(status) > 0 {
+			workflowExecution.Results = append(workflowExecution.Results, ActionResult{Action: parent, Status: status})
+		}
+	}
+
+	return workflowExecution, child
+}
+
+func TestGetResultJoin(t *testing.T) {
+	tests := []struct {
+		name     string
+		joinMode string
+		parents  map[string]string
+		want     string
+	}{
+		{"diamond with one side done", "", map[string]string{"left": "SUCCESS", "right": ""}, "wait"},
+		{"diamond with both sides done", "", map[string]string{"left": "SUCCESS", "right": "FINISHED"}, "run"},
+		{"diamond any with one side done", "any", map[string]string{"left": "SUCCESS", "right": "EXECUTING"}, "run"},
+		{"fan-in with one parent left", "all", map[string]string{"a": "SUCCESS", "b": "SUCCESS", "c": "EXECUTING"}, "wait"},
+		{"fan-in any with nothing done", "any", map[string]string{"a": "", "b": "", "c": ""}, "wait"},
+		{"skipped parent", "all", map[string]string{"a": "SUCCESS", "b": "SKIPPED"}, "skip"},
+		{"skipped parent with any", "any", map[string]string{"a": "SKIPPED", "b": "SUCCESS"}, "run"},
+		{"failed parent", "all", map[string]string{"a": "FAILURE", "b": "SUCCESS"}, "skip"},
+		{"aborted parent with any", "any", map[string]string{"a": "ABORTED", "b": ""}, "wait"},
+		{"every parent failed with any", "any", map[string]string{"a": "FAILURE", "b": "ABORTED"}, "skip"},
+	}
+
+	for _, test := range tests {
+		workflowExecution, child := getJoinExecution(test.joinMode, test.parents)
+		got := getResultJoin(workflowExecution, child)
+		if got != test.want {
+			t.Errorf("%s: getResultJoin = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// Triggers aren't parents, so a node under one isn't skipped
+	workflowExecution, child := getJoinExecution("", map[string]string{"a": "SUCCESS"})
+	workflowExecution.Workflow.Branches = append(workflowExecution.Workflow.Branches, Branch{SourceID: "trigger", DestinationID: child.ID})
+	if got := getResultJoin(workflowExecution, child); got != "run" {
+		t.Errorf("trigger parent: getResultJoin = %s, want run", got)
+	}
+}
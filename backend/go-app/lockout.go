@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Failures before anything gets locked. IPs can be shared, so they get more
+const lockoutThreshold = 5
+const ipLockoutThreshold = 20
+
+// First lockout. Doubles with every failure after that
+const lockoutBase = int64(30)
+const lockoutMax = int64(24 * 3600)
+
+// Failures are forgotten after this long without new ones
+const lockoutReset = int64(24 * 3600)
+
+// Key = user_<userid> or ip_<ip>
+type loginAttempts struct {
+	Key         string `datastore:"key"`
+	Failures    int64  `datastore:"failures,noindex"`
+	LastFailure int64  `datastore:"last_failure,noindex"`
+	LockedUntil int64  `datastore:"locked_until,noindex"`
+}
+
+// Proxies in front of the backend. Comma separated IPs, CIDRs or hostnames.
+// Defaults to loopback and the bundled nginx container, as anyone else on the
+// network can reach the backend port directly
+var trustedProxies, trustedProxyHosts = getTrustedProxies(os.Getenv("SHUFFLE_TRUSTED_PROXIES"))
+
+var defaultTrustedProxies = "127.0.0.0/8,::1/128,shuffle-frontend"
+
+func getTrustedProxies(value string) ([]*net.IPNet, []string) {
+	if len(strings.TrimSpace(value)) == 0 {
+		value = defaultTrustedProxies
+	}
+
+	proxies := []*net.IPNet{}
+	hosts := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		// Containers get new IPs when they're recreated, so hostnames are
+		// looked up when they're used
+		if !strings.Contains(item, "/") && net.ParseIP(item) == nil {
+			hosts = append(hosts, strings.ToLower(item))
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item = fmt.Sprintf("%s/128", item)
+			} else {
+				item = fmt.Sprintf("%s/32", item)
+			}
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("Bad trusted proxy %s: %s", item, err)
+			continue
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, hosts
+}
+
+type proxyHostIps struct {
+	ips     []string
+	expires int64
+}
+
+var proxyHostCache = map[string]proxyHostIps{}
+var proxyHostLock sync.Mutex
+
+// The IPs of a trusted proxy hostname. Kept for a minute
+func getProxyHostIps(host string) []string {
+	proxyHostLock.Lock()
+	defer proxyHostLock.Unlock()
+
+	cached, ok := proxyHostCache[host]
+	if ok && cached.expires > time.Now().Unix() {
+		return cached.ips
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		ips = []string{}
+	}
+
+	proxyHostCache[host] = proxyHostIps{
+		ips:     ips,
+		expires: time.Now().Unix() + 60,
+	}
+
+	return ips
+}
+
+func isTrustedProxy(ip string) bool {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(parsedIp) {
+			return true
+		}
+	}
+
+	for _, host := range trustedProxyHosts {
+		for _, hostIp := range getProxyHostIps(host) {
+			if parsedIp.Equal(net.ParseIP(hostIp)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The client's IP. Headers are only used when they come from a trusted
+// proxy, and the last address in X-Forwarded-For that isn't a proxy wins
+func getRequestIp(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+	for index := len(forwarded) - 1; index >= 0; index-- {
+		forwardedIp := strings.TrimSpace(forwarded[index])
+		if len(forwardedIp) == 0 {
+			continue
+		}
+
+		if !isTrustedProxy(forwardedIp) || index == 0 {
+			return forwardedIp
+		}
+	}
+
+	realIp := strings.TrimSpace(request.Header.Get("X-Real-IP"))
+	if len(realIp) > 0 {
+		return realIp
+	}
+
+	return ip
+}
+
+func getLoginAttempts(ctx context.Context, key string) (*loginAttempts, error) {
+	dbKey := datastore.NameKey("login_attempts", key, nil)
+	attempts := &loginAttempts{}
+	if err := dbclient.Get(ctx, dbKey, attempts); err != nil {
+		return &loginAttempts{Key: key}, err
+	}
+
+	return attempts, nil
+}
+
+func setLoginAttempts(ctx context.Context, attempts loginAttempts) error {
+	dbKey := datastore.NameKey("login_attempts", attempts.Key, nil)
+	if _, err := dbclient.Put(ctx, dbKey, &attempts); err != nil {
+		log.Printf("Error setting login attempts for %s: %s", attempts.Key, err)
+		return err
+	}
+
+	return nil
+}
+
+// Returns an error if any of the keys are locked
+func checkLockout(ctx context.Context, keys ...string) error {
+	timeNow := time.Now().Unix()
+	for _, key := range keys {
+		attempts, err := getLoginAttempts(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		if attempts.LockedUntil > timeNow {
+			return errors.New(fmt.Sprintf("Too many failed attempts. Try again in %d seconds", attempts.LockedUntil-timeNow))
+		}
+	}
+
+	return nil
+}
+
+// How long the failures lock a key for. 0 below the threshold
+func getLockoutDuration(failures, threshold int64) int64 {
+	if failures < threshold {
+		return 0
+	}
+
+	lockout := lockoutBase
+	for i := threshold; i < failures && lockout < lockoutMax; i++ {
+		lockout *= 2
+	}
+
+	if lockout > lockoutMax {
+		lockout = lockoutMax
+	}
+
+	return lockout
+}
+
+// Counts a failure for each key and locks them when there are too many.
+// Returns the keys that got locked.
+func addLoginFailure(ctx context.Context, keys ...string) []string {
+	locked := []string{}
+	timeNow := time.Now().Unix()
+	for _, key := range keys {
+		attempts, err := getLoginAttempts(ctx, key)
+		if err != nil || attempts.LastFailure+lockoutReset < timeNow {
+			attempts = &loginAttempts{Key: key}
+		}
+
+		threshold := int64(lockoutThreshold)
+		if strings.HasPrefix(key, "ip_") {
+			threshold = ipLockoutThreshold
+		}
+
+		attempts.Failures += 1
+		attempts.LastFailure = timeNow
+		lockout := getLockoutDuration(attempts.Failures, threshold)
+		if lockout > 0 {
+			attempts.LockedUntil = timeNow + lockout
+			locked = append(locked, key)
+			log.Printf("LOCKOUT: %s is locked for %d seconds after %d failed attempts", key, lockout, attempts.Failures)
+		}
+
+		setLoginAttempts(ctx, *attempts)
+	}
+
+	return locked
+}
+
+// IP lockouts go in the log of the org of the user that was tried. Without
+// a user they have no org, and every admin can see them
+func auditLockouts(ctx context.Context, request *http.Request, user User, locked []string) {
+	for _, key := range locked {
+		if strings.HasPrefix(key, "user_") {
+			addAuditLog(ctx, request, user, "user.lockout", "user", user.Id, nil, nil)
+		} else {
+			addOrgAuditLog(ctx, request, User{}, user.ActiveOrg.Id, "ip.lockout", "ip", getRequestIp(request), nil, map[string]string{"user_id": user.Id})
+		}
+	}
+}
+
+// Removes the failures after a successful login or an admin unlock
+func resetLoginFailures(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		_, err := getLoginAttempts(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		err = DeleteKey(ctx, "login_attempts", key)
+		if err != nil {
+			log.Printf("Failed resetting login attempts for %s: %s", key, err)
+		}
+	}
+}
+
+func getUserLockKey(userId string) string {
+	return fmt.Sprintf("user_%s", userId)
+}
+
+func getIpLockKey(request *http.Request) string {
+	return fmt.Sprintf("ip_%s", getRequestIp(request))
+}
+
+func handleUnlockUser(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in unlock user: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You need to be admin to unlock users"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 4 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+	}
+
+	ctx := context.Background()
+	foundUser, err := getUser(ctx, fileId)
+	if err != nil || !arrayContainsString(foundUser.Orgs, user.ActiveOrg.Id) {
+		log.Printf("%s failed to unlock user %s: %s", user.Username, fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resetLoginFailures(ctx, getUserLockKey(foundUser.Id))
+	addAuditLog(ctx, request, user, "user.unlock", "user", foundUser.Id, nil, nil)
+
+	log.Printf("LOCKOUT: %s unlocked %s", user.Username, foundUser.Username)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
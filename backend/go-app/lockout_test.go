@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetTrustedProxies(t *testing.T) {
+	proxies, hosts := getTrustedProxies(" 10.0.0.1, 192.168.0.0/16,::1,Proxy.local,, 10.0.0.0/99")
+	if len(proxies) != 3 {
+		t.Errorf("got %d trusted networks, want 3", len(proxies))
+	}
+
+	if len(hosts) != 1 || hosts[0] != "proxy.local" {
+		t.Errorf("got trusted hosts %v, want [proxy.local]", hosts)
+	}
+
+	proxies, hosts = getTrustedProxies("")
+	if len(proxies) != 2 || len(hosts) != 1 || hosts[0] != "shuffle-frontend" {
+		t.Errorf("empty value gave %d networks and hosts %v, want the defaults", len(proxies), hosts)
+	}
+}
+
+func TestGetRequestIp(t *testing.T) {
+	oldProxies, oldHosts := trustedProxies, trustedProxyHosts
+	defer func() {
+		trustedProxies, trustedProxyHosts = oldProxies, oldHosts
+	}()
+
+	trustedProxies, trustedProxyHosts = getTrustedProxies("10.0.0.0/8,::1")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIp     string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"direct client can't set the forwarded header", "203.0.113.5:1234", "198.51.100.7", "", "203.0.113.5"},
+		{"direct client can't set the real ip header", "203.0.113.5:1234", "", "198.51.100.7", "203.0.113.5"},
+		{"proxy forwards the client", "10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"spoofed address before the client", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"proxies after the client", "10.0.0.1:1234", "198.51.100.7, 10.0.0.3, 10.0.0.2", "", "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"empty entries", "10.0.0.1:1234", "198.51.100.7,, ", "", "198.51.100.7"},
+		{"real ip without forwarded", "10.0.0.1:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"forwarded before real ip", "10.0.0.1:1234", "198.51.100.7", "198.51.100.8", "198.51.100.7"},
+		{"proxy without headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"ipv6 proxy", "[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+		{"address without a port", "10.0.0.1", "198.51.100.7", "", "198.51.100.7"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/api/v1/login", nil)
+		request.RemoteAddr = test.remoteAddr
+		if len(test.forwarded) > 0 {
+			request.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if len(test.realIp) > 0 {
+			request.Header.Set("X-Real-IP", test.realIp)
+		}
+
+		got := getRequestIp(request)
+		if got != test.want {
+			t.Errorf("%s: getRequestIp = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int64
+		threshold int64
+		want      int64
+	}{
+		{"below the threshold", 4, lockoutThreshold, 0},
+		{"at the threshold", 5, lockoutThreshold, lockoutBase},
+		{"doubles after the threshold", 6, lockoutThreshold, lockoutBase * 2},
+		{"doubles again", 7, lockoutThreshold, lockoutBase * 4},
+		{"last step below the ceiling", 16, lockoutThreshold, lockoutBase * 2048},
+		{"capped at the ceiling", 17, lockoutThreshold, lockoutMax},
+		{"stays at the ceiling", 1000000, lockoutThreshold, lockoutMax},
+		{"ip below its threshold", 19, ipLockoutThreshold, 0},
+		{"ip at its threshold", 20, ipLockoutThreshold, lockoutBase},
+	}
+
+	for _, test := range tests {
+		got := getLockoutDuration(test.failures, test.threshold)
+		if got != test.want {
+			t.Errorf("%s: getLockoutDuration(%d, %d) = %d, want %d", test.name, test.failures, test.threshold, got, test.want)
+		}
+	}
+}
@@ -75,11 +75,6 @@ var baseDockerName = "frikky/shuffle"
 
 var dbclient *datastore.Client
 
-type Userapi struct {
-	Username string `datastore:"username"`
-	ApiKey   string `datastore:"apikey"`
-}
-
 type ExecutionInfo struct {
 	TotalApiUsage           int64 `json:"total_api_usage" datastore:"total_api_usage"`
 	TotalWorkflowExecutions int64 `json:"total_workflow_executions" datastore:"total_workflow_executions"`
@@ -161,18 +156,22 @@ type Environment struct {
 	Default    bool   `datastore:"default" json:"default"`
 	Archived   bool   `datastore:"archived" json:"archived"`
 	Id         string `datastore:"id" json:"id"`
+	OrgId      string `datastore:"org_id" json:"org_id"`
+
+	// Executions that can run at the same time. 0 is no limit
+	MaxConcurrency int `datastore:"max_concurrency" json:"max_concurrency"`
 }
 
 type User struct {
 	Username          string        `datastore:"Username" json:"username"`
 	Password          string        `datastore:"password,noindex" password:"password,omitempty"`
-	Session           string        `datastore:"session,noindex" json:"session"`
+	Session           string        `datastore:"session,noindex" json:"session"` // The current session. Not stored
 	Verified          bool          `datastore:"verified,noindex" json:"verified"`
 	PrivateApps       []WorkflowApp `datastore:"privateapps" json:"privateapps":`
 	Role              string        `datastore:"role" json:"role"`
 	Roles             []string      `datastore:"roles" json:"roles"`
 	VerificationToken string        `datastore:"verification_token" json:"verification_token"`
-	ApiKey            string        `datastore:"apikey" json:"apikey"`
+	ApiKey            string        `datastore:"apikey" json:"apikey"` // Legacy. Moved to hashed UserApikey
 	ResetReference    string        `datastore:"reset_reference" json:"reset_reference"`
 	Executions        ExecutionInfo `datastore:"executions" json:"executions"`
 	Limits            UserLimits    `datastore:"limits" json:"limits"`
@@ -180,20 +179,16 @@ type User struct {
 	ResetTimeout      int64         `datastore:"reset_timeout,noindex" json:"reset_timeout"`
 	Id                string        `datastore:"id" json:"id"`
 	Orgs              []string      `datastore:"orgs" json:"orgs"`
+	ActiveOrg         OrgMini       `datastore:"active_org" json:"active_org"`
+	Mfa               MFAInfo       `datastore:"mfa" json:"mfa"`
 	CreationTime      int64         `datastore:"creation_time" json:"creation_time"`
 	Active            bool          `datastore:"active" json:"active"`
 }
 
-// timeout maybe? idk
-type session struct {
-	Username string `datastore:"Username,noindex"`
-	Id       string `datastore:"Id,noindex"`
-	Session  string `datastore:"session,noindex"`
-}
-
 type loginStruct struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	MfaCode  string `json:"mfa_code"`
 }
 
 type Contact struct {
@@ -379,6 +374,8 @@ type Hook struct {
 	Status    string       `json:"status" datastore:"status"`
 	Workflows []string     `json:"workflows" datastore:"workflows"`
 	Running   bool         `json:"running" datastore:"running"`
+	OrgId     string       `json:"org_id" datastore:"org_id"`
+	Revision  int64        `json:"revision" datastore:"revision"`
 }
 
 func createFileFromFile(ctx context.Context, bucket *storage.BucketHandle, remotePath, localPath string) error {
@@ -611,6 +608,8 @@ func handleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 		}
 
 		ctx := context.Background()
+		ipKey := getIpLockKey(request)
+
 		//if item, err := memcache.Get(ctx, newApikey); err == memcache.ErrCacheMiss {
 		//	// Not in cache
 		//} else if err != nil {
@@ -632,12 +631,58 @@ func handleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 		// Make specific check for just service user?
 		// Get the user based on APIkey here
 		//log.Println(apikeyCheck[1])
-		Userdata, err := getApikey(ctx, apikeyCheck[1])
+		// Checked before the key, so a locked IP can't keep guessing
+		lockErr := checkLockout(ctx, ipKey)
+		if lockErr != nil {
+			log.Printf("Apikey from %s blocked: %s", getRequestIp(request), lockErr)
+			return User{}, lockErr
+		}
+
+		userApikey, err := getApikey(ctx, apikeyCheck[1])
+		if err != nil {
+			log.Printf("Apikey failed: %s", err)
+			auditLockouts(ctx, request, User{}, addLoginFailure(ctx, ipKey))
+			return User{}, err
+		}
+
+		err = checkApikeyScope(*userApikey, request)
 		if err != nil {
-			log.Printf("Apikey %s doesn't exist: %s", apikey, err)
+			log.Printf("Apikey %s (%s) not allowed: %s", userApikey.Id, userApikey.Name, err)
 			return User{}, err
 		}
 
+		foundUser, err := getUser(ctx, userApikey.UserId)
+		if err != nil {
+			log.Printf("User for apikey %s doesn't exist: %s", userApikey.Id, err)
+			return User{}, err
+		}
+		Userdata := *foundUser
+
+		// Keys only work in the org they were made for
+		if len(userApikey.OrgId) > 0 && Userdata.ActiveOrg.Id != userApikey.OrgId {
+			org, err := getOrg(ctx, userApikey.OrgId)
+			if err != nil {
+				return User{}, err
+			}
+
+			role := getOrgRole(*org, Userdata.Id)
+			if len(role) == 0 {
+				return User{}, errors.New("User is no longer in the org of the apikey")
+			}
+
+			Userdata.ActiveOrg = OrgMini{Name: org.Name, Id: org.Id, Role: role}
+			Userdata.Role = role
+		}
+
+		// No need to write on every single request
+		if userApikey.LastUsed < time.Now().Unix()-60 {
+			userApikey.LastUsed = time.Now().Unix()
+			err = setUserApikey(ctx, *userApikey)
+			if err != nil {
+				log.Printf("Failed updating last used for apikey %s: %s", userApikey.Id, err)
+			}
+		}
+
 		// Caching both bad and good apikeys :)
 		//b, err := json.Marshal(Userdata)
 		//if err != nil {
@@ -722,6 +767,16 @@ func handleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			return User{}, err
 		}
 
+		err = validateSession(ctx, session)
+		if err != nil {
+			log.Printf("Session for %s is invalid: %s", session.Username, err)
+			return User{}, err
+		}
+
+		if session.MfaSetup && !checkMfaSetupPath(request) {
+			return User{}, errors.New("MFA has to be set up first")
+		}
+
 		// Get session first
 		// Should basically never happen
 		Userdata, err := getUser(ctx, session.Id)
@@ -730,9 +785,7 @@ func handleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			return User{}, err
 		}
 
-		if Userdata.Session != sessionToken {
-			return User{}, errors.New("Wrong session token")
-		}
+		Userdata.Session = sessionToken
 
 		// Means session exists, but
 		return *Userdata, nil
@@ -905,22 +958,34 @@ func deleteUser(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// Invert. No user deletion.
-	if users[0].Active {
-		users[0].Active = false
-	} else {
-		users[0].Active = true
+	if !arrayContainsString(users[0].Orgs, user.ActiveOrg.Id) {
+		log.Printf("%s tried to remove user %s outside their org", user.Username, userId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
 	}
 
-	err = setUser(ctx, &users[0])
+	org, err := getOrg(ctx, user.ActiveOrg.Id)
 	if err != nil {
-		log.Printf("Failed swapping active for user %s (%s)", users[0].Username, users[0].Id)
+		log.Printf("Failed getting org %s: %s", user.ActiveOrg.Id, err)
 		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": true"}`)))
+		resp.Write([]byte(`{"success": false}`))
 		return
 	}
 
-	log.Printf("Successfully inverted %s", users[0].Username)
+	// The user can be in other orgs, so they're only removed from this one.
+	// No user deletion.
+	err = removeOrgUser(ctx, org, &users[0])
+	if err != nil {
+		log.Printf("Failed removing user %s (%s) from org %s", users[0].Username, users[0].Id, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "org.user_remove", "user", users[0].Id, map[string]string{"username": users[0].Username}, nil)
+
+	log.Printf("Successfully removed %s from org %s", users[0].Username, org.Id)
 
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
@@ -1024,9 +1089,7 @@ func handleSetEnvironments(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	ctx := context.Background()
-	var environments []Environment
-	q := datastore.NewQuery("Environments")
-	_, err = dbclient.GetAll(ctx, q, &environments)
+	environments, err := getEnvironments(ctx, user.ActiveOrg.Id)
 	if err != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Can't get environments when setting"}`))
@@ -1071,6 +1134,12 @@ func handleSetEnvironments(resp http.ResponseWriter, request *http.Request) {
 		if !item.Archived {
 			openEnvironments += 1
 		}
+
+		if item.MaxConcurrency < 0 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Max concurrency of %s can't be negative"}`, item.Name)))
+			return
+		}
 	}
 
 	if openEnvironments < 1 {
@@ -1080,6 +1149,7 @@ func handleSetEnvironments(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	for _, item := range newEnvironments {
+		item.OrgId = user.ActiveOrg.Id
 		err = setEnvironment(ctx, &item)
 		if err != nil {
 			resp.WriteHeader(401)
@@ -1093,11 +1163,13 @@ func handleSetEnvironments(resp http.ResponseWriter, request *http.Request) {
 	//log.Printf("FIXME: Set new environments: %#v", newEnvironments)
 	//log.Printf("DONT DELETE ONES THAT ARE IN USE")
 
+	addAuditLog(ctx, request, user, "environment.update", "environment", user.ActiveOrg.Id, map[string]interface{}{"environments": environments}, map[string]interface{}{"environments": newEnvironments})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
 
-func createNewUser(username, password, role, apikey string) error {
+func createNewUser(username, password, role, apikey, orgId string) error {
 	// Returns false if there is an issue
 	// Use this for register
 	err := checkPasswordStrength(password)
@@ -1137,7 +1209,7 @@ func createNewUser(username, password, role, apikey string) error {
 	newUser.Verified = false
 	newUser.CreationTime = time.Now().Unix()
 	newUser.Active = true
-	newUser.Orgs = []string{"default"}
+	newUser.Orgs = []string{}
 
 	// FIXME - Remove this later
 	if role == "admin" {
@@ -1148,10 +1220,6 @@ func createNewUser(username, password, role, apikey string) error {
 		newUser.Roles = []string{"user"}
 	}
 
-	if len(apikey) > 0 {
-		newUser.ApiKey = apikey
-	}
-
 	// set limits
 	newUser.Limits.DailyApiUsage = 100
 	newUser.Limits.DailyWorkflowExecutions = 1000
@@ -1177,11 +1245,38 @@ func createNewUser(username, password, role, apikey string) error {
 	ID := uuid.NewV4()
 	newUser.Id = ID.String()
 	newUser.VerificationToken = verifyToken.String()
-	err = setUser(ctx, newUser)
+
+	// Without an org, the user goes into the first one (default org)
+	var org *Org
+	if len(orgId) > 0 {
+		org, err = getOrg(ctx, orgId)
+		if err != nil {
+			log.Printf("Failed getting org %s for new user %s: %s", orgId, username, err)
+			return err
+		}
+	} else {
+		orgs, err := getAllOrgs(ctx)
+		if err != nil || len(orgs) == 0 {
+			log.Printf("No org found for new user %s: %s", username, err)
+			return errors.New("No org found to add the user to")
+		}
+
+		org = &orgs[0]
+	}
+
+	err = addOrgUser(ctx, org, newUser, newUser.Role)
 	if err != nil {
 		log.Printf("Error adding User %s: %s", username, err)
 		return err
 	}
+
+	if len(apikey) > 0 {
+		_, err = addUserApikey(ctx, *newUser, "default", apikey, []string{"all"}, []string{}, 0)
+		if err != nil {
+			log.Printf("Error adding apikey for %s: %s", username, err)
+			return err
+		}
+	}
 	url := fmt.Sprintf("https://shuffler.io/register/%s", verifyToken.String())
 	const verifyMessage = `
 Registration URL :)
@@ -1249,7 +1344,7 @@ func handleRegister(resp http.ResponseWriter, request *http.Request) {
 	if count == 0 {
 		role = "admin"
 	}
-	err = createNewUser(data.Username, data.Password, role, "")
+	err = createNewUser(data.Username, data.Password, role, "", user.ActiveOrg.Id)
 	if err != nil {
 		log.Printf("Failed registering user: %s", err)
 		resp.WriteHeader(401)
@@ -1257,6 +1352,8 @@ func handleRegister(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(context.Background(), request, user, "user.create", "user", data.Username, nil, map[string]string{"username": data.Username, "role": role})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 	log.Printf("%s Successfully registered.", data.Username)
@@ -1291,7 +1388,6 @@ func handleLogout(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("Session cookie is set!")
 	}
 
-	var Userdata User
 	ctx := context.Background()
 	//item, err := memcache.Get(ctx, c.Value)
 	sessionToken := ""
@@ -1330,34 +1426,15 @@ func handleLogout(resp http.ResponseWriter, request *http.Request) {
 	//	Userdata = *tmpdata
 	//}
 
-	// FIXME
-	// Session might delete someone elses here?
-	// No need to think about before possible scale..?
-	err = SetSession(ctx, Userdata, "")
-	if err != nil {
-		log.Printf("Error removing session for: %s", err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
-		return
-	}
-
+	// Only this session. The others stay logged in
 	err = DeleteKey(ctx, "sessions", sessionToken)
 	if err != nil {
-		log.Printf("Error deleting key %s for %s: %s", c.Value, Userdata.Username, err)
+		log.Printf("Error deleting key %s for %s: %s", c.Value, session.Username, err)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
 		return
 	}
 
-	Userdata.Session = ""
-	err = setUser(ctx, &Userdata)
-	if err != nil {
-		log.Printf("Failed updating user: %s", err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Failed updating apikey"}`))
-		return
-	}
-
 	//memcache.Delete(request.Context(), sessionToken)
 
 	resp.WriteHeader(200)
@@ -1365,28 +1442,6 @@ func handleLogout(resp http.ResponseWriter, request *http.Request) {
 	http.SetCookie(resp, c)
 }
 
-func generateApikey(ctx context.Context, userInfo User) (User, error) {
-	// Generate UUID
-	// Set uuid to apikey in backend (update)
-	apikey := uuid.NewV4()
-	userInfo.ApiKey = apikey.String()
-
-	err := SetApikey(ctx, userInfo)
-	if err != nil {
-		log.Printf("Failed updating apikey: %s", err)
-		return userInfo, err
-	}
-
-	// Updating user
-	err = setUser(ctx, &userInfo)
-	if err != nil {
-		log.Printf("Failed updating user: %s", err)
-		return userInfo, err
-	}
-
-	return userInfo, nil
-}
-
 func handleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 	cors := handleCors(resp, request)
 	if cors {
@@ -1440,6 +1495,14 @@ func handleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if !arrayContainsString(foundUser.Orgs, userInfo.ActiveOrg.Id) {
+		log.Printf("%s tried to update user %s outside their org", userInfo.Username, t.UserId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false}`)))
+		return
+	}
+
+	before := map[string]string{"username": foundUser.Username}
 	if t.Role != "admin" && t.Role != "user" {
 		log.Printf("%s tried and failed to update user %s", userInfo.Username, t.UserId)
 		resp.WriteHeader(401)
@@ -1453,9 +1516,25 @@ func handleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		log.Printf("Updated user %s from %s to %s", foundUser.Username, foundUser.Role, t.Role)
-		foundUser.Role = t.Role
+		// Roles are per org
+		org, err := getOrg(ctx, userInfo.ActiveOrg.Id)
+		if err != nil {
+			log.Printf("Failed getting org %s (update user): %s", userInfo.ActiveOrg.Id, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false}`)))
+			return
+		}
+
+		before["role"] = getOrgRole(*org, foundUser.Id)
+		log.Printf("Updated user %s from %s to %s in org %s", foundUser.Username, before["role"], t.Role, org.Id)
 		foundUser.Roles = []string{t.Role}
+		err = addOrgUser(ctx, org, foundUser, t.Role)
+		if err != nil {
+			log.Printf("Failed updating role of user %s: %s", foundUser.Username, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false}`)))
+			return
+		}
 	}
 
 	if len(t.Username) > 0 {
@@ -1493,6 +1572,8 @@ func handleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, userInfo, "user.update", "user", foundUser.Id, before, map[string]string{"username": foundUser.Username, "role": t.Role})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
@@ -1514,15 +1595,16 @@ func handleApiGeneration(resp http.ResponseWriter, request *http.Request) {
 	log.Printf("APIKEY")
 
 	ctx := context.Background()
+	apikey := ""
 	if request.Method == "GET" {
-		newUserInfo, err := generateApikey(ctx, userInfo)
+		apikey, err = generateApikey(ctx, userInfo)
 		if err != nil {
 			log.Printf("Failed to generate apikey for user %s: %s", userInfo.Username, err)
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false, "reason": ""}`))
 			return
 		}
-		userInfo = newUserInfo
+		addAuditLog(ctx, request, userInfo, "apikey.generate", "user", userInfo.Id, nil, nil)
 		log.Printf("Updated apikey for user %s", userInfo.Username)
 	} else if request.Method == "POST" {
 		log.Printf("Handling post!")
@@ -1562,22 +1644,30 @@ func handleApiGeneration(resp http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		newUserInfo, err := generateApikey(ctx, *foundUser)
+		if !arrayContainsString(foundUser.Orgs, userInfo.ActiveOrg.Id) {
+			log.Printf("%s tried to change apikey for %s outside their org", userInfo.Username, t.UserId)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false}`)))
+			return
+		}
+
+		apikey, err = generateApikey(ctx, *foundUser)
 		if err != nil {
 			log.Printf("Failed to generate apikey for user %s: %s", foundUser.Username, err)
 			resp.WriteHeader(401)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
 			return
 		}
-		foundUser = &newUserInfo
+
+		addAuditLog(ctx, request, userInfo, "apikey.generate", "user", foundUser.Id, nil, nil)
 
 		resp.WriteHeader(200)
-		resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": "%s"}`, foundUser.Username, foundUser.Verified, foundUser.ApiKey)))
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": "%s"}`, foundUser.Username, foundUser.Verified, apikey)))
 		return
 	}
 
 	resp.WriteHeader(200)
-	resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": "%s"}`, userInfo.Username, userInfo.Verified, userInfo.ApiKey)))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": "%s"}`, userInfo.Username, userInfo.Verified, apikey)))
 }
 
 func handleSettings(resp http.ResponseWriter, request *http.Request) {
@@ -1594,8 +1684,9 @@ func handleSettings(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Apikeys are hashed, so they're only shown when generated
 	resp.WriteHeader(200)
-	resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": "%s"}`, userInfo.Username, userInfo.Verified, userInfo.ApiKey)))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "username": "%s", "verified": %t, "apikey": ""}`, userInfo.Username, userInfo.Verified)))
 }
 
 func handleInfo(resp http.ResponseWriter, request *http.Request) {
@@ -1685,23 +1776,33 @@ func handleInfo(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	expiration := time.Now().Add(3600 * time.Second)
+	expiration := time.Unix(session.Expires, 0)
 	http.SetCookie(resp, &http.Cookie{
 		Name:    "session_token",
 		Value:   userInfo.Session,
 		Expires: expiration,
 	})
 
+	orgs, err := json.Marshal(getUserOrgs(ctx, userInfo))
+	if err != nil {
+		orgs = []byte("[]")
+	}
+
+	selectedOrg, err := json.Marshal(userInfo.ActiveOrg)
+	if err != nil {
+		selectedOrg = []byte("{}")
+	}
+
 	returnData := fmt.Sprintf(`
 	{
 		"success": true, 
 		"admin": %s, 
 		"tutorials": [],
 		"id": "%s",
-		"orgs": [{"name": "Shuffle", "id": "123", "role": "admin"}], 
-		"selected_org": {"name": "Shuffle", "id": "123", "role": "admin"}, 
+		"orgs": %s, 
+		"selected_org": %s, 
 		"cookies": [{"key": "session_token", "value": "%s", "expiration": %d}]
-	}`, parsedAdmin, userInfo.Id, userInfo.Session, expiration.Unix())
+	}`, parsedAdmin, userInfo.Id, string(orgs), string(selectedOrg), userInfo.Session, expiration.Unix())
 
 	resp.WriteHeader(200)
 	resp.Write([]byte(returnData))
@@ -1925,6 +2026,8 @@ func handlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// user is changed to the one getting the new password below
+	actor := user
 	curUserFound := false
 	if t.Username != user.Username && user.Role != "admin" {
 		resp.WriteHeader(401)
@@ -1979,6 +2082,14 @@ func handlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 			return
 		}
 
+		// Admins only manage the users of their own org
+		if !arrayContainsString(users[0].Orgs, user.ActiveOrg.Id) {
+			log.Printf("%s tried to change the password of %s outside their org", user.Username, t.Username)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
+			return
+		}
+
 		user = users[0]
 	} else {
 		// Admins can re-generate others' passwords as well.
@@ -2010,6 +2121,14 @@ func handlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Logs out everywhere, including here
+	err = deleteUserSessions(ctx, user.Id, "")
+	if err != nil {
+		log.Printf("Error removing sessions after password change for %s: %s", user.Username, err)
+	}
+
+	addAuditLog(ctx, request, actor, "user.password", "user", user.Id, nil, nil)
+
 	//memcache.Delete(ctx, sessionToken)
 
 	resp.WriteHeader(200)
@@ -2106,7 +2225,7 @@ func handleGetSchedules(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	ctx := context.Background()
-	schedules, err := getAllSchedules(ctx)
+	schedules, err := getAllSchedules(ctx, user.ActiveOrg.Id)
 	if err != nil {
 		log.Printf("Failed getting schedules: %s", err)
 		resp.WriteHeader(401)
@@ -2134,7 +2253,7 @@ func handleGetEnvironments(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	_, err := handleApiAuthentication(resp, request)
+	user, err := handleApiAuthentication(resp, request)
 	if err != nil {
 		log.Printf("Api authentication failed in set new workflowhandler: %s", err)
 		resp.WriteHeader(401)
@@ -2143,9 +2262,7 @@ func handleGetEnvironments(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	ctx := context.Background()
-	var environments []Environment
-	q := datastore.NewQuery("Environments")
-	_, err = dbclient.GetAll(ctx, q, &environments)
+	environments, err := getEnvironments(ctx, user.ActiveOrg.Id)
 	if err != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Can't get environments"}`))
@@ -2188,7 +2305,7 @@ func handleGetUsers(resp http.ResponseWriter, request *http.Request) {
 
 	ctx := context.Background()
 	var users []User
-	q := datastore.NewQuery("Users")
+	q := datastore.NewQuery("Users").Filter("orgs =", user.ActiveOrg.Id)
 	_, err = dbclient.GetAll(ctx, q, &users)
 	if err != nil {
 		resp.WriteHeader(401)
@@ -2196,6 +2313,7 @@ func handleGetUsers(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	org, orgErr := getOrg(ctx, user.ActiveOrg.Id)
 	newUsers := []User{}
 	for _, item := range users {
 		if len(item.Username) == 0 {
@@ -2206,6 +2324,11 @@ func handleGetUsers(resp http.ResponseWriter, request *http.Request) {
 		item.Session = ""
 		item.VerificationToken = ""
 
+		// Show the role within this org, not their active one
+		if orgErr == nil {
+			item.Role = getOrgRole(*org, item.Id)
+		}
+
 		newUsers = append(newUsers, item)
 	}
 
@@ -2269,6 +2392,15 @@ func handleLogin(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	ctx := context.Background()
+	ipKey := getIpLockKey(request)
+	err = checkLockout(ctx, ipKey)
+	if err != nil {
+		log.Printf("Login for %s from %s blocked: %s", data.Username, getRequestIp(request), err)
+		resp.WriteHeader(429)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	log.Printf("Username: %s", data.Username)
 	q := datastore.NewQuery("Users").Filter("Username =", data.Username)
 	var users []User
@@ -2282,16 +2414,29 @@ func handleLogin(resp http.ResponseWriter, request *http.Request) {
 
 	if len(users) != 1 {
 		log.Printf(`Found multiple users with the same username: %s: %d`, data.Username, len(users))
+		if len(users) == 0 {
+			auditLockouts(ctx, request, User{}, addLoginFailure(ctx, ipKey))
+		}
+
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Found %d users with the same username: %s"}`, len(users), data.Username)))
 		return
 	}
 
 	Userdata := users[0]
+	userKey := getUserLockKey(Userdata.Id)
+	err = checkLockout(ctx, userKey)
+	if err != nil {
+		log.Printf("Login for %s blocked: %s", data.Username, err)
+		resp.WriteHeader(429)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(Userdata.Password), []byte(data.Password))
 	if err != nil {
 		log.Printf("Password for %s is incorrect: %s", data.Username, err)
+		auditLockouts(ctx, request, Userdata, addLoginFailure(ctx, ipKey, userKey))
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
 		return
@@ -2304,7 +2449,7 @@ func handleLogin(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	log.Printf("%s SUCCESSFULLY LOGGED IN with session %s", data.Username, Userdata.Session)
+	log.Printf("%s SUCCESSFULLY LOGGED IN", data.Username)
 	//if !Userdata.Verified {
 	//	log.Printf("User %s is not verified", data.Username)
 	//	resp.WriteHeader(403)
@@ -2312,75 +2457,71 @@ func handleLogin(resp http.ResponseWriter, request *http.Request) {
 	//	return
 	//}
 
-	loginData := `{"success": true}`
-
-	// FIXME - have timeout here
-	if len(Userdata.Session) != 0 {
-		//log.Println("Nonexisting session")
-		expiration := time.Now().Add(3600 * time.Second)
-
-		http.SetCookie(resp, &http.Cookie{
-			Name:    "session_token",
-			Value:   Userdata.Session,
-			Expires: expiration,
-		})
-
-		loginData = fmt.Sprintf(`{"success": true, "cookies": [{"key": "session_token", "value": "%s", "expiration": %d}]}`, Userdata.Session, expiration.Unix())
-		//log.Printf("SESSION LENGTH MORE THAN 0 IN LOGIN: %s", Userdata.Session)
+	// No session before the second factor is done
+	mfaSetup := false
+	if Userdata.Mfa.Active {
+		if len(data.MfaCode) == 0 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "MFA code required", "mfa_required": true}`))
+			return
+		}
 
-		err = SetSession(ctx, Userdata, Userdata.Session)
+		err = checkMfaCode(&Userdata, data.MfaCode)
 		if err != nil {
-			log.Printf("Error adding session to database: %s", err)
+			log.Printf("MFA for %s failed: %s", data.Username, err)
+			auditLockouts(ctx, request, Userdata, addLoginFailure(ctx, ipKey, userKey))
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "MFA code is incorrect", "mfa_required": true}`))
+			return
 		}
 
-		resp.WriteHeader(200)
-		resp.Write([]byte(loginData))
-		return
+		err = setUser(ctx, &Userdata)
+		if err != nil {
+			log.Printf("Failed updating MFA for %s: %s", data.Username, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed updating user"}`))
+			return
+		}
+	} else if mfaRequired(ctx, Userdata) {
+		mfaSetup = true
 	}
 
-	sessionToken := uuid.NewV4()
-	http.SetCookie(resp, &http.Cookie{
-		Name:    "session_token",
-		Value:   sessionToken.String(),
-		Expires: time.Now().Add(3600 * time.Second),
-	})
+	// Only after every factor is done, so the MFA code can't be guessed
+	// forever with the password. Only the user, as resetting the IP would
+	// let anyone with an account keep guessing
+	resetLoginFailures(ctx, userKey)
 
-	// ADD TO DATABASE
-	err = SetSession(ctx, Userdata, sessionToken.String())
+	// Every login gets its own session
+	newSession, err := createSession(ctx, Userdata, request)
 	if err != nil {
 		log.Printf("Error adding session to database: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed creating session"}`))
+		return
 	}
 
-	resp.WriteHeader(200)
-	resp.Write([]byte(loginData))
-}
-
-func getApikey(ctx context.Context, apikey string) (User, error) {
-	// Query for the specifci workflowId
-	q := datastore.NewQuery("Users").Filter("apikey =", apikey)
-	var users []User
-	_, err := dbclient.GetAll(ctx, q, &users)
-	if err != nil {
-		log.Printf("Error getting users apikey (getapikey): %s", err)
-		return User{}, err
-	}
-
-	if len(users) == 0 {
-		log.Printf("No users found for apikey %s", apikey)
-		return User{}, err
+	// Can only be used to set up MFA
+	if mfaSetup {
+		newSession.MfaSetup = true
+		err = setSession(ctx, *newSession)
+		if err != nil {
+			log.Printf("Error updating session for %s: %s", data.Username, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed creating session"}`))
+			return
+		}
 	}
 
-	return users[0], nil
-}
-
-func getSession(ctx context.Context, thissession string) (*session, error) {
-	key := datastore.NameKey("sessions", thissession, nil)
-	curUser := &session{}
-	if err := dbclient.Get(ctx, key, curUser); err != nil {
-		return &session{}, err
-	}
+	expiration := time.Unix(newSession.Expires, 0)
+	http.SetCookie(resp, &http.Cookie{
+		Name:    "session_token",
+		Value:   newSession.Session,
+		Expires: expiration,
+	})
 
-	return curUser, nil
+	loginData := fmt.Sprintf(`{"success": true, "mfa_setup_required": %t, "cookies": [{"key": "session_token", "value": "%s", "expiration": %d}]}`, mfaSetup, newSession.Session, expiration.Unix())
+	resp.WriteHeader(200)
+	resp.Write([]byte(loginData))
 }
 
 // ListBooks returns a list of books, ordered by title.
@@ -2408,52 +2549,6 @@ func DeleteKey(ctx context.Context, entity string, value string) error {
 	return nil
 }
 
-// Index = Username
-func SetApikey(ctx context.Context, Userdata User) error {
-	// Non indexed User data
-	newapiUser := new(Userapi)
-	newapiUser.ApiKey = Userdata.ApiKey
-	newapiUser.Username = Userdata.Username
-	key1 := datastore.NameKey("apikey", newapiUser.ApiKey, nil)
-
-	// New struct, to not add body, author etc
-	if _, err := dbclient.Put(ctx, key1, newapiUser); err != nil {
-		log.Printf("Error adding apikey: %s", err)
-		return err
-	}
-
-	return nil
-}
-
-// Index = Username
-func SetSession(ctx context.Context, Userdata User, value string) error {
-	// Non indexed User data
-	Userdata.Session = value
-	key1 := datastore.NameKey("Users", Userdata.Id, nil)
-
-	// New struct, to not add body, author etc
-	if _, err := dbclient.Put(ctx, key1, &Userdata); err != nil {
-		log.Printf("rror adding Usersession: %s", err)
-		return err
-	}
-
-	if len(Userdata.Session) > 0 {
-		// Indexed session data
-		sessiondata := new(session)
-		sessiondata.Username = Userdata.Username
-		sessiondata.Session = Userdata.Session
-		sessiondata.Id = Userdata.Id
-		key2 := datastore.NameKey("sessions", sessiondata.Session, nil)
-
-		if _, err := dbclient.Put(ctx, key2, sessiondata); err != nil {
-			log.Printf("Error adding session: %s", err)
-			return err
-		}
-	}
-
-	return nil
-}
-
 func setOpenApiDatastore(ctx context.Context, id string, data ParsedOpenApi) error {
 	k := datastore.NameKey("openapi3", id, nil)
 	if _, err := dbclient.Put(ctx, k, &data); err != nil {
@@ -2474,8 +2569,13 @@ func getOpenApiDatastore(ctx context.Context, id string) (ParsedOpenApi, error)
 }
 
 func setEnvironment(ctx context.Context, data *Environment) error {
-	// clear session_token and API_token for user
-	k := datastore.NameKey("Environments", strings.ToLower(data.Name), nil)
+	// Environment names are only unique within an org
+	name := strings.ToLower(data.Name)
+	if len(data.OrgId) > 0 {
+		name = fmt.Sprintf("%s_%s", data.OrgId, name)
+	}
+
+	k := datastore.NameKey("Environments", name, nil)
 
 	// New struct, to not add body, author etc
 
@@ -2490,8 +2590,10 @@ func setEnvironment(ctx context.Context, data *Environment) error {
 // ListBooks returns a list of books, ordered by title.
 func setUser(ctx context.Context, data *User) error {
 	// clear session_token and API_token for user
+	user := *data
+	user.Session = ""
 	k := datastore.NameKey("Users", data.Id, nil)
-	if _, err := dbclient.Put(ctx, k, data); err != nil {
+	if _, err := dbclient.Put(ctx, k, &user); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -2742,7 +2844,7 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 	// Get the ID to see whether it exists
 	// FIXME - use return and set READONLY fields (don't allow change from User)
 	ctx := context.Background()
-	_, err = getHook(ctx, workflowId)
+	oldHook, err := getHook(ctx, workflowId)
 	if err != nil {
 		log.Printf("Failed getting hook: %s", err)
 		resp.WriteHeader(401)
@@ -2750,7 +2852,22 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if oldHook.OrgId != user.ActiveOrg.Id {
+		log.Printf("Wrong org for user %s and hook %s", user.Username, hook.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
 	// Update the fields
+	hook.OrgId = oldHook.OrgId
+	err = checkHookRevision(ctx, hook)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	err = setHook(ctx, hook)
 	if err != nil {
 		log.Printf("Failed setting hook: %s", err)
@@ -2759,6 +2876,8 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "hook.update", "hook", hook.Id, oldHook, hook)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -3152,10 +3271,25 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 			}
 		}
 
-		bodyWrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "webhook", "execution_argument": "%s"}`, hook.Start, string(parsedBody))
+		bodyWrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "webhook", "execution_argument": "%s", "revision": %d}`, hook.Start, string(parsedBody), hook.Revision)
 		if len(hook.Start) == 0 {
 			log.Printf("No start node for hook %s - running with workflow default.", hook.Id)
 			bodyWrapper = string(parsedBody)
+
+			// The raw body has no source, so the published version is found here
+			draftWorkflow, err := getWorkflow(ctx, item)
+			if err == nil {
+				var publishedWorkflow *Workflow
+				publishedWorkflow, err = getPublishedWorkflow(ctx, *draftWorkflow, hook.Revision)
+				workflow = *publishedWorkflow
+			}
+
+			if err != nil {
+				log.Printf("Failed getting workflow %s for hook %s: %s", item, hook.Id, err)
+				resp.WriteHeader(500)
+				resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+				return
+			}
 		}
 
 		newRequest := &http.Request{
@@ -3203,6 +3337,7 @@ func handleNewHook(resp http.ResponseWriter, request *http.Request) {
 		Name        string `json:"name"`
 		Workflow    string `json:"workflow"`
 		Start       string `json:"start"`
+		Revision    int64  `json:"revision"`
 	}
 
 	body, err := ioutil.ReadAll(request.Body)
@@ -3270,9 +3405,11 @@ func handleNewHook(resp http.ResponseWriter, request *http.Request) {
 			Description: requestdata.Description,
 			Url:         fmt.Sprintf("https://shuffler.io/functions/webhooks/webhook_%s", newId),
 		},
-		Type:   "webhook",
-		Owner:  user.Username,
-		Status: "uninitialized",
+		Type:     "webhook",
+		Owner:    user.Username,
+		OrgId:    user.ActiveOrg.Id,
+		Status:   "uninitialized",
+		Revision: requestdata.Revision,
 		Actions: []HookAction{
 			HookAction{
 				Type:  "workflow",
@@ -3284,6 +3421,13 @@ func handleNewHook(resp http.ResponseWriter, request *http.Request) {
 		Running: false,
 	}
 
+	err = checkHookRevision(ctx, hook)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	hook.Status = "running"
 	hook.Running = true
 	err = setHook(ctx, hook)
@@ -3299,6 +3443,8 @@ func handleNewHook(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("Failed to increase total workflows: %s", err)
 	}
 
+	addAuditLog(ctx, request, user, "hook.create", "hook", hook.Id, nil, hook)
+
 	log.Println("Set up a new hook")
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
@@ -3414,7 +3560,7 @@ func handleGetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Id != hook.Owner && user.Role != "admin" && user.Role != "scheduler" {
+	if (user.Id != hook.Owner && user.Role != "admin" && user.Role != "scheduler") || hook.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for hook %s", user.Username, hook.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -4086,7 +4232,7 @@ func handleGetallHooks(resp http.ResponseWriter, request *http.Request) {
 
 	ctx := context.Background()
 	// With user, do a search for workflows with user or user's org attached
-	q := datastore.NewQuery("hooks").Filter("owner =", user.Username)
+	q := datastore.NewQuery("hooks").Filter("org_id =", user.ActiveOrg.Id).Filter("owner =", user.Username)
 	var allhooks []Hook
 	_, err = dbclient.GetAll(ctx, q, &allhooks)
 	if err != nil {
@@ -4688,16 +4834,19 @@ func handleNewOutlookRegister(resp http.ResponseWriter, request *http.Request) {
 		},
 	})
 
-	// Set apikey for the user if they don't have one
-	if len(Userdata.ApiKey) == 0 {
-		newUser, err := generateApikey(ctx, *Userdata)
-		Userdata = &newUser
-		if err != nil {
-			log.Printf("Failed to generate apikey for user %s when creating outlook sub: %s", Userdata.Username, err)
-			resp.WriteHeader(401)
-			resp.Write([]byte(`{"success": false, "reason": ""}`))
-			return
-		}
+	// The function only needs to execute this workflow. Keys from earlier
+	// registrations aren't used anymore
+	err = revokeUserApikeys(ctx, Userdata.Id, fmt.Sprintf("outlook_%s", trigger.Id))
+	if err != nil {
+		log.Printf("Failed revoking old apikey for outlook sub %s: %s", trigger.Id, err)
+	}
+
+	functionApikey, _, err := createUserApikey(ctx, *Userdata, fmt.Sprintf("outlook_%s", trigger.Id), []string{"execute"}, []string{trigger.WorkflowId}, 0)
+	if err != nil {
+		log.Printf("Failed to generate apikey for user %s when creating outlook sub: %s", Userdata.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": ""}`))
+		return
 	}
 
 	//err = setUser(Userdata)
@@ -4716,7 +4865,7 @@ func handleNewOutlookRegister(resp http.ResponseWriter, request *http.Request) {
 
 	// FIXME - not sure if these are good at all :)
 	environmentVariables := map[string]string{
-		"FUNCTION_APIKEY": Userdata.ApiKey,
+		"FUNCTION_APIKEY": functionApikey,
 		"CALLBACKURL":     "https://shuffler.io",
 		"WORKFLOW_ID":     trigger.WorkflowId,
 		"TRIGGER_ID":      trigger.Id,
@@ -5023,8 +5172,7 @@ func handleDeleteOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s when deploying outlook", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5040,6 +5188,8 @@ func handleDeleteOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "trigger.delete", "trigger", triggerId, map[string]string{"workflow_id": workflowId, "type": "outlook"}, nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -5157,8 +5307,7 @@ func createOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s when deploying outlook", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5276,6 +5425,8 @@ func createOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		break
 	}
 
+	addAuditLog(ctx, request, user, "trigger.create", "trigger", curTrigger.ID, nil, map[string]string{"workflow_id": workflow.ID, "type": "outlook"})
+
 	log.Printf("Successfully handled outlook subscription for trigger %s in workflow %s", curTrigger.ID, workflow.ID)
 
 	//log.Printf("%#v", user)
@@ -5964,6 +6115,13 @@ func verifySwagger(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	auditAction := "app.create"
+	if test.Editing {
+		auditAction = "app.update"
+	}
+
+	addAuditLog(ctx, request, user, auditAction, "app", newmd5, nil, map[string]string{"name": api.Name, "app_version": api.AppVersion})
+
 	// 2. Get all the required code
 	appbase, staticBaseline, err := getAppbase()
 	if err != nil {
@@ -6233,6 +6391,14 @@ func runInit(ctx context.Context) {
 		}
 	*/
 
+	// Everything has to be in an org. Makes the default one if missing.
+	err = migrateDefaultOrg(ctx)
+	if err != nil {
+		log.Printf("Failed setting up default org: %s", err)
+	}
+
+	migrateUserApikeys(ctx)
+
 	// Fix active users etc
 	q := datastore.NewQuery("Users").Filter("active =", true)
 	var activeusers []User
@@ -6257,10 +6423,6 @@ func runInit(ctx context.Context) {
 						user.Roles = append(user.Roles, user.Role)
 					}
 
-					if len(user.Orgs) == 0 {
-						user.Orgs = []string{"default"}
-					}
-
 					err = setUser(ctx, &user)
 					if err != nil {
 						log.Printf("Failed to reset user")
@@ -6281,7 +6443,7 @@ func runInit(ctx context.Context) {
 				log.Printf("SHUFFLE_DEFAULT_USERNAME and SHUFFLE_DEFAULT_PASSWORD not defined as environments. Running without default user.")
 			} else {
 				apikey := os.Getenv("SHUFFLE_DEFAULT_APIKEY")
-				err = createNewUser(username, password, "admin", apikey)
+				err = createNewUser(username, password, "admin", apikey, "")
 				if err != nil {
 					log.Printf("Failed to create default user %s: %s", username, err)
 				} else {
@@ -6303,15 +6465,23 @@ func runInit(ctx context.Context) {
 			Type: "onprem",
 		}
 
+		orgs, err := getAllOrgs(ctx)
+		if err == nil && len(orgs) > 0 {
+			item.OrgId = orgs[0].Id
+		}
+
 		err = setEnvironment(ctx, &item)
 		if err != nil {
 			log.Printf("Failed setting up new environment")
 		}
 	}
 
+	startGitSync()
+	startApprovalExpiry()
+
 	// Gets schedules and starts them
 	log.Printf("Relaunching schedules")
-	schedules, err := getAllSchedules(ctx)
+	schedules, err := getAllSchedules(ctx, "")
 	if err != nil {
 		log.Printf("Failed getting schedules during service init: %s", err)
 	} else {
@@ -6434,7 +6604,13 @@ func runInit(ctx context.Context) {
 			if len(workflows) == 0 {
 				username := os.Getenv("SHUFFLE_DOWNLOAD_WORKFLOW_USERNAME")
 				password := os.Getenv("SHUFFLE_DOWNLOAD_WORKFLOW_PASSWORD")
-				err = loadGithubWorkflows(workflowLocation, username, password, "", os.Getenv("SHUFFLE_DOWNLOAD_WORKFLOW_BRANCH"))
+				orgId := ""
+				orgs, err := getAllOrgs(ctx)
+				if err == nil && len(orgs) > 0 {
+					orgId = orgs[0].Id
+				}
+
+				err = loadGithubWorkflows(workflowLocation, username, password, "", os.Getenv("SHUFFLE_DOWNLOAD_WORKFLOW_BRANCH"), orgId)
 				if err != nil {
 					log.Printf("Failed to upload workflows from github: %s", err)
 				} else {
@@ -6474,6 +6650,15 @@ func init() {
 
 	// Make user related locations
 	r.HandleFunc("/api/v1/users/generateapikey", handleApiGeneration).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/api/v1/users/apikeys", handleGetApikeys).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/users/apikeys", handleNewApikey).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/users/apikeys/{apikeyId}", handleRevokeApikey).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/users/sessions", handleGetSessions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/users/sessions", handleRevokeSession).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/users/sessions/{sessionId}", handleRevokeSession).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/users/mfa/setup", handleMfaSetup).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/users/mfa/verify", handleMfaVerify).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/users/mfa/disable", handleMfaDisable).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/users/login", handleLogin).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/users/logout", handleLogout).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/users/register", handleRegister).Methods("POST", "OPTIONS")
@@ -6483,6 +6668,7 @@ func init() {
 	r.HandleFunc("/api/v1/users/getsettings", handleSettings).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/users/updateuser", handleUpdateUser).Methods("PUT", "OPTIONS")
 	r.HandleFunc("/api/v1/users/{user}", deleteUser).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/users/{user}/unlock", handleUnlockUser).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/users/passwordchange", handlePasswordChange).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/users", handleGetUsers).Methods("GET", "OPTIONS")
 
@@ -6500,6 +6686,22 @@ func init() {
 	r.HandleFunc("/api/v1/setenvironments", handleSetEnvironments).Methods("PUT", "OPTIONS")
 	r.HandleFunc("/api/v1/passwordchange", handlePasswordChange).Methods("POST", "OPTIONS")
 
+	// Orgs. Everything else is scoped to the users' active org
+	r.HandleFunc("/api/v1/orgs", handleGetOrgs).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs", handleCreateOrg).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/invites", handleGetOrgInvites).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/invites/{inviteId}/accept", handleAnswerOrgInvite).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/invites/{inviteId}/decline", handleAnswerOrgInvite).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}", handleGetOrg).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/change", handleChangeUserOrg).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/mfa", handleSetOrgMfa).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/git", handleGitSyncConfig).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/git/sync", handleGitSyncRun).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/users", handleSetOrgUser).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/orgs/{orgId}/users/{userId}", handleRemoveOrgUser).Methods("DELETE", "OPTIONS")
+
+	r.HandleFunc("/api/v1/audit", handleGetAuditLogs).Methods("GET", "OPTIONS")
+
 	r.HandleFunc("/api/v1/docs", getDocList).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/docs/{key}", getDocs).Methods("GET", "OPTIONS")
 
@@ -6508,6 +6710,13 @@ func init() {
 	// This does not increase the API counter
 	r.HandleFunc("/api/v1/streams", handleWorkflowQueue).Methods("POST")
 	r.HandleFunc("/api/v1/streams/results", handleGetStreamResults).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/streams/subflow", handleRunSubflow).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/streams/foreach", handleRunForeach).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/streams/approval", handleCreateApproval).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/streams/release", handleReleaseExecution).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/approvals", handleGetApprovals).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/approvals/{key}", handleGetApprovals).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/approvals/{key}/{decision}", handleDecideApproval).Methods("GET", "POST", "OPTIONS")
 
 	// App specific
 	r.HandleFunc("/api/v1/apps/run_hotload", handleAppHotloadRequest).Methods("GET", "OPTIONS")
@@ -6539,6 +6748,9 @@ func init() {
 	r.HandleFunc("/api/v1/workflows/queue/confirm", handleGetWorkflowqueueConfirm).Methods("POST")
 	r.HandleFunc("/api/v1/workflows/schedules", handleGetSchedules).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/download_remote", loadSpecificWorkflows).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/import", handleImportWorkflow).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/validate", handleValidateWorkflow).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/export", handleExportWorkflow).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/execute", executeWorkflow).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/schedule", scheduleWorkflow).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/schedule/{schedule}", stopSchedule).Methods("DELETE", "OPTIONS")
@@ -6546,6 +6758,21 @@ func init() {
 	r.HandleFunc("/api/v1/workflows/{key}/outlook/{triggerId}", handleDeleteOutlookSub).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions", getWorkflowExecutions).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/abort", abortExecution).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/pause", handlePauseExecution).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/resume", handleResumeExecution).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/rerun", handleRerunExecution).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/replay", handleReplayExecution).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/diff", handleGetExecutionDiff).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/revisions", handleGetWorkflowRevisions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/revisions/{revision}", handleGetWorkflowRevisions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/revisions/{revision}/diff/{other}", handleGetWorkflowRevisions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/revisions/{revision}/restore", handleRestoreWorkflowRevision).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/tests", handleGetWorkflowTests).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/tests", handleSetWorkflowTest).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/tests/run", handleRunWorkflowTests).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/tests/{test}", handleDeleteWorkflowTest).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/publish", handlePublishWorkflow).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/validate", handleValidateWorkflow).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", getSpecificWorkflow).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", saveWorkflow).Methods("PUT", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", deleteWorkflow).Methods("DELETE", "OPTIONS")
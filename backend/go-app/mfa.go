@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) with the defaults every authenticator app uses
+const totpPeriod = 30
+const totpDigits = 6
+const mfaRecoveryCodes = 10
+
+// Secrets and recovery codes are never returned from the API
+type MFAInfo struct {
+	Active        bool     `json:"active" datastore:"active"`
+	Secret        string   `json:"-" datastore:"secret,noindex"`
+	PendingSecret string   `json:"-" datastore:"pending_secret,noindex"`
+	RecoveryCodes []string `json:"-" datastore:"recovery_codes,noindex"`
+	LastCounter   int64    `json:"-" datastore:"last_counter,noindex"`
+}
+
+func generateTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+func getTotpCode(secret string, counter int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// Returns the counter that matched. Allows one period of clock drift
+func validateTotpCode(secret, code string) (int64, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, errors.New("Invalid MFA code")
+	}
+
+	counter := time.Now().Unix() / totpPeriod
+	for _, drift := range []int64{0, -1, 1} {
+		curCode, err := getTotpCode(secret, counter+drift)
+		if err != nil {
+			return 0, err
+		}
+
+		if hmac.Equal([]byte(curCode), []byte(code)) {
+			return counter + drift, nil
+		}
+	}
+
+	return 0, errors.New("Invalid MFA code")
+}
+
+func hashRecoveryCode(code string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Returns the raw codes and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < mfaRecoveryCodes; i++ {
+		buf := make([]byte, 5)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return []string{}, []string{}, err
+		}
+
+		code := hex.EncodeToString(buf)
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// Checks a TOTP code or a recovery code. Used codes can't be used again,
+// so the user has to be stored afterwards.
+func checkMfaCode(user *User, code string) error {
+	if !user.Mfa.Active {
+		return errors.New("MFA is not active")
+	}
+
+	counter, err := validateTotpCode(user.Mfa.Secret, code)
+	if err == nil {
+		if counter <= user.Mfa.LastCounter {
+			return errors.New("MFA code is already used")
+		}
+
+		user.Mfa.LastCounter = counter
+		return nil
+	}
+
+	codeHash := hashRecoveryCode(code)
+	for index, recoveryCode := range user.Mfa.RecoveryCodes {
+		if hmac.Equal([]byte(recoveryCode), []byte(codeHash)) {
+			user.Mfa.RecoveryCodes = append(user.Mfa.RecoveryCodes[:index], user.Mfa.RecoveryCodes[index+1:]...)
+			log.Printf("%s used a recovery code. %d left", user.Username, len(user.Mfa.RecoveryCodes))
+			return nil
+		}
+	}
+
+	return errors.New("Invalid MFA code")
+}
+
+// Whether the org policy says the user needs MFA
+func mfaRequired(ctx context.Context, user User) bool {
+	if len(user.ActiveOrg.Id) == 0 {
+		return false
+	}
+
+	org, err := getOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		return false
+	}
+
+	if org.MfaRequired == "all" {
+		return true
+	}
+
+	return org.MfaRequired == "admin" && getOrgRole(*org, user.Id) == "admin"
+}
+
+// Sessions that still need MFA setup can only do that
+func checkMfaSetupPath(request *http.Request) bool {
+	path := request.URL.Path
+	return strings.HasPrefix(path, "/api/v1/users/mfa/") || strings.HasSuffix(path, "/getinfo")
+}
+
+func parseMfaCode(request *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return "", err
+	}
+
+	type mfaCode struct {
+		Code string `json:"code"`
+	}
+
+	var t mfaCode
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return "", err
+	}
+
+	if len(t.Code) == 0 {
+		return "", errors.New("Missing field: code")
+	}
+
+	return t.Code, nil
+}
+
+// Starts enrollment. MFA isn't active until a code is verified
+func handleMfaSetup(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in mfa setup: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Mfa.Active {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "MFA is already active. Disable it first."}`))
+		return
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		log.Printf("Failed generating MFA secret: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	user.Mfa.PendingSecret = secret
+	err = setUser(ctx, &user)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating user"}`))
+		return
+	}
+
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&digits=%d&period=%d", url.PathEscape("Shuffle"), url.PathEscape(user.Username), secret, url.QueryEscape("Shuffle"), totpDigits, totpPeriod)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "secret": "%s", "uri": "%s"}`, secret, uri)))
+}
+
+// Activates MFA and returns the recovery codes once
+func handleMfaVerify(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in mfa verify: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	code, err := parseMfaCode(request)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	if len(user.Mfa.PendingSecret) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Run MFA setup first"}`))
+		return
+	}
+
+	counter, err := validateTotpCode(user.Mfa.PendingSecret, code)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("Failed generating recovery codes: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	user.Mfa = MFAInfo{
+		Active:        true,
+		Secret:        user.Mfa.PendingSecret,
+		RecoveryCodes: hashes,
+		LastCounter:   counter,
+	}
+
+	err = setUser(ctx, &user)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating user"}`))
+		return
+	}
+
+	// The session is now allowed to do everything
+	if len(user.Session) > 0 {
+		session, err := getSession(ctx, user.Session)
+		if err == nil && session.MfaSetup {
+			session.MfaSetup = false
+			err = setSession(ctx, *session)
+			if err != nil {
+				log.Printf("Failed updating session after MFA setup for %s: %s", user.Username, err)
+			}
+		}
+	}
+
+	recoveryCodes, err := json.Marshal(codes)
+	if err != nil {
+		recoveryCodes = []byte("[]")
+	}
+
+	addAuditLog(ctx, request, user, "mfa.enable", "user", user.Id, map[string]bool{"active": false}, map[string]bool{"active": true})
+
+	log.Printf("Activated MFA for %s", user.Username)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "recovery_codes": %s}`, string(recoveryCodes))))
+}
+
+func handleMfaDisable(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in mfa disable: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	code, err := parseMfaCode(request)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	ctx := context.Background()
+	if mfaRequired(ctx, user) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Your org requires MFA"}`))
+		return
+	}
+
+	err = checkMfaCode(&user, code)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	user.Mfa = MFAInfo{}
+	err = setUser(ctx, &user)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating user"}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "mfa.disable", "user", user.Id, map[string]bool{"active": true}, map[string]bool{"active": false})
+
+	log.Printf("Disabled MFA for %s", user.Username)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Sets whether "all", "admin" or no users ("") in the org need MFA
+func handleSetOrgMfa(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in set org mfa: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 4 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	type orgMfa struct {
+		Required string `json:"required"`
+	}
+
+	var t orgMfa
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling data"}`))
+		return
+	}
+
+	if t.Required != "" && t.Required != "all" && t.Required != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Required has to be all, admin or empty"}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getOrg(ctx, fileId)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org doesn't exist"}`))
+		return
+	}
+
+	if getOrgRole(*org, user.Id) != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You need to be admin in the org"}`))
+		return
+	}
+
+	before := map[string]string{"mfa_required": org.MfaRequired}
+	org.MfaRequired = t.Required
+	err = setOrg(ctx, *org, org.Id)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating org"}`))
+		return
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.mfa", "org", org.Id, before, map[string]string{"mfa_required": org.MfaRequired})
+
+	log.Printf("%s set MFA requirement for org %s to '%s'", user.Username, org.Id, t.Required)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
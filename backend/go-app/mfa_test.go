@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// "12345678901234567890" from RFC 6238
+const testTotpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGetTotpCode(t *testing.T) {
+	// The RFC 6238 SHA1 vectors, cut to six digits
+	tests := []struct {
+		timestamp int64
+		want      string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		got, err := getTotpCode(testTotpSecret, test.timestamp/totpPeriod)
+		if err != nil {
+			t.Errorf("%d: getTotpCode failed: %s", test.timestamp, err)
+		} else if got != test.want {
+			t.Errorf("%d: getTotpCode = %s, want %s", test.timestamp, got, test.want)
+		}
+	}
+
+	lower, err := getTotpCode(strings.ToLower(testTotpSecret), 1)
+	if err != nil || lower != "287082" {
+		t.Errorf("lowercase secret: getTotpCode = %s, %v, want 287082", lower, err)
+	}
+
+	_, err = getTotpCode("not base32!", 1)
+	if err == nil {
+		t.Errorf("invalid secret: getTotpCode didn't fail")
+	}
+}
+
+func TestValidateTotpCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		drift int64
+		valid bool
+	}{
+		{"current period", 0, true},
+		{"one period behind", -1, true},
+		{"one period ahead", 1, true},
+		{"two periods behind", -2, false},
+		{"two periods ahead", 2, false},
+	}
+
+	for _, test := range tests {
+		// Tried again if the period changes in the middle
+		for attempt := 0; attempt < 2; attempt++ {
+			counter := time.Now().Unix() / totpPeriod
+			code, err := getTotpCode(testTotpSecret, counter+test.drift)
+			if err != nil {
+				t.Fatalf("%s: getTotpCode failed: %s", test.name, err)
+			}
+
+			got, err := validateTotpCode(testTotpSecret, code)
+			if time.Now().Unix()/totpPeriod != counter {
+				continue
+			}
+
+			if test.valid && (err != nil || got != counter+test.drift) {
+				t.Errorf("%s: validateTotpCode = %d, %v, want %d", test.name, got, err, counter+test.drift)
+			} else if !test.valid && err == nil {
+				t.Errorf("%s: validateTotpCode accepted the code", test.name)
+			}
+
+			break
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, err := validateTotpCode(testTotpSecret, code); err == nil {
+			t.Errorf("validateTotpCode accepted %q", code)
+		}
+	}
+}
+
+func TestCheckMfaCode(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes failed: %s", err)
+	}
+
+	if len(codes) != mfaRecoveryCodes || len(hashes) != mfaRecoveryCodes {
+		t.Fatalf("generateRecoveryCodes returned %d codes and %d hashes, want %d", len(codes), len(hashes), mfaRecoveryCodes)
+	}
+
+	user := &User{Mfa: MFAInfo{Active: true, Secret: testTotpSecret, RecoveryCodes: hashes}}
+	counter := time.Now().Unix() / totpPeriod
+	code, err := getTotpCode(testTotpSecret, counter)
+	if err != nil {
+		t.Fatalf("getTotpCode failed: %s", err)
+	}
+
+	if err := checkMfaCode(user, code); err != nil {
+		t.Errorf("first use of a code failed: %s", err)
+	}
+
+	if err := checkMfaCode(user, code); err == nil {
+		t.Errorf("a code could be used twice")
+	}
+
+	// A code from before the last used one is a replay too, even within the drift
+	previous, _ := getTotpCode(testTotpSecret, user.Mfa.LastCounter-1)
+	if err := checkMfaCode(user, previous); err == nil {
+		t.Errorf("a code older than the last used one was accepted")
+	}
+
+	if err := checkMfaCode(user, " "+strings.ToUpper(codes[0])+" "); err != nil {
+		t.Errorf("recovery code failed: %s", err)
+	}
+
+	if len(user.Mfa.RecoveryCodes) != mfaRecoveryCodes-1 {
+		t.Errorf("%d recovery codes left after using one, want %d", len(user.Mfa.RecoveryCodes), mfaRecoveryCodes-1)
+	}
+
+	if err := checkMfaCode(user, codes[0]); err == nil {
+		t.Errorf("a recovery code could be used twice")
+	}
+
+	if err := checkMfaCode(user, codes[1]); err != nil {
+		t.Errorf("second recovery code failed: %s", err)
+	}
+
+	if err := checkMfaCode(user, "0000000000"); err == nil {
+		t.Errorf("an unknown recovery code was accepted")
+	}
+
+	inactive := &User{Mfa: MFAInfo{Secret: testTotpSecret, RecoveryCodes: hashes}}
+	if err := checkMfaCode(inactive, codes[2]); err == nil {
+		t.Errorf("a code was accepted without MFA active")
+	}
+}
@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The org a user is currently working in. Role is the role within that org,
+// and is copied to User.Role when switching so the old admin checks still work.
+type OrgMini struct {
+	Name string `json:"name" datastore:"name"`
+	Id   string `json:"id" datastore:"id"`
+	Role string `json:"role" datastore:"role"`
+}
+
+type orgUserData struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// Users outside the org have to accept before they're added
+type OrgInvite struct {
+	Id        string `json:"id" datastore:"id"`
+	OrgId     string `json:"org_id" datastore:"org_id"`
+	OrgName   string `json:"org_name" datastore:"org_name"`
+	UserId    string `json:"user_id" datastore:"user_id"`
+	Role      string `json:"role" datastore:"role"`
+	InvitedBy string `json:"invited_by" datastore:"invited_by"`
+	Created   int64  `json:"created" datastore:"created"`
+}
+
+func getOrg(ctx context.Context, id string) (*Org, error) {
+	key := datastore.NameKey("Organizations", id, nil)
+	curOrg := &Org{}
+	if err := dbclient.Get(ctx, key, curOrg); err != nil {
+		return &Org{}, err
+	}
+
+	return curOrg, nil
+}
+
+func setOrg(ctx context.Context, data Org, id string) error {
+	key := datastore.NameKey("Organizations", id, nil)
+
+	if _, err := dbclient.Put(ctx, key, &data); err != nil {
+		log.Printf("Error adding org: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func getAllOrgs(ctx context.Context) ([]Org, error) {
+	var orgs []Org
+	q := datastore.NewQuery("Organizations")
+
+	_, err := dbclient.GetAll(ctx, q, &orgs)
+	if err != nil {
+		return []Org{}, err
+	}
+
+	return orgs, nil
+}
+
+// Only keep what's needed to know who's in an org. No passwords etc in there.
+func getOrgUser(user User, role string) User {
+	return User{
+		Username: user.Username,
+		Id:       user.Id,
+		Role:     role,
+	}
+}
+
+// Returns the role of the user within the org, or empty if not a member
+func getOrgRole(org Org, userId string) string {
+	for _, orgUser := range org.Users {
+		if orgUser.Id == userId {
+			return orgUser.Role
+		}
+	}
+
+	return ""
+}
+
+// Adds the user to the org, or updates its role if already there
+func addOrgUser(ctx context.Context, org *Org, user *User, role string) error {
+	found := false
+	for index, orgUser := range org.Users {
+		if orgUser.Id == user.Id {
+			org.Users[index].Role = role
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		org.Users = append(org.Users, getOrgUser(*user, role))
+	}
+
+	if !arrayContainsString(user.Orgs, org.Id) {
+		user.Orgs = append(user.Orgs, org.Id)
+	}
+
+	if len(user.ActiveOrg.Id) == 0 || user.ActiveOrg.Id == org.Id {
+		user.ActiveOrg = OrgMini{
+			Name: org.Name,
+			Id:   org.Id,
+			Role: role,
+		}
+		user.Role = role
+	}
+
+	err := setOrg(ctx, *org, org.Id)
+	if err != nil {
+		return err
+	}
+
+	return setUser(ctx, user)
+}
+
+// Admins of the default org (ORG_ID) run the instance, and can see what
+// doesn't belong to any org
+func isGlobalAdmin(user User) bool {
+	orgId := os.Getenv("ORG_ID")
+	return len(orgId) > 0 && user.ActiveOrg.Id == orgId && user.Role == "admin"
+}
+
+// Removes the user from the org only. Their other orgs keep them
+func removeOrgUser(ctx context.Context, org *Org, user *User) error {
+	newUsers := []User{}
+	for _, orgUser := range org.Users {
+		if orgUser.Id != user.Id {
+			newUsers = append(newUsers, orgUser)
+		}
+	}
+	org.Users = newUsers
+
+	newOrgs := []string{}
+	for _, orgId := range user.Orgs {
+		if orgId != org.Id {
+			newOrgs = append(newOrgs, orgId)
+		}
+	}
+	user.Orgs = newOrgs
+
+	// Moves them back to another org they're in, if any
+	if user.ActiveOrg.Id == org.Id {
+		user.ActiveOrg = OrgMini{}
+		user.Role = "user"
+		if len(user.Orgs) > 0 {
+			newOrg, err := getOrg(ctx, user.Orgs[0])
+			if err == nil {
+				user.ActiveOrg = OrgMini{
+					Name: newOrg.Name,
+					Id:   newOrg.Id,
+					Role: getOrgRole(*newOrg, user.Id),
+				}
+				user.Role = user.ActiveOrg.Role
+			}
+		}
+	}
+
+	err := setOrg(ctx, *org, org.Id)
+	if err != nil {
+		return err
+	}
+
+	return setUser(ctx, user)
+}
+
+func getOrgInvite(ctx context.Context, id string) (*OrgInvite, error) {
+	key := datastore.NameKey("org_invites", id, nil)
+	invite := &OrgInvite{}
+	if err := dbclient.Get(ctx, key, invite); err != nil {
+		return &OrgInvite{}, err
+	}
+
+	return invite, nil
+}
+
+func setOrgInvite(ctx context.Context, invite OrgInvite) error {
+	key := datastore.NameKey("org_invites", invite.Id, nil)
+	if _, err := dbclient.Put(ctx, key, &invite); err != nil {
+		log.Printf("Error setting org invite %s: %s", invite.Id, err)
+		return err
+	}
+
+	return nil
+}
+
+func getUserOrgInvites(ctx context.Context, userId string) ([]OrgInvite, error) {
+	q := datastore.NewQuery("org_invites").Filter("user_id =", userId)
+	var invites []OrgInvite
+	_, err := dbclient.GetAll(ctx, q, &invites)
+	if err != nil {
+		return []OrgInvite{}, err
+	}
+
+	return invites, nil
+}
+
+func arrayContainsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Every queue is per org AND environment, as multiple orgs can
+// have an environment with the same name.
+// Orborus without an environment header still uses the old org-id only key.
+func getQueueId(orgId, environment string) string {
+	if len(orgId) == 0 {
+		return environment
+	}
+
+	if len(environment) == 0 {
+		return orgId
+	}
+
+	return fmt.Sprintf("%s_%s", orgId, strings.ToLower(environment))
+}
+
+// Orborus without an environment header gets the work of the org's
+// default environment, so old deployments keep running executions
+func getQueueEnvironment(ctx context.Context, orgId, environment string) string {
+	if len(environment) > 0 {
+		return environment
+	}
+
+	environments, err := getEnvironments(ctx, orgId)
+	if err != nil {
+		log.Printf("Failed getting environments for %s: %s", orgId, err)
+		return environment
+	}
+
+	for _, env := range environments {
+		if env.Default && !env.Archived {
+			return env.Name
+		}
+	}
+
+	return environment
+}
+
+func getUserOrgs(ctx context.Context, user User) []OrgMini {
+	orgs := []OrgMini{}
+	for _, orgId := range user.Orgs {
+		org, err := getOrg(ctx, orgId)
+		if err != nil {
+			log.Printf("Failed getting org %s for user %s: %s", orgId, user.Username, err)
+			continue
+		}
+
+		orgs = append(orgs, OrgMini{
+			Name: org.Name,
+			Id:   org.Id,
+			Role: getOrgRole(*org, user.Id),
+		})
+	}
+
+	return orgs
+}
+
+// Sets up a default org if there are none, and moves everything
+// without an org into it. Keeps old installations working.
+func migrateDefaultOrg(ctx context.Context) error {
+	orgs, err := getAllOrgs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(orgs) > 0 {
+		return nil
+	}
+
+	// ORG_ID is what Orborus uses by default, so it's reused for the default org
+	orgId := os.Getenv("ORG_ID")
+	if len(orgId) == 0 {
+		orgId = uuid.NewV4().String()
+	}
+
+	log.Printf("No orgs found - setting up default org %s and migrating data", orgId)
+	org := Org{
+		Name:         "Shuffle",
+		Org:          "Shuffle",
+		Id:           orgId,
+		Users:        []User{},
+		CreationTime: time.Now().Unix(),
+	}
+
+	var users []User
+	q := datastore.NewQuery("Users")
+	_, err = dbclient.GetAll(ctx, q, &users)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if len(user.Username) == 0 {
+			continue
+		}
+
+		role := user.Role
+		if len(role) == 0 {
+			role = "user"
+		}
+
+		org.Users = append(org.Users, getOrgUser(user, role))
+		user.Orgs = []string{org.Id}
+		user.ActiveOrg = OrgMini{
+			Name: org.Name,
+			Id:   org.Id,
+			Role: role,
+		}
+
+		err = setUser(ctx, &user)
+		if err != nil {
+			log.Printf("Failed moving user %s to default org: %s", user.Username, err)
+		}
+	}
+
+	err = setOrg(ctx, org, org.Id)
+	if err != nil {
+		return err
+	}
+
+	workflows, err := getAllWorkflows(ctx)
+	if err == nil {
+		for _, workflow := range workflows {
+			if len(workflow.OrgId) > 0 {
+				continue
+			}
+
+			workflow.OrgId = org.Id
+			err = setWorkflow(ctx, workflow, workflow.ID)
+			if err != nil {
+				log.Printf("Failed moving workflow %s to default org: %s", workflow.ID, err)
+			}
+		}
+	}
+
+	var environments []Environment
+	q = datastore.NewQuery("Environments")
+	_, err = dbclient.GetAll(ctx, q, &environments)
+	if err == nil {
+		for _, environment := range environments {
+			if len(environment.OrgId) > 0 {
+				continue
+			}
+
+			// Key changes with the org, so the old one has to go
+			DeleteKey(ctx, "Environments", strings.ToLower(environment.Name))
+			environment.OrgId = org.Id
+			err = setEnvironment(ctx, &environment)
+			if err != nil {
+				log.Printf("Failed moving environment %s to default org: %s", environment.Name, err)
+			}
+		}
+	}
+
+	auths, err := getAllWorkflowAppAuth(ctx, "")
+	if err == nil {
+		for _, auth := range auths {
+			if len(auth.OrgId) > 0 {
+				continue
+			}
+
+			auth.OrgId = org.Id
+			err = setWorkflowAppAuthDatastore(ctx, auth, auth.Id)
+			if err != nil {
+				log.Printf("Failed moving auth %s to default org: %s", auth.Id, err)
+			}
+		}
+	}
+
+	var hooks []Hook
+	q = datastore.NewQuery("hooks")
+	_, err = dbclient.GetAll(ctx, q, &hooks)
+	if err == nil {
+		for _, hook := range hooks {
+			if len(hook.OrgId) > 0 {
+				continue
+			}
+
+			hook.OrgId = org.Id
+			err = setHook(ctx, hook)
+			if err != nil {
+				log.Printf("Failed moving hook %s to default org: %s", hook.Id, err)
+			}
+		}
+	}
+
+	schedules, err := getAllSchedules(ctx, "")
+	if err == nil {
+		for _, schedule := range schedules {
+			if len(schedule.Org) > 0 {
+				continue
+			}
+
+			schedule.Org = org.Id
+			err = setSchedule(ctx, schedule)
+			if err != nil {
+				log.Printf("Failed moving schedule %s to default org: %s", schedule.Id, err)
+			}
+		}
+	}
+
+	// FIXME: Executions are checked through their workflow, so old ones aren't moved.
+	log.Printf("Finished moving data to default org %s", org.Id)
+	return nil
+}
+
+func handleGetOrgs(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get orgs: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	orgs := getUserOrgs(ctx, user)
+	newjson, err := json.Marshal(orgs)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed unpacking orgs"}`)))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func handleGetOrg(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get org: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 4 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+	}
+
+	// Not always a uuid, as the default org can be set with ORG_ID
+	if len(fileId) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID is not valid"}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getOrg(ctx, fileId)
+	if err != nil {
+		log.Printf("Failed getting org %s: %s", fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if len(getOrgRole(*org, user.Id)) == 0 {
+		log.Printf("User %s isn't a member of org %s", user.Username, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(org)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed unpacking org"}`)))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Any admin can make a new org, and becomes the admin of that org
+func handleCreateOrg(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in create org: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("Error with body read: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var tmpData Org
+	err = json.Unmarshal(body, &tmpData)
+	if err != nil {
+		log.Printf("Failed unmarshaling org: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if len(tmpData.Name) < 2 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org name needs to be at least two characters"}`))
+		return
+	}
+
+	org := Org{
+		Name:         tmpData.Name,
+		Description:  tmpData.Description,
+		Org:          tmpData.Name,
+		Id:           uuid.NewV4().String(),
+		Users:        []User{},
+		CreationTime: time.Now().Unix(),
+	}
+
+	ctx := context.Background()
+	err = addOrgUser(ctx, &org, &user, "admin")
+	if err != nil {
+		log.Printf("Failed setting up org %s: %s", org.Name, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed setting up org"}`))
+		return
+	}
+
+	// Every org needs somewhere to execute
+	environment := Environment{
+		Name:    "Shuffle",
+		Type:    "onprem",
+		Default: true,
+		OrgId:   org.Id,
+	}
+
+	err = setEnvironment(ctx, &environment)
+	if err != nil {
+		log.Printf("Failed setting up environment for org %s: %s", org.Id, err)
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.create", "org", org.Id, nil, map[string]string{"name": org.Name, "description": org.Description})
+
+	log.Printf("%s created org %s (%s)", user.Username, org.Name, org.Id)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, org.Id)))
+}
+
+// Switches the active org of the user. Everything after this is scoped to that org.
+func handleChangeUserOrg(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in change org: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 4 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+	}
+
+	// Not always a uuid, as the default org can be set with ORG_ID
+	if len(fileId) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID is not valid"}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getOrg(ctx, fileId)
+	if err != nil {
+		log.Printf("Failed getting org %s: %s", fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	role := getOrgRole(*org, user.Id)
+	if len(role) == 0 {
+		log.Printf("User %s can't change to org %s as they aren't a member", user.Username, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Not a member of the org"}`))
+		return
+	}
+
+	user.ActiveOrg = OrgMini{
+		Name: org.Name,
+		Id:   org.Id,
+		Role: role,
+	}
+	user.Role = role
+
+	// Same policy as when logging in
+	if !user.Mfa.Active && mfaRequired(ctx, user) {
+		log.Printf("User %s can't change to org %s without MFA", user.Username, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "The org requires MFA. Set it up before changing to it", "mfa_required": true}`))
+		return
+	}
+
+	err = setUser(ctx, &user)
+	if err != nil {
+		log.Printf("Failed changing org for %s: %s", user.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("%s changed active org to %s (%s)", user.Username, org.Name, org.Id)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Adds a user to the org, or changes their role. Org admins only.
+func handleSetOrgUser(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in set org user: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+
+	var fileId string
+	if location[1] == "api" {
+		if len(location) <= 4 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+	}
+
+	// Not always a uuid, as the default org can be set with ORG_ID
+	if len(fileId) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID is not valid"}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getOrg(ctx, fileId)
+	if err != nil {
+		log.Printf("Failed getting org %s: %s", fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if getOrgRole(*org, user.Id) != "admin" {
+		log.Printf("User %s isn't admin of org %s", user.Username, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org admin required"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("Error with body read: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var tmpData orgUserData
+	err = json.Unmarshal(body, &tmpData)
+	if err != nil {
+		log.Printf("Failed unmarshaling org user: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if tmpData.Role != "admin" && tmpData.Role != "user" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Role has to be admin or user"}`))
+		return
+	}
+
+	var foundUser *User
+	if len(tmpData.UserId) > 0 {
+		foundUser, err = getUser(ctx, tmpData.UserId)
+	} else {
+		var users []User
+		q := datastore.NewQuery("Users").Filter("Username =", strings.ToLower(tmpData.Username))
+		_, err = dbclient.GetAll(ctx, q, &users)
+		if err == nil && len(users) == 0 {
+			err = errors.New(fmt.Sprintf("User %s doesn't exist", tmpData.Username))
+		} else if err == nil {
+			foundUser = &users[0]
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed finding user to add to org %s: %s", org.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "User not found"}`))
+		return
+	}
+
+	if foundUser.Id == user.Id && tmpData.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Can't remove your own admin rights"}`))
+		return
+	}
+
+	// Nobody is added to an org without agreeing to it
+	oldRole := getOrgRole(*org, foundUser.Id)
+	if len(oldRole) == 0 {
+		invites, err := getUserOrgInvites(ctx, foundUser.Id)
+		if err != nil {
+			log.Printf("Failed getting invites for %s: %s", foundUser.Id, err)
+		}
+
+		invite := OrgInvite{
+			Id:        uuid.NewV4().String(),
+			OrgId:     org.Id,
+			OrgName:   org.Name,
+			UserId:    foundUser.Id,
+			Role:      tmpData.Role,
+			InvitedBy: user.Username,
+			Created:   time.Now().Unix(),
+		}
+
+		for _, oldInvite := range invites {
+			if oldInvite.OrgId == org.Id {
+				invite.Id = oldInvite.Id
+				break
+			}
+		}
+
+		err = setOrgInvite(ctx, invite)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed inviting the user"}`))
+			return
+		}
+
+		addOrgAuditLog(ctx, request, user, org.Id, "org.user_invite", "user", foundUser.Id, nil, map[string]string{"role": tmpData.Role, "invite_id": invite.Id})
+
+		resp.WriteHeader(200)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "invited": true, "invite_id": "%s"}`, invite.Id)))
+		return
+	}
+
+	err = addOrgUser(ctx, org, foundUser, tmpData.Role)
+	if err != nil {
+		log.Printf("Failed adding user %s to org %s: %s", foundUser.Username, org.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.user_set", "user", foundUser.Id, map[string]string{"role": oldRole}, map[string]string{"role": tmpData.Role})
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// GET /api/v1/orgs/invites
+// The invites waiting for the user
+func handleGetOrgInvites(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get org invites: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	invites, err := getUserOrgInvites(ctx, user.Id)
+	if err != nil {
+		log.Printf("Failed getting invites for %s: %s", user.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(invites)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking invites"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// POST /api/v1/orgs/invites/{id}/accept or /decline
+// Only the invited user can answer
+func handleAnswerOrgInvite(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in answer org invite: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 7 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	invite, err := getOrgInvite(ctx, location[5])
+	if err != nil || invite.UserId != user.Id {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Invite not found"}`))
+		return
+	}
+
+	key := datastore.NameKey("org_invites", invite.Id, nil)
+	if location[6] == "decline" {
+		err = dbclient.Delete(ctx, key)
+		if err != nil {
+			log.Printf("Failed deleting invite %s: %s", invite.Id, err)
+		}
+
+		addOrgAuditLog(ctx, request, user, invite.OrgId, "org.user_decline", "user", user.Id, nil, nil)
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	org, err := getOrg(ctx, invite.OrgId)
+	if err != nil {
+		log.Printf("Failed getting org %s: %s", invite.OrgId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org not found"}`))
+		return
+	}
+
+	foundUser, err := getUser(ctx, user.Id)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "User not found"}`))
+		return
+	}
+
+	err = addOrgUser(ctx, org, foundUser, invite.Role)
+	if err != nil {
+		log.Printf("Failed adding user %s to org %s: %s", foundUser.Username, org.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = dbclient.Delete(ctx, key)
+	if err != nil {
+		log.Printf("Failed deleting invite %s: %s", invite.Id, err)
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.user_set", "user", user.Id, map[string]string{"role": ""}, map[string]string{"role": invite.Role})
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Removes a user from the org. Org admins only.
+func handleRemoveOrgUser(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in remove org user: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+
+	var fileId string
+	var userId string
+	if location[1] == "api" {
+		if len(location) <= 6 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		fileId = location[4]
+		userId = location[6]
+	}
+
+	// Not always a uuid, as the default org can be set with ORG_ID
+	if len(fileId) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID is not valid"}`))
+		return
+	}
+
+	if userId == user.Id {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Can't remove yourself from the org"}`))
+		return
+	}
+
+	ctx := context.Background()
+	org, err := getOrg(ctx, fileId)
+	if err != nil {
+		log.Printf("Failed getting org %s: %s", fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if getOrgRole(*org, user.Id) != "admin" {
+		log.Printf("User %s isn't admin of org %s", user.Username, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Org admin required"}`))
+		return
+	}
+
+	foundUser, err := getUser(ctx, userId)
+	if err != nil {
+		log.Printf("Failed getting user %s: %s", userId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "User not found"}`))
+		return
+	}
+
+	err = removeOrgUser(ctx, org, foundUser)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	addOrgAuditLog(ctx, request, user, org.Id, "org.user_remove", "user", foundUser.Id, map[string]string{"username": foundUser.Username}, nil)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// The environments that have to run nodes of the execution
+func getExecutionEnvironments(workflowExecution WorkflowExecution) []string {
+	environments := []string{}
+	for _, action := range workflowExecution.Workflow.Actions {
+		if action.Environment == cloudname || arrayContainsString(environments, action.Environment) {
+			continue
+		}
+
+		environments = append(environments, action.Environment)
+	}
+
+	return environments
+}
+
+// Changes the status only if it's still the old one, so a result or abort
+// that comes in at the same time isn't overwritten
+func updateExecutionStatus(ctx context.Context, executionId, oldStatus, newStatus string) (*WorkflowExecution, error) {
+	key := datastore.NameKey("workflowexecution", strings.ToLower(executionId), nil)
+	workflowExecution := &WorkflowExecution{}
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, workflowExecution); err != nil {
+			return err
+		}
+
+		if workflowExecution.Status != oldStatus {
+			return errors.New(fmt.Sprintf("Status for %s is %s, not %s", executionId, workflowExecution.Status, oldStatus))
+		}
+
+		workflowExecution.Status = newStatus
+		setConcurrencyFields(workflowExecution)
+		_, err := tx.Put(key, workflowExecution)
+		return err
+	})
+
+	return workflowExecution, err
+}
+
+// Saves an execution that was read while its status was oldStatus. If the
+// status was changed in the meantime, e.g. by a pause, resume or abort, the
+// new status is kept unless this update decided a status itself. An update
+// can't bring back an execution that was stopped
+func setWorkflowExecutionStatus(ctx context.Context, workflowExecution *WorkflowExecution, oldStatus string) error {
+	key := datastore.NameKey("workflowexecution", workflowExecution.ExecutionId, nil)
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		curExecution := WorkflowExecution{}
+		if err := tx.Get(key, &curExecution); err != nil {
+			return err
+		}
+
+		if curExecution.Status != oldStatus {
+			if curExecution.Status != "EXECUTING" && curExecution.Status != "PAUSED" {
+				return errors.New(fmt.Sprintf("Status for %s changed to %s", workflowExecution.ExecutionId, curExecution.Status))
+			}
+
+			if workflowExecution.Status == oldStatus {
+				workflowExecution.Status = curExecution.Status
+			}
+		}
+
+		setConcurrencyFields(workflowExecution)
+		_, err := tx.Put(key, workflowExecution)
+		return err
+	})
+
+	return err
+}
+
+// POST /api/v1/workflows/{id}/executions/{id}/pause
+// The worker stops starting nodes and exits. Nodes that already started
+// still report their results
+func handlePauseExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in pause execution: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflowExecution, err := getRequestExecution(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting execution to pause: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting the execution"}`))
+		return
+	}
+
+	if workflowExecution.Status != "EXECUTING" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Status for %s is %s, which can't be paused."}`, workflowExecution.ExecutionId, workflowExecution.Status)))
+		return
+	}
+
+	workflowExecution, err = updateExecutionStatus(ctx, workflowExecution.ExecutionId, "EXECUTING", "PAUSED")
+	if err != nil {
+		log.Printf("Failed pausing %s: %s", workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed setting workflowexecution status to paused"}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "execution.pause", "execution", workflowExecution.ExecutionId, nil, map[string]string{"workflow_id": workflowExecution.Workflow.ID})
+
+	log.Printf("[INFO] Paused execution %s", workflowExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true, "status": "PAUSED"}`))
+}
+
+// POST /api/v1/workflows/{id}/executions/{id}/resume
+// Queues the execution again. The new worker continues from the results
+// that are there
+func handleResumeExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in resume execution: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflowExecution, err := getRequestExecution(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting execution to resume: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting the execution"}`))
+		return
+	}
+
+	if workflowExecution.Status != "PAUSED" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Status for %s is %s, which can't be resumed."}`, workflowExecution.ExecutionId, workflowExecution.Status)))
+		return
+	}
+
+	workflowExecution, err = updateExecutionStatus(ctx, workflowExecution.ExecutionId, "PAUSED", "EXECUTING")
+	if err != nil {
+		log.Printf("Failed resuming %s: %s", workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed setting workflowexecution status to executing"}`))
+		return
+	}
+
+	queueExecution(ctx, *workflowExecution, getExecutionEnvironments(*workflowExecution))
+	addAuditLog(ctx, request, user, "execution.resume", "execution", workflowExecution.ExecutionId, nil, map[string]string{"workflow_id": workflowExecution.Workflow.ID})
+
+	log.Printf("[INFO] Resumed execution %s", workflowExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true, "status": "EXECUTING"}`))
+}
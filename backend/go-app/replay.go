@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type ReplayRequest struct {
+	Revision int64 `json:"revision"`
+}
+
+// How one node did in an execution compared to the one it replays.
+// Change is added, removed, changed or same
+type ResultDiff struct {
+	ActionId     string `json:"action_id"`
+	Label        string `json:"label"`
+	Change       string `json:"change"`
+	StatusBefore string `json:"status_before"`
+	StatusAfter  string `json:"status_after"`
+	ResultBefore string `json:"result_before"`
+	ResultAfter  string `json:"result_after"`
+}
+
+// The execution in /api/v1/workflows/{id}/executions/{id}/..., if the user can see it
+func getRequestExecution(ctx context.Context, user User, location []string) (*WorkflowExecution, error) {
+	if len(location) < 7 || len(location[4]) != 36 || len(location[6]) != 36 {
+		return &WorkflowExecution{}, errors.New("Workflow or execution ID not valid")
+	}
+
+	workflowExecution, err := getWorkflowExecution(ctx, location[6])
+	if err != nil {
+		return &WorkflowExecution{}, err
+	}
+
+	if workflowExecution.Workflow.ID != location[4] {
+		return &WorkflowExecution{}, errors.New(fmt.Sprintf("Execution %s isn't from workflow %s", location[6], location[4]))
+	}
+
+	if !canAccessExecution(user, *workflowExecution) {
+		return &WorkflowExecution{}, errors.New(fmt.Sprintf("Wrong user (%s) for workflowexecution %s", user.Username, location[6]))
+	}
+
+	return workflowExecution, nil
+}
+
+func canAccessExecution(user User, workflowExecution WorkflowExecution) bool {
+	return (user.Id == workflowExecution.Workflow.Owner || user.Role == "admin") && workflowExecution.Workflow.OrgId == user.ActiveOrg.Id
+}
+
+// Every node in either execution, in the order of the newest workflow
+func getResultDiff(before, after WorkflowExecution) []ResultDiff {
+	actions := []Action{}
+	found := map[string]bool{}
+	for _, workflowActions := range [][]Action{after.Workflow.Actions, before.Workflow.Actions} {
+		for _, action := range workflowActions {
+			if !found[action.ID] {
+				actions = append(actions, action)
+				found[action.ID] = true
+			}
+		}
+	}
+
+	diffs := []ResultDiff{}
+	for _, action := range actions {
+		diff := ResultDiff{
+			ActionId: action.ID,
+			Label:    action.Label,
+		}
+
+		beforeFound := false
+		for _, result := range before.Results {
+			if result.Action.ID == action.ID {
+				diff.StatusBefore = result.Status
+				diff.ResultBefore = result.Result
+				beforeFound = true
+				break
+			}
+		}
+
+		afterFound := false
+		for _, result := range after.Results {
+			if result.Action.ID == action.ID {
+				diff.StatusAfter = result.Status
+				diff.ResultAfter = result.Result
+				afterFound = true
+				break
+			}
+		}
+
+		if beforeFound && !afterFound {
+			diff.Change = "removed"
+		} else if !beforeFound && afterFound {
+			diff.Change = "added"
+		} else if diff.StatusBefore != diff.StatusAfter || diff.ResultBefore != diff.ResultAfter {
+			diff.Change = "changed"
+		} else {
+			diff.Change = "same"
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	return diffs
+}
+
+// Runs an old execution again with the same input, source and start node.
+// Uses the current workflow unless a revision is given
+func handleReplayExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in replay execution: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for replay")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var replay ReplayRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &replay)
+		if err != nil {
+			log.Printf("Failed replay unmarshaling: %s", err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+			return
+		}
+	}
+
+	ctx := context.Background()
+	location := strings.Split(request.URL.Path, "/")
+	workflowExecution, err := getRequestExecution(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting execution to replay: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting the execution"}`))
+		return
+	}
+
+	workflow, err := getWorkflow(ctx, workflowExecution.Workflow.ID)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "The workflow doesn't exist anymore"}`))
+		return
+	}
+
+	workflow, err = getWorkflowAtRevision(ctx, *workflow, replay.Revision)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Revision %d doesn't exist"}`, replay.Revision)))
+		return
+	}
+
+	start := workflowExecution.Start
+	if len(start) == 0 {
+		start = workflowExecution.Workflow.Start
+	}
+
+	executionBody, err := json.Marshal(ExecutionRequest{
+		ExecutionArgument: workflowExecution.ExecutionArgument,
+		ExecutionSource:   workflowExecution.ExecutionSource,
+		Start:             start,
+		ReplayOf:          workflowExecution.ExecutionId,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making replay request"}`))
+		return
+	}
+
+	executionRequest, err := http.NewRequest("POST", fmt.Sprintf("/api/v1/workflows/%s/execute", workflow.ID), bytes.NewReader(executionBody))
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making replay request"}`))
+		return
+	}
+
+	newExecution, executionResp, err := handleExecution(workflow.ID, *workflow, executionRequest)
+	if err != nil {
+		log.Printf("Failed replaying %s: %s", workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, executionResp)))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "execution.replay", "execution", newExecution.ExecutionId, nil, map[string]interface{}{"workflow_id": workflow.ID, "replay_of": workflowExecution.ExecutionId, "revision": workflow.Revision})
+
+	log.Printf("[INFO] Replaying %s with revision %d as %s", workflowExecution.ExecutionId, workflow.Revision, newExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "execution_id": "%s", "authorization": "%s", "replay_of": "%s", "revision": %d}`, newExecution.ExecutionId, newExecution.Authorization, workflowExecution.ExecutionId, workflow.Revision)))
+}
+
+// The results of a replay or rerun next to the execution it came from
+func handleGetExecutionDiff(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in execution diff: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	location := strings.Split(request.URL.Path, "/")
+	workflowExecution, err := getRequestExecution(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting execution for diff: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting the execution"}`))
+		return
+	}
+
+	otherId := workflowExecution.ReplayOf
+	if len(otherId) == 0 {
+		otherId = workflowExecution.RerunOf
+	}
+
+	if len(otherId) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "The execution isn't a replay or rerun"}`))
+		return
+	}
+
+	otherExecution, err := getWorkflowExecution(ctx, otherId)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution %s doesn't exist anymore"}`, otherId)))
+		return
+	}
+
+	diffs, err := json.Marshal(getResultDiff(*otherExecution, *workflowExecution))
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making the diff"}`))
+		return
+	}
+
+	finished := workflowExecution.Status != "EXECUTING" && workflowExecution.Status != "PAUSED"
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "execution_id": "%s", "compared_to": "%s", "status": "%s", "finished": %t, "diff": %s}`, workflowExecution.ExecutionId, otherId, workflowExecution.Status, finished, string(diffs))))
+}
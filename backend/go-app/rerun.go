@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type RerunRequest struct {
+	Start string `json:"start"`
+}
+
+// Successful results from the old execution replace the skipped nodes that
+// aren't under the start node. Everything under it runs again
+func getRerunResults(workflowExecution WorkflowExecution, oldExecution WorkflowExecution, childNodes []string, results []ActionResult) []ActionResult {
+	newResults := []ActionResult{}
+	seeded := map[string]bool{}
+	for _, oldResult := range oldExecution.Results {
+		if oldResult.Status != "SUCCESS" && oldResult.Status != "FINISHED" {
+			continue
+		}
+
+		if arrayContainsString(childNodes, oldResult.Action.ID) {
+			continue
+		}
+
+		found := false
+		for _, action := range workflowExecution.Workflow.Actions {
+			if action.ID == oldResult.Action.ID {
+				oldResult.Action = action
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		oldResult.ExecutionId = workflowExecution.ExecutionId
+		oldResult.Authorization = workflowExecution.Authorization
+		newResults = append(newResults, oldResult)
+		seeded[oldResult.Action.ID] = true
+	}
+
+	for _, result := range results {
+		if !seeded[result.Action.ID] {
+			newResults = append(newResults, result)
+		}
+	}
+
+	return newResults
+}
+
+// The first node that didn't make it
+func getRerunStart(workflowExecution WorkflowExecution) string {
+	for _, result := range workflowExecution.Results {
+		if result.Status == "FAILURE" || result.Status == "ABORTED" {
+			return result.Action.ID
+		}
+	}
+
+	return ""
+}
+
+// Starts a new execution from a node of an old one, with the results that
+// came before it. Defaults to the node that failed
+func handleRerunExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in rerun execution: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for rerun")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var rerun RerunRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &rerun)
+		if err != nil {
+			log.Printf("Failed rerun unmarshaling: %s", err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+			return
+		}
+	}
+
+	ctx := context.Background()
+	location := strings.Split(request.URL.Path, "/")
+	workflowExecution, err := getRequestExecution(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting execution to rerun: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting the execution"}`))
+		return
+	}
+
+	workflowId := workflowExecution.Workflow.ID
+	executionId := workflowExecution.ExecutionId
+
+	if workflowExecution.Status == "EXECUTING" || workflowExecution.Status == "PAUSED" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution %s is still running"}`, executionId)))
+		return
+	}
+
+	if len(rerun.Start) == 0 {
+		rerun.Start = getRerunStart(*workflowExecution)
+		if len(rerun.Start) == 0 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Nothing failed. Choose a node to start from"}`))
+			return
+		}
+	}
+
+	executionBody, err := json.Marshal(ExecutionRequest{
+		ExecutionArgument: workflowExecution.ExecutionArgument,
+		ExecutionSource:   "rerun",
+		Start:             rerun.Start,
+		RerunOf:           workflowExecution.ExecutionId,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making rerun request"}`))
+		return
+	}
+
+	executionRequest, err := http.NewRequest("POST", fmt.Sprintf("/api/v1/workflows/%s/execute", workflowId), bytes.NewReader(executionBody))
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed making rerun request"}`))
+		return
+	}
+
+	newExecution, executionResp, err := handleExecution(workflowId, Workflow{}, executionRequest)
+	if err != nil {
+		log.Printf("Failed rerunning %s from %s: %s", executionId, rerun.Start, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, executionResp)))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "execution.rerun", "execution", newExecution.ExecutionId, nil, map[string]string{"workflow_id": workflowId, "rerun_of": executionId, "start": rerun.Start})
+
+	log.Printf("[INFO] Rerunning %s from %s as %s", executionId, rerun.Start, newExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "execution_id": "%s", "authorization": "%s", "rerun_of": "%s", "start": "%s"}`, newExecution.ExecutionId, newExecution.Authorization, executionId, rerun.Start)))
+}
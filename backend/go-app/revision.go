@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Every save makes one of these. They're never changed afterwards.
+// Key = <workflow id>_<revision>
+type WorkflowRevision struct {
+	WorkflowId string    `json:"workflow_id" datastore:"workflow_id"`
+	OrgId      string    `json:"org_id" datastore:"org_id"`
+	Revision   int64     `json:"revision" datastore:"revision"`
+	Author     string    `json:"author" datastore:"author"`
+	AuthorName string    `json:"author_name" datastore:"author_name,noindex"`
+	Message    string    `json:"message" datastore:"message,noindex"`
+	Created    int64     `json:"created" datastore:"created"`
+	Workflow   *Workflow `json:"workflow,omitempty" datastore:"workflow,noindex"`
+}
+
+// One change between two revisions. Type is workflow, action, parameter,
+// branch or trigger. Change is added, removed or changed.
+type WorkflowDiff struct {
+	Type   string      `json:"type"`
+	Change string      `json:"change"`
+	Id     string      `json:"id"`
+	Label  string      `json:"label"`
+	Field  string      `json:"field,omitempty"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+func getRevisionKey(workflowId string, revision int64) string {
+	return fmt.Sprintf("%s_%d", workflowId, revision)
+}
+
+func getWorkflowRevision(ctx context.Context, workflowId string, revision int64) (*WorkflowRevision, error) {
+	key := datastore.NameKey("workflow_revisions", getRevisionKey(workflowId, revision), nil)
+	workflowRevision := &WorkflowRevision{}
+	if err := dbclient.Get(ctx, key, workflowRevision); err != nil {
+		return &WorkflowRevision{}, err
+	}
+
+	return workflowRevision, nil
+}
+
+// Newest first
+func getWorkflowRevisions(ctx context.Context, workflowId string) ([]WorkflowRevision, error) {
+	q := datastore.NewQuery("workflow_revisions").Filter("workflow_id =", workflowId)
+	var revisions []WorkflowRevision
+	_, err := dbclient.GetAll(ctx, q, &revisions)
+	if err != nil {
+		return []WorkflowRevision{}, err
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+
+	return revisions, nil
+}
+
+func getNewWorkflowRevision(user User, workflow Workflow, message string) WorkflowRevision {
+	return WorkflowRevision{
+		WorkflowId: workflow.ID,
+		OrgId:      workflow.OrgId,
+		Revision:   workflow.Revision,
+		Author:     user.Id,
+		AuthorName: user.Username,
+		Message:    message,
+		Created:    time.Now().Unix(),
+		Workflow:   &workflow,
+	}
+}
+
+// Stores the workflow as it is now. workflow.Revision has to be set already
+func addWorkflowRevision(ctx context.Context, user User, workflow Workflow, message string) error {
+	workflowRevision := getNewWorkflowRevision(user, workflow, message)
+	key := datastore.NameKey("workflow_revisions", getRevisionKey(workflow.ID, workflow.Revision), nil)
+	if _, err := dbclient.Put(ctx, key, &workflowRevision); err != nil {
+		log.Printf("Error adding revision %d for workflow %s: %s", workflow.Revision, workflow.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// Saves the workflow as the next revision. The number is taken in a
+// transaction, so saves at the same time can't get the same one. Workflows
+// from before revisions existed first keep what they were as revision 1.
+// Publishing is kept from what's stored
+func setWorkflowRevision(ctx context.Context, user User, workflow Workflow, message string) (Workflow, error) {
+	key := datastore.NameKey("workflow", workflow.ID, nil)
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		storedWorkflow := Workflow{}
+		err := tx.Get(key, &storedWorkflow)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		workflow.Revision = 1
+		if err == nil {
+			if storedWorkflow.Revision == 0 {
+				storedWorkflow.Revision = 1
+				oldRevision := getNewWorkflowRevision(User{}, storedWorkflow, "Before revisions")
+				oldKey := datastore.NameKey("workflow_revisions", getRevisionKey(workflow.ID, 1), nil)
+				if _, err := tx.Put(oldKey, &oldRevision); err != nil {
+					return err
+				}
+			}
+
+			workflow.Revision = storedWorkflow.Revision + 1
+			workflow.Published = storedWorkflow.Published
+			workflow.PublishedRevisions = storedWorkflow.PublishedRevisions
+		}
+
+		if _, err := tx.Put(key, &workflow); err != nil {
+			return err
+		}
+
+		workflowRevision := getNewWorkflowRevision(user, workflow, message)
+		revisionKey := datastore.NameKey("workflow_revisions", getRevisionKey(workflow.ID, workflow.Revision), nil)
+		_, err = tx.Put(revisionKey, &workflowRevision)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Error saving revision of workflow %s: %s", workflow.ID, err)
+		return workflow, err
+	}
+
+	return workflow, nil
+}
+
+// Top level JSON fields that are different, except the ones in skip
+func getChangedFields(before, after interface{}, skip []string) map[string][]interface{} {
+	beforeMap := map[string]interface{}{}
+	afterMap := map[string]interface{}{}
+	data, err := json.Marshal(before)
+	if err == nil {
+		json.Unmarshal(data, &beforeMap)
+	}
+
+	data, err = json.Marshal(after)
+	if err == nil {
+		json.Unmarshal(data, &afterMap)
+	}
+
+	changed := map[string][]interface{}{}
+	for key, value := range beforeMap {
+		if !reflect.DeepEqual(value, afterMap[key]) {
+			changed[key] = []interface{}{value, afterMap[key]}
+		}
+	}
+
+	for key, value := range afterMap {
+		if _, ok := beforeMap[key]; !ok {
+			changed[key] = []interface{}{nil, value}
+		}
+	}
+
+	for _, key := range skip {
+		delete(changed, key)
+	}
+
+	return changed
+}
+
+// Appends the changed fields sorted by name, so the output is stable
+func appendFieldDiffs(diffs []WorkflowDiff, itemType, id, label string, changed map[string][]interface{}) []WorkflowDiff {
+	fields := []string{}
+	for field := range changed {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+	for _, field := range fields {
+		diffs = append(diffs, WorkflowDiff{
+			Type:   itemType,
+			Change: "changed",
+			Id:     id,
+			Label:  label,
+			Field:  field,
+			Before: changed[field][0],
+			After:  changed[field][1],
+		})
+	}
+
+	return diffs
+}
+
+// Parameters are compared by name. Only what the user sets is interesting
+func getParameterDiffs(diffs []WorkflowDiff, id string, before, after []WorkflowAppActionParameter) []WorkflowDiff {
+	beforeParams := map[string]WorkflowAppActionParameter{}
+	for _, param := range before {
+		beforeParams[param.Name] = param
+	}
+
+	for _, param := range after {
+		oldParam, ok := beforeParams[param.Name]
+		if !ok {
+			diffs = append(diffs, WorkflowDiff{Type: "parameter", Change: "added", Id: id, Label: param.Name, After: param.Value})
+			continue
+		}
+
+		delete(beforeParams, param.Name)
+		if oldParam.Value != param.Value || oldParam.Variant != param.Variant || oldParam.ActionField != param.ActionField {
+			diffs = append(diffs, WorkflowDiff{
+				Type:   "parameter",
+				Change: "changed",
+				Id:     id,
+				Label:  param.Name,
+				Field:  "value",
+				Before: oldParam.Value,
+				After:  param.Value,
+			})
+		}
+	}
+
+	for _, param := range before {
+		if _, ok := beforeParams[param.Name]; ok {
+			diffs = append(diffs, WorkflowDiff{Type: "parameter", Change: "removed", Id: id, Label: param.Name, Before: param.Value})
+		}
+	}
+
+	return diffs
+}
+
+// Compares two versions of a workflow at the action, branch and parameter level.
+// Moving nodes around isn't counted as a change.
+func getWorkflowDiff(before, after Workflow) []WorkflowDiff {
+	diffs := []WorkflowDiff{}
+
+	workflowSkip := []string{"actions", "branches", "triggers", "schedules", "revision", "revision_message", "errors", "is_valid", "org", "execution_org"}
+	diffs = appendFieldDiffs(diffs, "workflow", after.ID, after.Name, getChangedFields(before, after, workflowSkip))
+
+	nodeSkip := []string{"parameters", "position", "errors", "is_valid", "small_image", "large_image"}
+	beforeActions := map[string]Action{}
+	for _, action := range before.Actions {
+		beforeActions[action.ID] = action
+	}
+
+	for _, action := range after.Actions {
+		oldAction, ok := beforeActions[action.ID]
+		if !ok {
+			diffs = append(diffs, WorkflowDiff{Type: "action", Change: "added", Id: action.ID, Label: action.Label})
+			continue
+		}
+
+		delete(beforeActions, action.ID)
+		diffs = appendFieldDiffs(diffs, "action", action.ID, action.Label, getChangedFields(oldAction, action, nodeSkip))
+		diffs = getParameterDiffs(diffs, action.ID, oldAction.Parameters, action.Parameters)
+	}
+
+	for _, action := range before.Actions {
+		if _, ok := beforeActions[action.ID]; ok {
+			diffs = append(diffs, WorkflowDiff{Type: "action", Change: "removed", Id: action.ID, Label: action.Label})
+		}
+	}
+
+	beforeTriggers := map[string]Trigger{}
+	for _, trigger := range before.Triggers {
+		beforeTriggers[trigger.ID] = trigger
+	}
+
+	for _, trigger := range after.Triggers {
+		oldTrigger, ok := beforeTriggers[trigger.ID]
+		if !ok {
+			diffs = append(diffs, WorkflowDiff{Type: "trigger", Change: "added", Id: trigger.ID, Label: trigger.Label})
+			continue
+		}
+
+		delete(beforeTriggers, trigger.ID)
+		diffs = appendFieldDiffs(diffs, "trigger", trigger.ID, trigger.Label, getChangedFields(oldTrigger, trigger, nodeSkip))
+		diffs = getParameterDiffs(diffs, trigger.ID, oldTrigger.Parameters, trigger.Parameters)
+	}
+
+	for _, trigger := range before.Triggers {
+		if _, ok := beforeTriggers[trigger.ID]; ok {
+			diffs = append(diffs, WorkflowDiff{Type: "trigger", Change: "removed", Id: trigger.ID, Label: trigger.Label})
+		}
+	}
+
+	beforeBranches := map[string]Branch{}
+	for _, branch := range before.Branches {
+		beforeBranches[branch.ID] = branch
+	}
+
+	for _, branch := range after.Branches {
+		label := fmt.Sprintf("%s -> %s", branch.SourceID, branch.DestinationID)
+		oldBranch, ok := beforeBranches[branch.ID]
+		if !ok {
+			diffs = append(diffs, WorkflowDiff{Type: "branch", Change: "added", Id: branch.ID, Label: label})
+			continue
+		}
+
+		delete(beforeBranches, branch.ID)
+		diffs = appendFieldDiffs(diffs, "branch", branch.ID, label, getChangedFields(oldBranch, branch, []string{"has_errors"}))
+	}
+
+	for _, branch := range before.Branches {
+		if _, ok := beforeBranches[branch.ID]; ok {
+			label := fmt.Sprintf("%s -> %s", branch.SourceID, branch.DestinationID)
+			diffs = append(diffs, WorkflowDiff{Type: "branch", Change: "removed", Id: branch.ID, Label: label})
+		}
+	}
+
+	return diffs
+}
+
+// Gets the workflow in the path and checks that the user can see it
+func getRevisionWorkflow(ctx context.Context, user User, location []string) (*Workflow, error) {
+	if len(location) <= 4 || len(location[4]) != 36 {
+		return &Workflow{}, errors.New("Workflow ID is not valid")
+	}
+
+	workflow, err := getWorkflow(ctx, location[4])
+	if err != nil {
+		return &Workflow{}, err
+	}
+
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
+		return &Workflow{}, errors.New(fmt.Sprintf("Wrong user (%s) for workflow %s (revisions)", user.Username, workflow.ID))
+	}
+
+	return workflow, nil
+}
+
+// GET /api/v1/workflows/{id}/revisions - all revisions without the workflows
+// GET /api/v1/workflows/{id}/revisions/{revision} - one revision with the workflow
+// GET /api/v1/workflows/{id}/revisions/{revision}/diff/{revision} - the changes between the two
+func handleGetWorkflowRevisions(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get workflow revisions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting workflow for revisions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if len(location) <= 6 {
+		revisions, err := getWorkflowRevisions(ctx, workflow.ID)
+		if err != nil {
+			log.Printf("Failed getting revisions for %s: %s", workflow.ID, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed getting revisions"}`))
+			return
+		}
+
+		for index := range revisions {
+			revisions[index].Workflow = nil
+		}
+
+		newjson, err := json.Marshal(revisions)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed unpacking revisions"}`))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write(newjson)
+		return
+	}
+
+	revisionNumber, err := strconv.ParseInt(location[6], 10, 64)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Revision has to be a number"}`))
+		return
+	}
+
+	revision, err := getWorkflowRevision(ctx, workflow.ID, revisionNumber)
+	if err != nil || revision.Workflow == nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Revision %d doesn't exist"}`, revisionNumber)))
+		return
+	}
+
+	var newjson []byte
+	if len(location) > 8 && location[7] == "diff" {
+		otherNumber, err := strconv.ParseInt(location[8], 10, 64)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Revision has to be a number"}`))
+			return
+		}
+
+		otherRevision, err := getWorkflowRevision(ctx, workflow.ID, otherNumber)
+		if err != nil || otherRevision.Workflow == nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Revision %d doesn't exist"}`, otherNumber)))
+			return
+		}
+
+		newjson, err = json.Marshal(getWorkflowDiff(*revision.Workflow, *otherRevision.Workflow))
+	} else {
+		newjson, err = json.Marshal(revision)
+	}
+
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking revision"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Makes a new revision with the content of an old one. Schedules aren't
+// touched, as they're running independently of the saved workflow.
+func handleRestoreWorkflowRevision(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in restore workflow revision: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, location)
+	if err != nil || len(location) <= 6 {
+		log.Printf("Failed getting workflow for revision restore: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	revisionNumber, err := strconv.ParseInt(location[6], 10, 64)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Revision has to be a number"}`))
+		return
+	}
+
+	revision, err := getWorkflowRevision(ctx, workflow.ID, revisionNumber)
+	if err != nil || revision.Workflow == nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Revision %d doesn't exist"}`, revisionNumber)))
+		return
+	}
+
+	// An optional message, e.g. why it's rolled back
+	message := fmt.Sprintf("Restored revision %d", revisionNumber)
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		var t struct {
+			Message string `json:"message"`
+		}
+
+		if json.Unmarshal(body, &t) == nil && len(t.Message) > 0 {
+			message = fmt.Sprintf("%s: %s", message, t.Message)
+		}
+	}
+
+	newWorkflow := *revision.Workflow
+	newWorkflow.ID = workflow.ID
+	newWorkflow.OrgId = workflow.OrgId
+	newWorkflow.Owner = workflow.Owner
+	newWorkflow.Schedules = workflow.Schedules
+	newWorkflow.Published = workflow.Published
+	newWorkflow.PublishedRevisions = workflow.PublishedRevisions
+	newWorkflow, err = setWorkflowRevision(ctx, user, newWorkflow, message)
+	if err != nil {
+		log.Printf("Failed restoring revision %d of %s: %s", revisionNumber, workflow.ID, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving workflow"}`))
+		return
+	}
+
+	newWorkflow.RevisionMessage = message
+	go syncGitWorkflow(user, newWorkflow)
+
+	addAuditLog(ctx, request, user, "workflow.restore", "workflow", workflow.ID, workflow, newWorkflow)
+
+	log.Printf("%s restored revision %d of workflow %s", user.Username, revisionNumber, workflow.ID)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "revision": %d}`, newWorkflow.Revision)))
+}
+
+// Sources that run the published version instead of the draft
+var publishedSources = []string{"webhook", "schedule", "outlook", "email", "subflow"}
+
+// Pinned triggers can only use revisions that have been published
+func checkPublishedRevision(workflow Workflow, revision int64) error {
+	if revision == 0 {
+		return nil
+	}
+
+	if arrayContainsInt64(workflow.PublishedRevisions, revision) {
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("Revision %d of workflow %s isn't published", revision, workflow.ID))
+}
+
+// Same check as for schedules, for every workflow the hook runs
+func checkHookRevision(ctx context.Context, hook Hook) error {
+	if hook.Revision == 0 {
+		return nil
+	}
+
+	for _, workflowId := range hook.Workflows {
+		if len(workflowId) == 0 {
+			continue
+		}
+
+		workflow, err := getWorkflow(ctx, workflowId)
+		if err != nil || workflow.OrgId != hook.OrgId {
+			return errors.New(fmt.Sprintf("Workflow %s doesn't exist", workflowId))
+		}
+
+		err = checkPublishedRevision(*workflow, hook.Revision)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The version triggers run. Revision 0 means the latest published one.
+// Workflows that were never published run the draft, so old triggers keep working.
+func getPublishedWorkflow(ctx context.Context, workflow Workflow, revision int64) (*Workflow, error) {
+	err := checkPublishedRevision(workflow, revision)
+	if err != nil {
+		return &Workflow{}, err
+	}
+
+	if revision == 0 {
+		revision = workflow.Published
+	}
+
+	return getWorkflowAtRevision(ctx, workflow, revision)
+}
+
+// The workflow as it was saved in a revision, owned by the current workflow
+func getWorkflowAtRevision(ctx context.Context, workflow Workflow, revision int64) (*Workflow, error) {
+	if revision == 0 || revision == workflow.Revision {
+		return &workflow, nil
+	}
+
+	workflowRevision, err := getWorkflowRevision(ctx, workflow.ID, revision)
+	if err != nil || workflowRevision.Workflow == nil {
+		return &Workflow{}, errors.New(fmt.Sprintf("Failed getting revision %d of workflow %s", revision, workflow.ID))
+	}
+
+	revisionWorkflow := *workflowRevision.Workflow
+	revisionWorkflow.ID = workflow.ID
+	revisionWorkflow.OrgId = workflow.OrgId
+	revisionWorkflow.Owner = workflow.Owner
+	revisionWorkflow.Published = workflow.Published
+	revisionWorkflow.PublishedRevisions = workflow.PublishedRevisions
+	return &revisionWorkflow, nil
+}
+
+// Makes a revision the one triggers run. Defaults to the current draft
+func handlePublishWorkflow(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in publish workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, location)
+	if err != nil {
+		log.Printf("Failed getting workflow to publish: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var t struct {
+		Revision int64 `json:"revision"`
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &t)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+			return
+		}
+	}
+
+	// Only the publishing fields change, on what's stored when the
+	// transaction runs. A save in the meantime keeps its draft and revision
+	revision := t.Revision
+	oldPublished := int64(0)
+	reason := ""
+	key := datastore.NameKey("workflow", workflow.ID, nil)
+	_, err = dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		storedWorkflow := Workflow{}
+		if err := tx.Get(key, &storedWorkflow); err != nil {
+			return err
+		}
+
+		revision = t.Revision
+		if revision == 0 {
+			if !storedWorkflow.IsValid || len(storedWorkflow.Lint) > 0 {
+				reason = "The draft is not valid. Fix and save it before publishing."
+				return errors.New(reason)
+			}
+
+			revision = storedWorkflow.Revision
+		}
+
+		workflowRevision := WorkflowRevision{}
+		err := tx.Get(datastore.NameKey("workflow_revisions", getRevisionKey(workflow.ID, revision), nil), &workflowRevision)
+
+		// Workflows from before revisions have none to publish
+		if err == datastore.ErrNoSuchEntity && revision == storedWorkflow.Revision {
+			storedWorkflow.Revision += 1
+			revision = storedWorkflow.Revision
+			workflowRevision = getNewWorkflowRevision(user, storedWorkflow, "Published")
+			_, err = tx.Put(datastore.NameKey("workflow_revisions", getRevisionKey(workflow.ID, revision), nil), &workflowRevision)
+		}
+
+		if err != nil || revision <= 0 {
+			reason = fmt.Sprintf("Revision %d doesn't exist", revision)
+			return errors.New(reason)
+		}
+
+		oldPublished = storedWorkflow.Published
+		storedWorkflow.Published = revision
+		if !arrayContainsInt64(storedWorkflow.PublishedRevisions, revision) {
+			storedWorkflow.PublishedRevisions = append(storedWorkflow.PublishedRevisions, revision)
+		}
+
+		_, err = tx.Put(key, &storedWorkflow)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Failed publishing revision %d of %s: %s", revision, workflow.ID, err)
+		if len(reason) == 0 {
+			reason = "Failed saving workflow"
+		}
+
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, reason)))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "workflow.publish", "workflow", workflow.ID, map[string]int64{"published": oldPublished}, map[string]int64{"published": revision})
+
+	log.Printf("%s published revision %d of workflow %s", user.Username, revision, workflow.ID)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "published": %d}`, revision)))
+}
+
+func arrayContainsInt64(items []int64, value int64) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
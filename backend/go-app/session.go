@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Sessions are logged out after this, no matter what
+var sessionTimeout = int64(7 * 24 * 3600)
+
+// Sessions are logged out if they're not used for this long
+var sessionIdleTimeout = int64(3600)
+
+// One per login. Key = the session token
+type session struct {
+	Username  string `datastore:"Username,noindex" json:"username"`
+	Id        string `datastore:"Id" json:"user_id"`
+	Session   string `datastore:"session,noindex" json:"-"`
+	SessionId string `datastore:"session_id" json:"id"`
+	Created   int64  `datastore:"created,noindex" json:"created"`
+	LastUsed  int64  `datastore:"last_used,noindex" json:"last_used"`
+	Expires   int64  `datastore:"expires,noindex" json:"expires"`
+	UserAgent string `datastore:"user_agent,noindex" json:"user_agent"`
+	Ip        string `datastore:"ip,noindex" json:"ip"`
+	MfaSetup  bool   `datastore:"mfa_setup,noindex" json:"mfa_setup"`
+	Current   bool   `datastore:"-" json:"current"`
+}
+
+func getSession(ctx context.Context, thissession string) (*session, error) {
+	key := datastore.NameKey("sessions", thissession, nil)
+	curUser := &session{}
+	if err := dbclient.Get(ctx, key, curUser); err != nil {
+		return &session{}, err
+	}
+
+	return curUser, nil
+}
+
+func setSession(ctx context.Context, sessiondata session) error {
+	key := datastore.NameKey("sessions", sessiondata.Session, nil)
+	if _, err := dbclient.Put(ctx, key, &sessiondata); err != nil {
+		log.Printf("Error adding session: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func getUserSessions(ctx context.Context, userId string) ([]session, error) {
+	q := datastore.NewQuery("sessions").Filter("Id =", userId)
+	var sessions []session
+	_, err := dbclient.GetAll(ctx, q, &sessions)
+	if err != nil {
+		return []session{}, err
+	}
+
+	return sessions, nil
+}
+
+// Makes a new session for every login
+func createSession(ctx context.Context, user User, request *http.Request) (*session, error) {
+	timeNow := time.Now().Unix()
+	sessiondata := session{
+		Username:  user.Username,
+		Id:        user.Id,
+		Session:   uuid.NewV4().String(),
+		SessionId: uuid.NewV4().String(),
+		Created:   timeNow,
+		LastUsed:  timeNow,
+		Expires:   timeNow + sessionTimeout,
+		UserAgent: request.Header.Get("User-Agent"),
+		Ip:        request.RemoteAddr,
+	}
+
+	err := setSession(ctx, sessiondata)
+	if err != nil {
+		return &session{}, err
+	}
+
+	return &sessiondata, nil
+}
+
+// Checks the session timeouts and updates when it was last used
+func validateSession(ctx context.Context, sessiondata *session) error {
+	timeNow := time.Now().Unix()
+
+	// Old sessions without expiry are invalid as well
+	if sessiondata.Expires < timeNow || sessiondata.LastUsed+sessionIdleTimeout < timeNow {
+		err := DeleteKey(ctx, "sessions", sessiondata.Session)
+		if err != nil {
+			log.Printf("Failed deleting expired session for %s: %s", sessiondata.Username, err)
+		}
+
+		return errors.New("Session is expired")
+	}
+
+	// No need to write on every single request
+	if sessiondata.LastUsed < timeNow-60 {
+		sessiondata.LastUsed = timeNow
+		err := setSession(ctx, *sessiondata)
+		if err != nil {
+			log.Printf("Failed updating session for %s: %s", sessiondata.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// Removes all sessions for a user except the one with the token in except
+func deleteUserSessions(ctx context.Context, userId, except string) error {
+	sessions, err := getUserSessions(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range sessions {
+		if len(except) > 0 && item.Session == except {
+			continue
+		}
+
+		err = DeleteKey(ctx, "sessions", item.Session)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func handleGetSessions(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get sessions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	sessions, err := getUserSessions(ctx, user.Id)
+	if err != nil {
+		log.Printf("Failed getting sessions for %s: %s", user.Username, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	timeNow := time.Now().Unix()
+	newSessions := []session{}
+	for _, item := range sessions {
+		if item.Expires < timeNow || item.LastUsed+sessionIdleTimeout < timeNow {
+			continue
+		}
+
+		item.Current = item.Session == user.Session
+		newSessions = append(newSessions, item)
+	}
+
+	newjson, err := json.Marshal(newSessions)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking sessions"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Revokes one session, or all but the current one if no ID is given
+func handleRevokeSession(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in revoke session: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	var fileId string
+	if location[1] == "api" && len(location) > 5 {
+		fileId = location[5]
+	}
+
+	ctx := context.Background()
+	if len(fileId) == 0 {
+		err = deleteUserSessions(ctx, user.Id, user.Session)
+		if err != nil {
+			log.Printf("Failed revoking sessions for %s: %s", user.Username, err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed revoking sessions"}`))
+			return
+		}
+
+		addAuditLog(ctx, request, user, "session.revoke_all", "user", user.Id, nil, nil)
+
+		log.Printf("Revoked other sessions for %s", user.Username)
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	sessions, err := getUserSessions(ctx, user.Id)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	for _, item := range sessions {
+		if item.SessionId != fileId {
+			continue
+		}
+
+		err = DeleteKey(ctx, "sessions", item.Session)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed revoking session"}`))
+			return
+		}
+
+		addAuditLog(ctx, request, user, "session.revoke", "session", fileId, nil, nil)
+
+		log.Printf("Revoked session %s for %s", fileId, user.Username)
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	resp.WriteHeader(401)
+	resp.Write([]byte(`{"success": false, "reason": "Session not found"}`))
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// How deep subflows can call subflows. Stops workflows calling themselves forever
+var maxSubflowDepth = 5
+
+// An execution without a worker, as all its running nodes wait for other
+// executions. Kept apart from the execution, as results overwrite that
+type WaitingExecution struct {
+	ExecutionId  string   `json:"execution_id" datastore:"execution_id"`
+	Environments []string `json:"environments" datastore:"environments,noindex"`
+	Created      int64    `json:"created" datastore:"created"`
+}
+
+type ReleaseRequest struct {
+	ExecutionId   string `json:"execution_id"`
+	Authorization string `json:"authorization"`
+	Environment   string `json:"environment"`
+}
+
+type SubflowRequest struct {
+	ExecutionId   string `json:"execution_id"`
+	Authorization string `json:"authorization"`
+	ActionId      string `json:"action_id"`
+	WorkflowId    string `json:"workflow_id"`
+	Argument      string `json:"argument"`
+}
+
+func getSubflowDepth(ctx context.Context, workflowExecution WorkflowExecution) int {
+	depth := 0
+	for len(workflowExecution.ParentExecutionId) > 0 && depth <= maxSubflowDepth {
+		parentExecution, err := getWorkflowExecution(ctx, workflowExecution.ParentExecutionId)
+		if err != nil {
+			break
+		}
+
+		workflowExecution = *parentExecution
+		depth += 1
+	}
+
+	return depth
+}
+
+// Runs the workflow as a child of the execution's node
+func startSubflow(workflowExecution WorkflowExecution, workflow Workflow, actionId, argument string) (WorkflowExecution, string, error) {
+	executionBody, err := json.Marshal(ExecutionRequest{
+		ExecutionArgument:   argument,
+		ExecutionSource:     "subflow",
+		ParentExecutionId:   workflowExecution.ExecutionId,
+		ParentActionId:      actionId,
+		ParentAuthorization: workflowExecution.Authorization,
+		DryRun:              workflowExecution.DryRun,
+	})
+	if err != nil {
+		return WorkflowExecution{}, "Failed making subflow request", err
+	}
+
+	executionRequest, err := http.NewRequest("POST", fmt.Sprintf("/api/v1/workflows/%s/execute", workflow.ID), bytes.NewReader(executionBody))
+	if err != nil {
+		return WorkflowExecution{}, "Failed making subflow request", err
+	}
+
+	return handleExecution(workflow.ID, workflow, executionRequest)
+}
+
+// Called by the worker when it reaches a subflow node.
+// Starts the child workflow with the parent execution's authorization
+func handleRunSubflow(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for subflow")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var subflow SubflowRequest
+	err = json.Unmarshal(body, &subflow)
+	if err != nil {
+		log.Printf("Failed subflow unmarshaling: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflowExecution, err := getWorkflowExecution(ctx, subflow.ExecutionId)
+	if err != nil || workflowExecution.Authorization != subflow.Authorization {
+		log.Printf("Bad authorization key when starting subflow from %s", subflow.ExecutionId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad authorization key or execution_id might not exist."}`))
+		return
+	}
+
+	if workflowExecution.Status != "EXECUTING" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution has status %s"}`, workflowExecution.Status)))
+		return
+	}
+
+	workflow, err := getWorkflow(ctx, subflow.WorkflowId)
+	if err != nil || workflow.OrgId != workflowExecution.Workflow.OrgId {
+		log.Printf("Failed getting subflow workflow %s: %s", subflow.WorkflowId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Workflow %s doesn't exist"}`, subflow.WorkflowId)))
+		return
+	}
+
+	depth := getSubflowDepth(ctx, *workflowExecution)
+	if depth >= maxSubflowDepth {
+		log.Printf("Stopped subflow of %s from %s at depth %d", workflow.ID, workflowExecution.ExecutionId, depth)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Subflows can only be %d levels deep"}`, maxSubflowDepth)))
+		return
+	}
+
+	childExecution, executionResp, err := startSubflow(*workflowExecution, *workflow, subflow.ActionId, subflow.Argument)
+	if err != nil {
+		log.Printf("Failed starting subflow %s from %s: %s", workflow.ID, workflowExecution.ExecutionId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, executionResp)))
+		return
+	}
+
+	log.Printf("[INFO] Started subflow %s (%s) from execution %s", childExecution.ExecutionId, workflow.ID, workflowExecution.ExecutionId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "execution_id": "%s", "workflow_id": "%s"}`, childExecution.ExecutionId, workflow.ID)))
+}
+
+// Gives the parent's subflow node the result of the child when it's done.
+// Only if the node is still waiting for it
+func setSubflowResult(workflowExecution WorkflowExecution) error {
+	if len(workflowExecution.ParentExecutionId) == 0 || len(workflowExecution.ParentActionId) == 0 {
+		return nil
+	}
+
+	// Paused children aren't done either
+	if workflowExecution.Status == "EXECUTING" || workflowExecution.Status == "PAUSED" {
+		return nil
+	}
+
+	// For-each nodes collect every item before they're done
+	ctx := context.Background()
+	_, err := getForeachState(ctx, workflowExecution.ParentExecutionId, workflowExecution.ParentActionId)
+	if err == nil {
+		return setForeachResult(ctx, workflowExecution)
+	}
+
+	subflowResult, err := json.Marshal(map[string]interface{}{
+		"success":      workflowExecution.Status == "FINISHED",
+		"execution_id": workflowExecution.ExecutionId,
+		"workflow_id":  workflowExecution.Workflow.ID,
+		"status":       workflowExecution.Status,
+		"result":       workflowExecution.Result,
+	})
+	if err != nil {
+		return err
+	}
+
+	status := "SUCCESS"
+	if workflowExecution.Status != "FINISHED" {
+		status = "FAILURE"
+	}
+
+	return setParentResult(ctx, workflowExecution.ParentExecutionId, workflowExecution.ParentActionId, string(subflowResult), status)
+}
+
+// Finishes a node that's waiting for other executions
+func setParentResult(ctx context.Context, executionId, actionId, result, status string) error {
+	parentExecution, err := getWorkflowExecution(ctx, executionId)
+	if err != nil {
+		return err
+	}
+
+	actionResult := ActionResult{}
+	for _, parentResult := range parentExecution.Results {
+		if parentResult.Action.ID == actionId {
+			actionResult = parentResult
+			break
+		}
+	}
+
+	if actionResult.Action.ID != actionId || actionResult.Status != "EXECUTING" {
+		return nil
+	}
+
+	actionResult.ExecutionId = parentExecution.ExecutionId
+	actionResult.Authorization = parentExecution.Authorization
+	actionResult.Result = result
+	actionResult.CompletedAt = int64(time.Now().Unix())
+	actionResult.Status = status
+
+	err = setExecutionResult(actionResult)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Set result of %s in execution %s to %s", actionId, parentExecution.ExecutionId, actionResult.Status)
+	return requeueWaitingExecution(ctx, parentExecution.ExecutionId)
+}
+
+// Goes through the same path as results from apps
+func setExecutionResult(actionResult ActionResult) error {
+	data, err := json.Marshal(actionResult)
+	if err != nil {
+		return err
+	}
+
+	streamUrl := fmt.Sprintf("%s/api/v1/streams", localBase)
+	req, err := http.NewRequest("POST", streamUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	newresp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer newresp.Body.Close()
+	if newresp.StatusCode != 200 {
+		respBody, _ := ioutil.ReadAll(newresp.Body)
+		return errors.New(fmt.Sprintf("Bad status %d setting result of %s: %s", newresp.StatusCode, actionResult.Action.ID, string(respBody)))
+	}
+
+	return nil
+}
+
+// Nodes the worker starts and the backend finishes
+func isWaitingAction(action Action) bool {
+	return arrayContainsString(builtinApps, action.AppID) && (action.Name == "run_subflow" || action.Name == "run_foreach" || action.Name == "approval")
+}
+
+// Called by a worker that only has nodes waiting for other executions left.
+// It can exit if nothing finished since it last looked, as the results are
+// checked in the same transaction as the release
+func handleReleaseExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Failed reading body for release")
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var release ReleaseRequest
+	err = json.Unmarshal(body, &release)
+	if err != nil {
+		log.Printf("Failed release unmarshaling: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	ctx := context.Background()
+	executionKey := datastore.NameKey("workflowexecution", strings.ToLower(release.ExecutionId), nil)
+	waitingKey := datastore.NameKey("waiting_executions", strings.ToLower(release.ExecutionId), nil)
+	_, err = dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		workflowExecution := WorkflowExecution{}
+		if err := tx.Get(executionKey, &workflowExecution); err != nil {
+			return err
+		}
+
+		if workflowExecution.Authorization != release.Authorization {
+			return errors.New("Bad authorization key")
+		}
+
+		if workflowExecution.Status != "EXECUTING" {
+			return errors.New(fmt.Sprintf("Execution has status %s", workflowExecution.Status))
+		}
+
+		waiting := false
+		for _, result := range workflowExecution.Results {
+			if result.Status != "EXECUTING" {
+				continue
+			}
+
+			if !isWaitingAction(result.Action) {
+				return errors.New(fmt.Sprintf("%s is still running", result.Action.Label))
+			}
+
+			waiting = true
+		}
+
+		if !waiting {
+			return errors.New("No nodes are waiting")
+		}
+
+		waitingExecution := WaitingExecution{}
+		err := tx.Get(waitingKey, &waitingExecution)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		waitingExecution.ExecutionId = workflowExecution.ExecutionId
+		if !arrayContainsString(waitingExecution.Environments, release.Environment) {
+			waitingExecution.Environments = append(waitingExecution.Environments, release.Environment)
+		}
+
+		waitingExecution.Created = int64(time.Now().Unix())
+		_, err = tx.Put(waitingKey, &waitingExecution)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Didn't release worker of %s: %s", release.ExecutionId, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	log.Printf("[INFO] Released worker of %s in environment %s while it waits", release.ExecutionId, release.Environment)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Queues a released execution again when one of its nodes is done. The
+// new worker continues from the results
+func requeueWaitingExecution(ctx context.Context, executionId string) error {
+	waitingKey := datastore.NameKey("waiting_executions", strings.ToLower(executionId), nil)
+	waitingExecution := WaitingExecution{}
+	_, err := dbclient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(waitingKey, &waitingExecution); err != nil {
+			return err
+		}
+
+		return tx.Delete(waitingKey)
+	})
+
+	// The worker is still running
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	workflowExecution, err := getWorkflowExecution(ctx, executionId)
+	if err != nil {
+		return err
+	}
+
+	// Paused executions are queued when they're resumed
+	if workflowExecution.Status != "EXECUTING" {
+		return nil
+	}
+
+	queueExecution(ctx, *workflowExecution, waitingExecution.Environments)
+	log.Printf("[INFO] Queued %s again after its waiting node finished", executionId)
+	return nil
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Apps that are part of Shuffle itself and not stored as workflow apps
+var builtinApps = []string{
+	"0ca8887e-b4af-4e3e-887c-87e9d3bc3d3e",
+}
+
+// Required parameters of the nodes the worker runs itself
+var builtinParameters = map[string][]string{
+	"run_subflow":   []string{"workflow_id"},
+	"run_foreach":   []string{"list"},
+	"filter_list":   []string{"list", "condition"},
+	"transform":     []string{"input"},
+	"regex_extract": []string{"input", "regex"},
+	"parse_json":    []string{"input"},
+	"format_json":   []string{"input"},
+	"set_variable":  []string{"name"},
+	"approval":      []string{"message"},
+}
+
+// Checks the worker can evaluate in branch conditions
+var conditionChecks = []string{
+	"=", "equals", "!=", "does not equal", "startswith", "endswith", "contains",
+	"re", "matches regex", ">", "larger than", "<", "smaller than", "less than",
+	">=", "<=", "is empty",
+}
+
+// $node.field. Names start with a letter and have no spaces, so text like
+// "$5.00" or "Pay $10 or more. Thanks" isn't a reference
+var referencePattern = regexp.MustCompile(`\$([a-zA-Z][a-zA-Z0-9_-]*)\.([a-zA-Z0-9#_-]+)`)
+
+// Labels and variables are referenced with spaces as underscores, in lowercase
+func getReferenceName(name string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(name), " ", "_", -1))
+}
+
+type workflowValidator struct {
+	workflow     Workflow
+	apps         []WorkflowApp
+	auths        []AppAuthenticationStorage
+	errors       []string
+	lint         []string
+	actionErrors map[string][]string
+	labels       map[string]string
+	children     map[string][]string
+	parents      map[string][]string
+}
+
+func (validator *workflowValidator) addError(message string) {
+	validator.errors = append(validator.errors, message)
+}
+
+// Problems with single nodes are lint. The workflow can still run
+func (validator *workflowValidator) addActionError(action Action, message string) {
+	validator.actionErrors[action.ID] = append(validator.actionErrors[action.ID], message)
+	validator.lint = append(validator.lint, fmt.Sprintf("%s: %s", action.Label, message))
+}
+
+func (validator *workflowValidator) getLabel(id string) string {
+	if label, ok := validator.labels[id]; ok && len(label) > 0 {
+		return label
+	}
+
+	return id
+}
+
+// Nodes, branches and the start node
+func (validator *workflowValidator) checkStructure() {
+	workflow := validator.workflow
+	if len(workflow.Actions) == 0 {
+		validator.addError("The workflow has no actions")
+	}
+
+	usedLabels := map[string]string{}
+	for _, action := range workflow.Actions {
+		if _, ok := validator.labels[action.ID]; ok {
+			validator.addActionError(action, fmt.Sprintf("Node ID %s is used more than once", action.ID))
+		}
+
+		validator.labels[action.ID] = action.Label
+		referenceName := getReferenceName(action.Label)
+		if otherId, ok := usedLabels[referenceName]; ok && otherId != action.ID {
+			validator.addActionError(action, fmt.Sprintf("Label is the same as another node. $%s references can't tell them apart", referenceName))
+		}
+
+		usedLabels[referenceName] = action.ID
+	}
+
+	for _, trigger := range workflow.Triggers {
+		if _, ok := validator.labels[trigger.ID]; ok {
+			validator.addError(fmt.Sprintf("Trigger %s: Node ID %s is used more than once", trigger.Label, trigger.ID))
+		}
+
+		validator.labels[trigger.ID] = trigger.Label
+	}
+
+	if status := workflow.Configuration.ErrorStatus; len(status) > 0 && status != "FINISHED" && status != "FAILURE" {
+		validator.addError(fmt.Sprintf("Error status has to be FINISHED or FAILURE, not %s", status))
+	}
+
+	if workflow.Configuration.MaxConcurrency < 0 {
+		validator.addError("Max concurrency can't be negative")
+	}
+
+	if len(workflow.Start) == 0 {
+		validator.addError("The workflow has no start node")
+	} else if _, ok := validator.labels[workflow.Start]; !ok {
+		validator.addError(fmt.Sprintf("Start node %s doesn't exist", workflow.Start))
+	}
+
+	for _, branch := range workflow.Branches {
+		_, sourceFound := validator.labels[branch.SourceID]
+		_, destinationFound := validator.labels[branch.DestinationID]
+		if !sourceFound {
+			validator.addError(fmt.Sprintf("Branch %s comes from node %s, which doesn't exist", branch.ID, branch.SourceID))
+		}
+
+		if !destinationFound {
+			validator.addError(fmt.Sprintf("Branch %s goes to node %s, which doesn't exist", branch.ID, branch.DestinationID))
+		}
+
+		if !sourceFound || !destinationFound {
+			continue
+		}
+
+		for _, condition := range branch.Conditions {
+			if !arrayContainsString(conditionChecks, strings.ToLower(strings.TrimSpace(condition.Condition.Value))) {
+				validator.addError(fmt.Sprintf("Branch %s has an unknown condition '%s'", branch.ID, condition.Condition.Value))
+			}
+		}
+
+		if branch.SourceID == branch.DestinationID {
+			validator.addError(fmt.Sprintf("Branch %s goes from %s to itself", branch.ID, validator.getLabel(branch.SourceID)))
+			continue
+		}
+
+		validator.children[branch.SourceID] = append(validator.children[branch.SourceID], branch.DestinationID)
+		validator.parents[branch.DestinationID] = append(validator.parents[branch.DestinationID], branch.SourceID)
+	}
+}
+
+// Join modes only count parents that are actions
+func (validator *workflowValidator) checkJoins() {
+	actionIds := map[string]bool{}
+	for _, action := range validator.workflow.Actions {
+		actionIds[action.ID] = true
+	}
+
+	for _, action := range validator.workflow.Actions {
+		if !arrayContainsString(joinModes, action.JoinMode) {
+			validator.addActionError(action, fmt.Sprintf("Unknown join mode '%s'", action.JoinMode))
+			continue
+		}
+
+		if action.JoinMode != "count" {
+			continue
+		}
+
+		parents := 0
+		for _, parent := range validator.parents[action.ID] {
+			if actionIds[parent] {
+				parents += 1
+			}
+		}
+
+		if action.JoinCount < 1 || action.JoinCount > parents {
+			validator.addActionError(action, fmt.Sprintf("Join count has to be between 1 and the %d parent nodes", parents))
+		}
+	}
+}
+
+// Everything has to be reachable from the start node or a trigger
+func (validator *workflowValidator) checkReachable() {
+	visited := map[string]bool{}
+	queue := []string{}
+	if len(validator.workflow.Start) > 0 {
+		queue = append(queue, validator.workflow.Start)
+	}
+
+	for _, trigger := range validator.workflow.Triggers {
+		queue = append(queue, trigger.ID)
+	}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+
+		visited[current] = true
+		queue = append(queue, validator.children[current]...)
+	}
+
+	for _, action := range validator.workflow.Actions {
+		if !visited[action.ID] {
+			validator.addActionError(action, "Can't be reached from the start node or a trigger")
+		}
+	}
+}
+
+// Reports every cycle once, with the nodes in it
+func (validator *workflowValidator) checkCycles() {
+	// 0 = not visited, 1 = in the current path, 2 = done
+	state := map[string]int{}
+	path := []string{}
+
+	var visit func(node string)
+	visit = func(node string) {
+		state[node] = 1
+		path = append(path, node)
+		for _, child := range validator.children[node] {
+			if state[child] == 1 {
+				cycle := []string{}
+				for index := len(path) - 1; index >= 0; index-- {
+					cycle = append([]string{validator.getLabel(path[index])}, cycle...)
+					if path[index] == child {
+						break
+					}
+				}
+
+				cycle = append(cycle, validator.getLabel(child))
+				validator.addError(fmt.Sprintf("Cycle: %s", strings.Join(cycle, " -> ")))
+			} else if state[child] == 0 {
+				visit(child)
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[node] = 2
+	}
+
+	for _, action := range validator.workflow.Actions {
+		if state[action.ID] == 0 {
+			visit(action.ID)
+		}
+	}
+}
+
+// The app, action and required parameters have to exist
+func (validator *workflowValidator) checkApps() {
+	for _, action := range validator.workflow.Actions {
+		if len(action.Environment) == 0 {
+			validator.addActionError(action, "An environment is required")
+		}
+
+		if len(action.AuthenticationId) > 0 {
+			authFound := false
+			for _, auth := range validator.auths {
+				if auth.Id == action.AuthenticationId {
+					authFound = true
+					break
+				}
+			}
+
+			if !authFound {
+				validator.addActionError(action, fmt.Sprintf("App auth %s doesn't exist", action.AuthenticationId))
+			}
+		}
+
+		if arrayContainsString(builtinApps, action.AppID) {
+			for _, name := range builtinParameters[action.Name] {
+				value := ""
+				for _, param := range action.Parameters {
+					if param.Name == name {
+						value = param.Value
+						break
+					}
+				}
+
+				if len(value) == 0 {
+					validator.addActionError(action, fmt.Sprintf("Required parameter %s is missing", name))
+				}
+			}
+
+			continue
+		}
+
+		curapp := WorkflowApp{}
+		for _, app := range validator.apps {
+			if app.ID == action.AppID || (app.Name == action.AppName && app.AppVersion == action.AppVersion) {
+				curapp = app
+				break
+			}
+		}
+
+		if len(curapp.Name) == 0 {
+			validator.addActionError(action, fmt.Sprintf("App %s version %s doesn't exist", action.AppName, action.AppVersion))
+			continue
+		}
+
+		curappaction := WorkflowAppAction{}
+		for _, appAction := range curapp.Actions {
+			if appAction.Name == action.Name {
+				curappaction = appAction
+				break
+			}
+		}
+
+		if len(curappaction.Name) == 0 {
+			validator.addActionError(action, fmt.Sprintf("Action %s doesn't exist in %s %s", action.Name, action.AppName, action.AppVersion))
+			continue
+		}
+
+		for _, param := range curappaction.Parameters {
+			if !param.Required {
+				continue
+			}
+
+			// Filled in from the auth when running
+			if param.Configuration && len(action.AuthenticationId) > 0 {
+				continue
+			}
+
+			found := false
+			for _, actionParam := range action.Parameters {
+				if actionParam.Name != param.Name {
+					continue
+				}
+
+				found = true
+				if len(actionParam.Value) == 0 && (actionParam.Variant == "" || actionParam.Variant == "STATIC_VALUE") {
+					validator.addActionError(action, fmt.Sprintf("Required parameter %s is empty", param.Name))
+				}
+
+				break
+			}
+
+			if !found {
+				validator.addActionError(action, fmt.Sprintf("Required parameter %s is missing", param.Name))
+			}
+		}
+	}
+}
+
+// Every node that runs before the given one
+func (validator *workflowValidator) getAncestors(node string) map[string]bool {
+	ancestors := map[string]bool{}
+	queue := append([]string{}, validator.parents[node]...)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if ancestors[current] {
+			continue
+		}
+
+		ancestors[current] = true
+		queue = append(queue, validator.parents[current]...)
+	}
+
+	return ancestors
+}
+
+// $node.field has to be a node that runs before, a variable or $exec
+func (validator *workflowValidator) checkReferences() {
+	workflow := validator.workflow
+	variables := []string{"exec"}
+	for _, variable := range workflow.WorkflowVariables {
+		variables = append(variables, getReferenceName(variable.Name))
+	}
+
+	for _, variable := range workflow.ExecutionVariables {
+		variables = append(variables, getReferenceName(variable.Name))
+	}
+
+	nodes := map[string]string{}
+	for _, action := range workflow.Actions {
+		nodes[getReferenceName(action.Label)] = action.ID
+	}
+
+	// $error is the failure that started the node
+	errorNodes := map[string]bool{}
+	for _, branch := range workflow.Branches {
+		if branch.HasError {
+			errorNodes[branch.DestinationID] = true
+		}
+	}
+
+	for _, action := range workflow.Actions {
+		ancestors := validator.getAncestors(action.ID)
+		for _, param := range action.Parameters {
+			if param.Variant != "" && param.Variant != "STATIC_VALUE" {
+				continue
+			}
+
+			for _, match := range referencePattern.FindAllStringSubmatch(param.Value, -1) {
+				name := getReferenceName(match[1])
+				if arrayContainsString(variables, name) {
+					continue
+				}
+
+				if name == "error" {
+					if !errorNodes[action.ID] {
+						validator.addActionError(action, fmt.Sprintf("Parameter %s references $error, but no error branch goes to this node", param.Name))
+					}
+
+					continue
+				}
+
+				nodeId, ok := nodes[name]
+				if !ok {
+					validator.addActionError(action, fmt.Sprintf("Parameter %s references $%s, which isn't a node or variable", param.Name, name))
+				} else if !ancestors[nodeId] {
+					validator.addActionError(action, fmt.Sprintf("Parameter %s references $%s, which doesn't run before this node", param.Name, name))
+				}
+			}
+		}
+	}
+}
+
+// Checks the workflow without running it. Structural errors go in Errors and
+// decide IsValid. Node problems go in Lint and on every action.
+func validateWorkflow(workflow Workflow, apps []WorkflowApp, auths []AppAuthenticationStorage) Workflow {
+	validator := &workflowValidator{
+		workflow:     workflow,
+		apps:         apps,
+		auths:        auths,
+		errors:       []string{},
+		actionErrors: map[string][]string{},
+		labels:       map[string]string{},
+		children:     map[string][]string{},
+		parents:      map[string][]string{},
+	}
+
+	validator.checkStructure()
+	validator.checkJoins()
+	validator.checkReachable()
+	validator.checkCycles()
+	validator.checkApps()
+	validator.checkReferences()
+
+	newActions := []Action{}
+	for _, action := range workflow.Actions {
+		action.Errors = validator.actionErrors[action.ID]
+		if action.Errors == nil {
+			action.Errors = []string{}
+		}
+
+		newActions = append(newActions, action)
+	}
+
+	workflow.Actions = newActions
+	workflow.Errors = validator.errors
+	workflow.Lint = validator.lint
+	workflow.IsValid = len(validator.errors) == 0
+	return workflow
+}
+
+// Validates and returns the workflow with the errors filled in
+func getValidatedWorkflow(ctx context.Context, workflow Workflow, orgId string) (Workflow, error) {
+	apps, err := getAllWorkflowApps(ctx)
+	if err != nil {
+		return workflow, err
+	}
+
+	auths, err := getAllWorkflowAppAuth(ctx, orgId)
+	if err != nil {
+		return workflow, err
+	}
+
+	return validateWorkflow(workflow, apps, auths), nil
+}
+
+// POST /api/v1/workflows/validate with a workflow, or
+// GET /api/v1/workflows/{id}/validate for a stored one.
+// 200 if it's valid, 400 with the errors if not
+func handleValidateWorkflow(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in validate workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	var workflow Workflow
+	if request.Method == "POST" {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+			return
+		}
+
+		err = json.Unmarshal(body, &workflow)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed parsing workflow: %s"}`, strings.Replace(err.Error(), `"`, `'`, -1))))
+			return
+		}
+	} else {
+		storedWorkflow, err := getRevisionWorkflow(ctx, user, strings.Split(request.URL.Path, "/"))
+		if err != nil {
+			log.Printf("Failed getting workflow to validate: %s", err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		workflow = *storedWorkflow
+	}
+
+	workflow, err = getValidatedWorkflow(ctx, workflow, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("Failed validating workflow: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting apps"}`))
+		return
+	}
+
+	type actionErrors struct {
+		Id     string   `json:"id"`
+		Label  string   `json:"label"`
+		Errors []string `json:"errors"`
+	}
+
+	actions := []actionErrors{}
+	for _, action := range workflow.Actions {
+		if len(action.Errors) > 0 {
+			actions = append(actions, actionErrors{
+				Id:     action.ID,
+				Label:  action.Label,
+				Errors: action.Errors,
+			})
+		}
+	}
+
+	result := struct {
+		Success bool           `json:"success"`
+		IsValid bool           `json:"is_valid"`
+		Errors  []string       `json:"errors"`
+		Lint    []string       `json:"lint"`
+		Actions []actionErrors `json:"actions"`
+	}{
+		Success: workflow.IsValid && len(workflow.Lint) == 0,
+		IsValid: workflow.IsValid,
+		Errors:  workflow.Errors,
+		Lint:    workflow.Lint,
+		Actions: actions,
+	}
+
+	newjson, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking errors"}`))
+		return
+	}
+
+	if result.Success {
+		resp.WriteHeader(200)
+	} else {
+		resp.WriteHeader(400)
+	}
+
+	resp.Write(newjson)
+}
@@ -64,13 +64,36 @@ type ExecutionRequest struct {
 	Status            string   `json:"status"`
 	Start             string   `json:"start"`
 	Type              string   `json:"type"`
+	Revision          int64    `json:"revision"`
+
+	// Set when started by a subflow or for-each node in another execution
+	ParentExecutionId   string `json:"parent_execution_id"`
+	ParentActionId      string `json:"parent_action_id"`
+	ParentAuthorization string `json:"parent_authorization"`
+	ForeachIndex        int    `json:"foreach_index"`
+
+	// Set when rerunning or replaying an older execution of the same workflow
+	RerunOf  string `json:"rerun_of"`
+	ReplayOf string `json:"replay_of"`
+
+	// Runs without any apps. They return their mock or example instead
+	DryRun bool         `json:"dry_run"`
+	Mocks  []ActionMock `json:"mocks"`
+
+	// Higher priorities leave the queue first. The concurrency is the
+	// workflow's, so the queue doesn't have to look it up
+	Priority            int `json:"priority"`
+	WorkflowConcurrency int `json:"workflow_concurrency"`
 }
 
 type Org struct {
-	Name  string `json:"name"`
-	Org   string `json:"org"`
-	Users []User `json:"users"`
-	Id    string `json:"id"`
+	Name         string `json:"name"`
+	Org          string `json:"org"`
+	Users        []User `json:"users"`
+	Id           string `json:"id"`
+	Description  string `json:"description" datastore:"description,noindex"`
+	CreationTime int64  `json:"creation_time" datastore:"creation_time"`
+	MfaRequired  string `json:"mfa_required" datastore:"mfa_required"`
 }
 
 type AppAuthenticationStorage struct {
@@ -82,6 +105,7 @@ type AppAuthenticationStorage struct {
 	Usage         []AuthenticationUsage `json:"usage" datastore:"usage"`
 	WorkflowCount int64                 `json:"workflow_count" datastore:"workflow_count"`
 	NodeCount     int64                 `json:"node_count" datastore:"node_count"`
+	OrgId         string                `json:"org_id" datastore:"org_id"`
 }
 
 type AuthenticationUsage struct {
@@ -191,6 +215,18 @@ type WorkflowExecution struct {
 	Locations          []string       `json:"locations" datastore:"locations"`
 	Workflow           Workflow       `json:"workflow" datastore:"workflow,noindex"`
 	Results            []ActionResult `json:"results" datastore:"results,noindex"`
+	OrgId              string         `json:"org_id" datastore:"org_id"`
+	WorkflowRevision   int64          `json:"workflow_revision" datastore:"workflow_revision"`
+	ParentExecutionId  string         `json:"parent_execution_id,omitempty" datastore:"parent_execution_id"`
+	ParentActionId     string         `json:"parent_action_id,omitempty" datastore:"parent_action_id"`
+	ForeachIndex       int            `json:"foreach_index,omitempty" datastore:"foreach_index,noindex"`
+	RerunOf            string         `json:"rerun_of,omitempty" datastore:"rerun_of"`
+	ReplayOf           string         `json:"replay_of,omitempty" datastore:"replay_of"`
+	DryRun             bool           `json:"dry_run" datastore:"dry_run"`
+	Mocks              []ActionMock   `json:"mocks,omitempty" datastore:"mocks,noindex"`
+	Priority           int            `json:"priority" datastore:"priority"`
+	Environments       []string       `json:"environments,omitempty" datastore:"environments"`
+	LastActivity       int64          `json:"last_activity,omitempty" datastore:"last_activity"`
 	ExecutionVariables []struct {
 		Description string `json:"description" datastore:"description,noindex"`
 		ID          string `json:"id" datastore:"id"`
@@ -227,6 +263,9 @@ type Action struct {
 		Y float64 `json:"y" datastore:"y"`
 	} `json:"position"`
 	Priority         int    `json:"priority" datastore:"priority"`
+	JoinMode         string `json:"join_mode" datastore:"join_mode"`
+	JoinCount        int    `json:"join_count" datastore:"join_count"`
+	Timeout          int    `json:"timeout" datastore:"timeout"`
 	AuthenticationId string `json:"authentication_id" datastore:"authentication_id"`
 	Example          string `json:"example" datastore:"example"`
 	AuthNotRequired  bool   `json:"auth_not_required" datastore:"auth_not_required" yaml:"auth_not_required"`
@@ -268,10 +307,20 @@ type Branch struct {
 }
 
 // Same format for a lot of stuff
+// Conditions in the same group all have to pass. Any passing group is enough
 type Condition struct {
 	Condition   WorkflowAppActionParameter `json:"condition" datastore:"condition"`
 	Source      WorkflowAppActionParameter `json:"source" datastore:"source"`
 	Destination WorkflowAppActionParameter `json:"destination" datastore:"destination"`
+	Group       int                        `json:"group" datastore:"group"`
+}
+
+// What the worker decided for a branch into a node
+type BranchDecision struct {
+	BranchId string `json:"branch_id" datastore:"branch_id"`
+	SourceId string `json:"source_id" datastore:"source_id"`
+	Active   bool   `json:"active" datastore:"active"`
+	Reason   string `json:"reason" datastore:"reason,noindex"`
 }
 
 type Schedule struct {
@@ -279,6 +328,7 @@ type Schedule struct {
 	Frequency         string `json:"frequency" datastore:"frequency"`
 	ExecutionArgument string `json:"execution_argument" datastore:"execution_argument,noindex"`
 	Id                string `json:"id" datastore:"id"`
+	Revision          int64  `json:"revision" datastore:"revision"`
 }
 
 type Workflow struct {
@@ -287,21 +337,29 @@ type Workflow struct {
 	Triggers      []Trigger  `json:"triggers" datastore:"triggers,noindex"`
 	Schedules     []Schedule `json:"schedules" datastore:"schedules,noindex"`
 	Configuration struct {
-		ExitOnError  bool `json:"exit_on_error" datastore:"exit_on_error"`
-		StartFromTop bool `json:"start_from_top" datastore:"start_from_top"`
+		ExitOnError    bool   `json:"exit_on_error" datastore:"exit_on_error"`
+		StartFromTop   bool   `json:"start_from_top" datastore:"start_from_top"`
+		ErrorStatus    string `json:"error_status" datastore:"error_status"`
+		MaxConcurrency int    `json:"max_concurrency" datastore:"max_concurrency"`
 	} `json:"configuration,omitempty" datastore:"configuration"`
-	Errors            []string `json:"errors,omitempty" datastore:"errors"`
-	Tags              []string `json:"tags,omitempty" datastore:"tags"`
-	ID                string   `json:"id" datastore:"id"`
-	IsValid           bool     `json:"is_valid" datastore:"is_valid"`
-	Name              string   `json:"name" datastore:"name"`
-	Description       string   `json:"description" datastore:"description,noindex"`
-	Start             string   `json:"start" datastore:"start"`
-	Owner             string   `json:"owner" datastore:"owner"`
-	Sharing           string   `json:"sharing" datastore:"sharing"`
-	Org               []Org    `json:"org,omitempty" datastore:"org"`
-	ExecutingOrg      Org      `json:"execution_org,omitempty" datastore:"execution_org"`
-	WorkflowVariables []struct {
+	Errors             []string `json:"errors,omitempty" datastore:"errors"`
+	Lint               []string `json:"lint,omitempty" datastore:"lint,noindex"`
+	Tags               []string `json:"tags,omitempty" datastore:"tags"`
+	ID                 string   `json:"id" datastore:"id"`
+	IsValid            bool     `json:"is_valid" datastore:"is_valid"`
+	Name               string   `json:"name" datastore:"name"`
+	Description        string   `json:"description" datastore:"description,noindex"`
+	Start              string   `json:"start" datastore:"start"`
+	Owner              string   `json:"owner" datastore:"owner"`
+	Sharing            string   `json:"sharing" datastore:"sharing"`
+	Org                []Org    `json:"org,omitempty" datastore:"org"`
+	ExecutingOrg       Org      `json:"execution_org,omitempty" datastore:"execution_org"`
+	OrgId              string   `json:"org_id" datastore:"org_id"`
+	Revision           int64    `json:"revision" datastore:"revision"`
+	RevisionMessage    string   `json:"revision_message,omitempty" datastore:"-"`
+	Published          int64    `json:"published" datastore:"published"`
+	PublishedRevisions []int64  `json:"published_revisions" datastore:"published_revisions,noindex"`
+	WorkflowVariables  []struct {
 		Description string `json:"description" datastore:"description,noindex"`
 		ID          string `json:"id" datastore:"id"`
 		Name        string `json:"name" datastore:"name"`
@@ -323,6 +381,8 @@ type ActionResult struct {
 	StartedAt     int64  `json:"started_at" datastore:"started_at"`
 	CompletedAt   int64  `json:"completed_at" datastore:"completed_at"`
 	Status        string `json:"status" datastore:"status"`
+
+	Decisions []BranchDecision `json:"decisions,omitempty" datastore:"decisions,noindex"`
 }
 
 type Authentication struct {
@@ -420,6 +480,71 @@ func setWorkflowQueue(ctx context.Context, executionRequests ExecutionRequestWra
 	return nil
 }
 
+// Queues are per org + environment
+func queueExecution(ctx context.Context, workflowExecution WorkflowExecution, environments []string) {
+	for _, environment := range environments {
+		queueId := getQueueId(workflowExecution.Workflow.OrgId, environment)
+		log.Printf("[INFO] Execution: %s should execute onprem with execution environment \"%s\"", workflowExecution.ExecutionId, environment)
+
+		executionRequest := ExecutionRequest{
+			ExecutionId:         workflowExecution.ExecutionId,
+			WorkflowId:          workflowExecution.Workflow.ID,
+			Authorization:       workflowExecution.Authorization,
+			Environments:        environments,
+			Priority:            workflowExecution.Priority,
+			WorkflowConcurrency: workflowExecution.Workflow.Configuration.MaxConcurrency,
+		}
+
+		executionRequestWrapper, err := getWorkflowQueue(ctx, queueId)
+		if err != nil {
+			executionRequestWrapper = ExecutionRequestWrapper{
+				Data: []ExecutionRequest{executionRequest},
+			}
+		} else {
+			executionRequestWrapper.Data = append(executionRequestWrapper.Data, executionRequest)
+		}
+
+		//log.Printf("Execution request: %#v", executionRequest)
+		err = setWorkflowQueue(ctx, executionRequestWrapper, queueId)
+		if err != nil {
+			log.Printf("Failed adding to db: %s", err)
+		}
+	}
+}
+
+// Tells the Orborus running the execution to remove its worker and apps.
+// Requests that haven't started yet are dropped instead
+func queueAbort(ctx context.Context, workflowExecution WorkflowExecution, environments []string) {
+	for _, environment := range environments {
+		queueId := getQueueId(workflowExecution.Workflow.OrgId, environment)
+		executionRequestWrapper, err := getWorkflowQueue(ctx, queueId)
+		if err != nil {
+			executionRequestWrapper = ExecutionRequestWrapper{}
+		}
+
+		newExecutionRequests := []ExecutionRequest{}
+		for _, executionRequest := range executionRequestWrapper.Data {
+			if executionRequest.ExecutionId != workflowExecution.ExecutionId {
+				newExecutionRequests = append(newExecutionRequests, executionRequest)
+			}
+		}
+
+		newExecutionRequests = append(newExecutionRequests, ExecutionRequest{
+			ExecutionId:   workflowExecution.ExecutionId,
+			WorkflowId:    workflowExecution.Workflow.ID,
+			Authorization: workflowExecution.Authorization,
+			Environments:  environments,
+			Status:        "ABORT",
+		})
+
+		executionRequestWrapper.Data = newExecutionRequests
+		err = setWorkflowQueue(ctx, executionRequestWrapper, queueId)
+		if err != nil {
+			log.Printf("Failed adding abort of %s to queue %s: %s", workflowExecution.ExecutionId, queueId, err)
+		}
+	}
+}
+
 func getWorkflowQueue(ctx context.Context, id string) (ExecutionRequestWrapper, error) {
 	key := datastore.NameKey("workflowqueue", id, nil)
 	workflows := ExecutionRequestWrapper{}
@@ -448,7 +573,7 @@ func getWorkflowQueue(ctx context.Context, id string) (ExecutionRequestWrapper,
 //}
 
 // Frequency = cronjob OR minutes between execution
-func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode, frequency string, body []byte) error {
+func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode, frequency, orgId string, revision int64, body []byte) error {
 	var err error
 	testSplit := strings.Split(frequency, "*")
 	cronJob := ""
@@ -484,7 +609,7 @@ func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode
 	// but that's a future problem
 	//log.Printf("BODY: %s", string(body))
 	parsedArgument := strings.Replace(string(body), "\"", "\\\"", -1)
-	bodyWrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "schedule", "execution_argument": "%s"}`, startNode, parsedArgument)
+	bodyWrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "schedule", "execution_argument": "%s", "revision": %d}`, startNode, parsedArgument, revision)
 	log.Printf("WRAPPER BODY: \n%s", bodyWrapper)
 	job := func() {
 		request := &http.Request{
@@ -513,6 +638,7 @@ func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode
 	schedule := ScheduleOld{
 		Id:                   scheduleId,
 		WorkflowId:           workflowId,
+		Org:                  orgId,
 		StartNode:            startNode,
 		Argument:             string(body),
 		WrappedArgument:      bodyWrapper,
@@ -542,8 +668,8 @@ func handleGetWorkflowqueueConfirm(resp http.ResponseWriter, request *http.Reque
 	}
 
 	// FIXME: Add authentication?
-	id := request.Header.Get("Org-Id")
-	if len(id) == 0 {
+	orgId := request.Header.Get("Org-Id")
+	if len(orgId) == 0 {
 		log.Printf("No Org-Id header set - confirm")
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Specify the org-id header."}`)))
@@ -552,6 +678,7 @@ func handleGetWorkflowqueueConfirm(resp http.ResponseWriter, request *http.Reque
 
 	//setWorkflowqueuetest(id)
 	ctx := context.Background()
+	id := getQueueId(orgId, getQueueEnvironment(ctx, orgId, request.Header.Get("Environment")))
 	executionRequests, err := getWorkflowQueue(ctx, id)
 	if err != nil {
 		log.Printf("(1) Failed reading body for workflowqueue: %s", err)
@@ -598,7 +725,7 @@ func handleGetWorkflowqueueConfirm(resp http.ResponseWriter, request *http.Reque
 	for _, execution := range executionRequests.Data {
 		found := false
 		for _, removeExecution := range removeExecutionRequests.Data {
-			if removeExecution.ExecutionId == execution.ExecutionId && removeExecution.WorkflowId == execution.WorkflowId {
+			if removeExecution.ExecutionId == execution.ExecutionId && removeExecution.WorkflowId == execution.WorkflowId && removeExecution.Status == execution.Status {
 				found = true
 				break
 			}
@@ -629,22 +756,24 @@ func handleGetWorkflowqueueConfirm(resp http.ResponseWriter, request *http.Reque
 }
 
 // FIXME: Authenticate this one? Can org ID be auth enough?
-// (especially since we have a default: shuffle)
 func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 	cors := handleCors(resp, request)
 	if cors {
 		return
 	}
 
-	id := request.Header.Get("Org-Id")
-	if len(id) == 0 {
+	orgId := request.Header.Get("Org-Id")
+	if len(orgId) == 0 {
 		log.Printf("No org-id header set")
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Specify the org-id header."}`)))
 		return
 	}
 
+	// Old versions of Orborus only send the Org-Id. They run the default environment
 	ctx := context.Background()
+	environment := getQueueEnvironment(ctx, orgId, request.Header.Get("Environment"))
+	id := getQueueId(orgId, environment)
 	executionRequests, err := getWorkflowQueue(ctx, id)
 	if err != nil {
 		// Skipping as this comes up over and over
@@ -658,6 +787,7 @@ func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 		executionRequests.Data = []ExecutionRequest{}
 	} else {
 		log.Printf("[INFO] Executionrequests: %d", len(executionRequests.Data))
+		executionRequests.Data = getRunnableRequests(ctx, orgId, environment, executionRequests.Data)
 	}
 
 	newjson, err := json.Marshal(executionRequests)
@@ -723,6 +853,30 @@ func handleGetStreamResults(resp http.ResponseWriter, request *http.Request) {
 
 }
 
+// Error branches only run when their source fails
+func hasErrorBranches(workflow Workflow, actionId string) bool {
+	for _, branch := range workflow.Branches {
+		if branch.SourceID == actionId && branch.HasError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// What an execution ends as after a failure went down an error branch
+func getErrorStatus(workflow Workflow) string {
+	if len(workflow.Configuration.ErrorStatus) > 0 {
+		return workflow.Configuration.ErrorStatus
+	}
+
+	if workflow.Configuration.ExitOnError {
+		return "FAILURE"
+	}
+
+	return "FINISHED"
+}
+
 // Finds the child nodes of a node in execution and returns them
 // Used if e.g. a node in a branch is exited, and all children have to be stopped
 func findChildNodes(workflowExecution WorkflowExecution, nodeId string) []string {
@@ -810,6 +964,8 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	oldStatus := workflowExecution.Status
+
 	if workflowExecution.Authorization != actionResult.Authorization {
 		log.Printf("Bad authorization key when updating node (workflowQueue) %s. Want: %s, Have: %s", actionResult.ExecutionId, workflowExecution.Authorization, actionResult.Authorization)
 		resp.WriteHeader(401)
@@ -839,18 +995,58 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	// The error branches of a node that failed, e.g. by timing out, might
+	// already be running. A late result from the app doesn't change that
+	for _, result := range workflowExecution.Results {
+		if result.Action.ID == actionResult.Action.ID && result.Status == "FAILURE" && actionResult.Status != "FAILURE" && hasErrorBranches(workflowExecution.Workflow, result.Action.ID) {
+			log.Printf("Ignoring %s result for %s as it already failed", actionResult.Status, actionResult.Action.ID)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Action %s already failed"}`, actionResult.Action.ID)))
+			return
+		}
+
+		// A waiting node can be decided before the worker sends its last
+		// update, e.g. the links of an approval
+		if result.Action.ID == actionResult.Action.ID && (result.Status == "SUCCESS" || result.Status == "FAILURE") && actionResult.Status == "EXECUTING" {
+			log.Printf("Ignoring EXECUTING result for %s as it's already %s", actionResult.Action.ID, result.Status)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Action %s already finished"}`, actionResult.Action.ID)))
+			return
+		}
+	}
+
 	if actionResult.Status == "ABORTED" || actionResult.Status == "FAILURE" {
 		log.Printf("Actionresult is %s. Should set workflowExecution and exit all running functions", actionResult.Status)
 
+		// The error branches run instead of stopping the execution
+		errorHandled := actionResult.Status == "FAILURE" && hasErrorBranches(workflowExecution.Workflow, actionResult.Action.ID)
+
 		newResults := []ActionResult{}
 		childNodes := []string{}
-		if workflowExecution.Workflow.Configuration.ExitOnError {
+		if workflowExecution.Workflow.Configuration.ExitOnError && !errorHandled {
 			workflowExecution.Status = actionResult.Status
 			workflowExecution.LastNode = actionResult.Action.ID
 			// Find underlying nodes and add them
 		} else {
-			// Finds ALL childnodes to set them to SKIPPED
-			childNodes = findChildNodes(*workflowExecution, actionResult.Action.ID)
+			// Finds ALL childnodes to set them to SKIPPED.
+			// Only what's under the normal branches when the error branches run
+			if !errorHandled {
+				childNodes = findChildNodes(*workflowExecution, actionResult.Action.ID)
+			} else {
+				childNodes = []string{actionResult.Action.ID}
+				for _, branch := range workflowExecution.Workflow.Branches {
+					if branch.SourceID != actionResult.Action.ID || branch.HasError {
+						continue
+					}
+
+					for _, nodeId := range findChildNodes(*workflowExecution, branch.DestinationID) {
+						if !arrayContainsString(childNodes, nodeId) {
+							childNodes = append(childNodes, nodeId)
+						}
+					}
+				}
+			}
+
 			// Remove duplicates
 			log.Printf("CHILD NODES: %d", len(childNodes))
 			for _, nodeId := range childNodes {
@@ -873,6 +1069,19 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 					continue
 				}
 
+				// E.g. nodes under a for-each node, which get their results from the items
+				hasResult := false
+				for _, result := range workflowExecution.Results {
+					if result.Action.ID == nodeId {
+						hasResult = true
+						break
+					}
+				}
+
+				if hasResult {
+					continue
+				}
+
 				// Check parents are done here. Only add it IF all parents are skipped
 				skipNodeAdd := false
 				for _, branch := range workflowExecution.Workflow.Branches {
@@ -906,7 +1115,7 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 					}
 
 					newResults = append(newResults, newResult)
-					increaseStatisticsField(ctx, "workflow_execution_actions_skipped", workflowExecution.Workflow.ID, 1)
+					increaseExecutionStatistics(ctx, *workflowExecution, "workflow_execution_actions_skipped", 1)
 				}
 			}
 		}
@@ -915,7 +1124,7 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		lastResult := ""
 		// type ActionResult struct {
 		for _, result := range workflowExecution.Results {
-			if result.Status == "EXECUTING" {
+			if result.Status == "EXECUTING" && !errorHandled {
 				result.Status = actionResult.Status
 				result.Result = "Aborted because of an unknown error"
 			}
@@ -931,12 +1140,12 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		workflowExecution.Results = newResults
 
 		if workflowExecution.Status == "ABORTED" {
-			err = increaseStatisticsField(ctx, "workflow_executions_aborted", workflowExecution.Workflow.ID, 1)
+			err = increaseExecutionStatistics(ctx, *workflowExecution, "workflow_executions_aborted", 1)
 			if err != nil {
 				log.Printf("Failed to increase aborted execution stats: %s", err)
 			}
 		} else if workflowExecution.Status == "FAILURE" {
-			err = increaseStatisticsField(ctx, "workflow_executions_failure", workflowExecution.Workflow.ID, 1)
+			err = increaseExecutionStatistics(ctx, *workflowExecution, "workflow_executions_failure", 1)
 			if err != nil {
 				log.Printf("Failed to increase failure execution stats: %s", err)
 			}
@@ -974,6 +1183,11 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 				}
 			}
 
+			// Apps don't know what the worker decided
+			if len(actionResult.Decisions) == 0 {
+				actionResult.Decisions = workflowExecution.Results[outerindex].Decisions
+			}
+
 			log.Printf("Updating %s in %s from %s to %s", actionResult.Action.ID, workflowExecution.ExecutionId, workflowExecution.Results[outerindex].Status, actionResult.Status)
 			workflowExecution.Results[outerindex] = actionResult
 		} else {
@@ -985,31 +1199,25 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		workflowExecution.Results = append(workflowExecution.Results, actionResult)
 	}
 
-	// FIXME: Have a check for skippednodes and their parents
-	for resultIndex, result := range workflowExecution.Results {
-		if result.Status != "SKIPPED" {
-			continue
-		}
-
-		// Checks if all parents are skipped or failed. Otherwise removes them from the results
-		for _, branch := range workflowExecution.Workflow.Branches {
-			if branch.DestinationID == result.Action.ID {
-				for _, subresult := range workflowExecution.Results {
-					if subresult.Action.ID == branch.SourceID {
-						if subresult.Status != "SKIPPED" && subresult.Status != "FAILURE" {
-							log.Printf("SUBRESULT PARENT STATUS: %s", subresult.Status)
-							log.Printf("Should remove resultIndex: %d", resultIndex)
-
-							workflowExecution.Results = append(workflowExecution.Results[:resultIndex], workflowExecution.Results[resultIndex+1:]...)
-
-							break
-						}
-					}
-				}
+	// Skipped by branch conditions is already decided, and so is everything
+	// that's not under the start node. Other skipped nodes are removed again
+	// if their join mode could still run them
+	startChildren := findChildNodes(*workflowExecution, workflowExecution.Start)
+	keptResults := []ActionResult{}
+	for _, result := range workflowExecution.Results {
+		if result.Status == "SKIPPED" && len(result.Decisions) == 0 && arrayContainsString(startChildren, result.Action.ID) {
+			join := getResultJoin(*workflowExecution, result.Action)
+			if join != "skip" {
+				log.Printf("Removing SKIPPED result of %s. Join is %s", result.Action.ID, join)
+				continue
 			}
 		}
+
+		keptResults = append(keptResults, result)
 	}
 
+	workflowExecution.Results = keptResults
+
 	extraInputs := 0
 	for _, result := range workflowExecution.Results {
 		if result.Action.Name == "User Input" && result.Action.AppName == "User Input" {
@@ -1031,28 +1239,13 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 				break
 			}
 
-			// FIXME: Check if ALL parents are skipped or if its just one. Otherwise execute it
-			if result.Status == "SKIPPED" {
+			if result.Status == "SKIPPED" && len(result.Decisions) == 0 {
 				skippedNodes = true
 
-				// Checks if all parents are skipped or failed. Otherwise removes them from the results
-				for _, branch := range workflowExecution.Workflow.Branches {
-					if branch.DestinationID == result.Action.ID {
-						for _, subresult := range workflowExecution.Results {
-							if subresult.Action.ID == branch.SourceID {
-								if subresult.Status != "SKIPPED" && subresult.Status != "FAILURE" {
-									//log.Printf("SUBRESULT PARENT STATUS: %s", subresult.Status)
-									//log.Printf("Should remove resultIndex: %d", resultIndex)
-									finished = false
-									break
-								}
-							}
-						}
-					}
-
-					if !finished {
-						break
-					}
+				// Same check as the worker. The node might still run
+				if arrayContainsString(startChildren, result.Action.ID) && getResultJoin(*workflowExecution, result.Action) != "skip" {
+					finished = false
+					break
 				}
 			}
 
@@ -1073,9 +1266,24 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 				workflowExecution.LastNode = actionResult.Action.ID
 			}
 
-			err = increaseStatisticsField(ctx, "workflow_executions_success", workflowExecution.Workflow.ID, 1)
-			if err != nil {
-				log.Printf("Failed to increase success execution stats: %s", err)
+			// Failures handled by error branches decide the status themselves
+			for _, result := range workflowExecution.Results {
+				if result.Status == "FAILURE" && hasErrorBranches(workflowExecution.Workflow, result.Action.ID) {
+					workflowExecution.Status = getErrorStatus(workflowExecution.Workflow)
+					break
+				}
+			}
+
+			if workflowExecution.Status == "FAILURE" {
+				err = increaseExecutionStatistics(ctx, *workflowExecution, "workflow_executions_failure", 1)
+				if err != nil {
+					log.Printf("Failed to increase failure execution stats: %s", err)
+				}
+			} else {
+				err = increaseExecutionStatistics(ctx, *workflowExecution, "workflow_executions_success", 1)
+				if err != nil {
+					log.Printf("Failed to increase success execution stats: %s", err)
+				}
 			}
 		}
 	}
@@ -1087,7 +1295,7 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 	//	log.Printf("Name: %s, Env: %s", action.Name, action.Environment)
 	//}
 
-	err = setWorkflowExecution(ctx, *workflowExecution)
+	err = setWorkflowExecutionStatus(ctx, workflowExecution, oldStatus)
 	if err != nil {
 		log.Printf("Error saving workflow execution actionresult setting: %s", err)
 		resp.WriteHeader(401)
@@ -1095,6 +1303,15 @@ func handleWorkflowQueue(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if workflowExecution.Status != "EXECUTING" {
+		go func(workflowExecution WorkflowExecution) {
+			err := setSubflowResult(workflowExecution)
+			if err != nil {
+				log.Printf("Failed setting subflow result of %s: %s", workflowExecution.ExecutionId, err)
+			}
+		}(*workflowExecution)
+	}
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
@@ -1128,9 +1345,10 @@ func getWorkflows(resp http.ResponseWriter, request *http.Request) {
 	//}
 
 	// With user, do a search for workflows with user or user's org attached
-	q := datastore.NewQuery("workflow").Filter("owner =", user.Id)
+	// Org admins can see everything in the org
+	q := datastore.NewQuery("workflow").Filter("org_id =", user.ActiveOrg.Id).Filter("owner =", user.Id)
 	if user.Role == "admin" {
-		q = datastore.NewQuery("workflow")
+		q = datastore.NewQuery("workflow").Filter("org_id =", user.ActiveOrg.Id)
 	}
 
 	var workflows []Workflow
@@ -1208,7 +1426,10 @@ func setNewWorkflow(resp http.ResponseWriter, request *http.Request) {
 
 	workflow.ID = uuid.NewV4().String()
 	workflow.Owner = user.Id
+	workflow.OrgId = user.ActiveOrg.Id
 	workflow.Sharing = "private"
+	workflow.Published = 0
+	workflow.PublishedRevisions = []int64{}
 
 	ctx := context.Background()
 	log.Printf("Saved new workflow %s with name %s", workflow.ID, workflow.Name)
@@ -1249,7 +1470,7 @@ func setNewWorkflow(resp http.ResponseWriter, request *http.Request) {
 		if err == nil {
 			// FIXME: Add real env
 			envName := "Shuffle"
-			environments, err := getEnvironments(ctx)
+			environments, err := getEnvironments(ctx, user.ActiveOrg.Id)
 			if err == nil {
 				for _, env := range environments {
 					if env.Default {
@@ -1296,6 +1517,7 @@ func setNewWorkflow(resp http.ResponseWriter, request *http.Request) {
 	workflow.Actions = newActions
 	workflow.IsValid = true
 	workflow.Configuration.ExitOnError = false
+	workflow.Revision = 1
 
 	workflowjson, err := json.Marshal(workflow)
 	if err != nil {
@@ -1313,6 +1535,15 @@ func setNewWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	err = addWorkflowRevision(ctx, user, workflow, "Created")
+	if err != nil {
+		log.Printf("Failed adding first revision for %s: %s", workflow.ID, err)
+	}
+
+	go syncGitWorkflow(user, workflow)
+
+	addAuditLog(ctx, request, user, "workflow.create", "workflow", workflow.ID, nil, workflow)
+
 	//memcacheName := fmt.Sprintf("%s_workflows", user.Username)
 	//memcache.Delete(ctx, memcacheName)
 
@@ -1363,8 +1594,7 @@ func deleteWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -1411,6 +1641,8 @@ func deleteWorkflow(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("Failed to increase total workflows: %s", err)
 	}
 
+	addAuditLog(ctx, request, user, "workflow.delete", "workflow", fileId, workflow, nil)
+
 	//memcacheName := fmt.Sprintf("%s_%s", user.Username, fileId)
 	//memcache.Delete(ctx, memcacheName)
 	//memcacheName = fmt.Sprintf("%s_workflows", user.Username)
@@ -1525,8 +1757,7 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 
 	log.Println("GetWorkflow end")
 
-	// FIXME - have a check for org etc too..
-	if user.Id != tmpworkflow.Owner && user.Role != "admin" {
+	if (user.Id != tmpworkflow.Owner && user.Role != "admin") || tmpworkflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (save)", user.Username, tmpworkflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -1566,6 +1797,11 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		workflow.Owner = user.Id
 	}
 
+	// The org and what's published can't be changed by saving
+	workflow.OrgId = tmpworkflow.OrgId
+	workflow.Published = tmpworkflow.Published
+	workflow.PublishedRevisions = tmpworkflow.PublishedRevisions
+
 	// FIXME - this shouldn't be necessary with proper API checks
 	newActions := []Action{}
 	allNodes := []string{}
@@ -1715,7 +1951,7 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	allAuths, err := getAllWorkflowAppAuth(ctx)
+	allAuths, err := getAllWorkflowAppAuth(ctx, tmpworkflow.OrgId)
 	if userErr != nil {
 		log.Printf("Api authentication failed in get all apps: %s", userErr)
 		resp.WriteHeader(401)
@@ -1851,11 +2087,12 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	// Saved either way. Lint only stops publishing, errors stop running too
 	workflow.Actions = newActions
-	workflow.IsValid = true
+	workflow = validateWorkflow(workflow, workflowApps, allAuths)
 	log.Printf("Tags: %#v", workflow.Tags)
 
-	err = setWorkflow(ctx, workflow, fileId)
+	workflow, err = setWorkflowRevision(ctx, user, workflow, workflow.RevisionMessage)
 	if err != nil {
 		log.Printf("Failed saving workflow to database: %s", err)
 		resp.WriteHeader(401)
@@ -1863,6 +2100,8 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	go syncGitWorkflow(user, workflow)
+
 	totalOldActions := len(tmpworkflow.Actions)
 	totalNewActions := len(workflow.Actions)
 	err = increaseStatisticsField(ctx, "total_workflow_actions", workflow.ID, int64(totalNewActions-totalOldActions))
@@ -1870,9 +2109,21 @@ func saveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("Failed to change total actions data: %s", err)
 	}
 
-	log.Printf("Saved new version of workflow %s (%s)", workflow.Name, fileId)
+	addAuditLog(ctx, request, user, "workflow.update", "workflow", fileId, tmpworkflow, workflow)
+
+	log.Printf("Saved revision %d of workflow %s (%s) with %d errors and %d lint issues", workflow.Revision, workflow.Name, fileId, len(workflow.Errors), len(workflow.Lint))
+	workflowErrors, err := json.Marshal(workflow.Errors)
+	if err != nil {
+		workflowErrors = []byte("[]")
+	}
+
+	workflowLint, err := json.Marshal(workflow.Lint)
+	if err != nil {
+		workflowLint = []byte("[]")
+	}
+
 	resp.WriteHeader(200)
-	resp.Write([]byte(`{"success": true}`))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "revision": %d, "is_valid": %t, "errors": %s, "lint": %s}`, workflow.Revision, workflow.IsValid, string(workflowErrors), string(workflowLint))))
 }
 
 func getWorkflowLocal(fileId string, request *http.Request) ([]byte, error) {
@@ -1959,8 +2210,7 @@ func abortExecution(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
-	if user.Id != workflowExecution.Workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflowExecution.Workflow.Owner && user.Role != "admin") || workflowExecution.Workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflowexecution workflow %s", user.Username, workflowExecution.Workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -1974,6 +2224,38 @@ func abortExecution(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	interrupted, err := stopExecution(ctx, workflowExecution)
+	if err != nil {
+		log.Printf("Error saving workflow execution for updates when aborting %s: %s", executionId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed setting workflowexecution status to abort"}`)))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "execution.abort", "execution", executionId, nil, map[string]string{"workflow_id": workflowExecution.Workflow.ID})
+
+	interruptedBody, err := json.Marshal(interrupted)
+	if err != nil {
+		interruptedBody = []byte("[]")
+	}
+
+	// FIXME - allowed to edit it? idk
+	log.Printf("[INFO] Aborted execution %s. Interrupted %d action(s)", executionId, len(interrupted))
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "interrupted": %s}`, string(interruptedBody))))
+
+	// Not sure what's up here
+	//if workflowExecution.Status == "ABORTED" || workflowExecution.Status == "FAILURE" {
+	//	log.Printf("Workflowexecution is already aborted. No further action can be taken")
+	//	resp.WriteHeader(401)
+	//	resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Workflowexecution is aborted because of %s with result %s and status %s"}`, workflowExecution.LastNode, workflowExecution.Result, workflowExecution.Status)))
+	//	return
+	//}
+}
+
+// Aborts the execution and what it started, like subflows and the items of
+// for-each nodes. Returns the nodes that were interrupted
+func stopExecution(ctx context.Context, workflowExecution *WorkflowExecution) ([]string, error) {
 	topic := "workflowexecution"
 
 	workflowExecution.CompletedAt = int64(time.Now().Unix())
@@ -1981,11 +2263,14 @@ func abortExecution(resp http.ResponseWriter, request *http.Request) {
 
 	lastResult := ""
 	newResults := []ActionResult{}
+	interrupted := []string{}
 	// type ActionResult struct {
 	for _, result := range workflowExecution.Results {
 		if result.Status == "EXECUTING" {
 			result.Status = "ABORTED"
-			result.Result = "Aborted because of an unknown error"
+			result.Result = "Interrupted because the execution was aborted"
+			result.CompletedAt = int64(time.Now().Unix())
+			interrupted = append(interrupted, result.Action.ID)
 		}
 
 		if len(result.Result) > 0 {
@@ -2000,30 +2285,56 @@ func abortExecution(resp http.ResponseWriter, request *http.Request) {
 		workflowExecution.Result = lastResult
 	}
 
-	err = setWorkflowExecution(ctx, *workflowExecution)
+	err := setWorkflowExecution(ctx, *workflowExecution)
 	if err != nil {
 		log.Printf("Error saving workflow execution for updates when aborting %s: %s", topic, err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed setting workflowexecution status to abort"}`)))
-		return
+		return interrupted, err
+	}
+
+	if workflowExecution.Status != "EXECUTING" {
+		go func(workflowExecution WorkflowExecution) {
+			err := setSubflowResult(workflowExecution)
+			if err != nil {
+				log.Printf("Failed setting subflow result of %s: %s", workflowExecution.ExecutionId, err)
+			}
+		}(*workflowExecution)
 	}
 
-	err = increaseStatisticsField(ctx, "workflow_executions_aborted", workflowExecution.Workflow.ID, 1)
+	err = increaseExecutionStatistics(ctx, *workflowExecution, "workflow_executions_aborted", 1)
 	if err != nil {
 		log.Printf("Failed to increase aborted execution stats: %s", err)
 	}
 
-	// FIXME - allowed to edit it? idk
-	resp.WriteHeader(200)
-	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
+	// Stops the worker and app containers instead of waiting for them to notice
+	queueAbort(ctx, *workflowExecution, getExecutionEnvironments(*workflowExecution))
 
-	// Not sure what's up here
-	//if workflowExecution.Status == "ABORTED" || workflowExecution.Status == "FAILURE" {
-	//	log.Printf("Workflowexecution is already aborted. No further action can be taken")
-	//	resp.WriteHeader(401)
-	//	resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Workflowexecution is aborted because of %s with result %s and status %s"}`, workflowExecution.LastNode, workflowExecution.Result, workflowExecution.Status)))
-	//	return
-	//}
+	abortChildExecutions(ctx, workflowExecution.ExecutionId)
+	return interrupted, nil
+}
+
+func abortChildExecutions(ctx context.Context, executionId string) {
+	q := datastore.NewQuery("workflowexecution").Filter("parent_execution_id =", executionId)
+	var childExecutions []WorkflowExecution
+	_, err := dbclient.GetAll(ctx, q, &childExecutions)
+	if err != nil {
+		log.Printf("Failed getting child executions of %s: %s", executionId, err)
+		return
+	}
+
+	for _, childExecution := range childExecutions {
+		if childExecution.Status != "EXECUTING" && childExecution.Status != "PAUSED" {
+			continue
+		}
+
+		childExecution := childExecution
+		_, err := stopExecution(ctx, &childExecution)
+		if err != nil {
+			log.Printf("Failed aborting child execution %s of %s: %s", childExecution.ExecutionId, executionId, err)
+			continue
+		}
+
+		log.Printf("[INFO] Aborted child execution %s of %s", childExecution.ExecutionId, executionId)
+	}
 }
 
 //// New execution with firestore
@@ -2083,6 +2394,38 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 		workflow = *tmpworkflow
 	}
 
+	// Triggers run the published version, not the draft that's being edited.
+	// Replays of an execution of this workflow choose the revision themselves
+	if request.Method == "POST" && request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			log.Printf("Failed request POST read: %s", err)
+			return WorkflowExecution{}, "Failed getting body", err
+		}
+
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var execution ExecutionRequest
+		err = json.Unmarshal(body, &execution)
+		if err == nil && len(execution.ReplayOf) > 0 {
+			replayExecution, err := getWorkflowExecution(ctx, execution.ReplayOf)
+			if err != nil || replayExecution.Workflow.ID != workflow.ID || replayExecution.Workflow.OrgId != workflow.OrgId {
+				log.Printf("Bad execution %s to replay for %s", execution.ReplayOf, workflow.ID)
+				return WorkflowExecution{}, "Bad execution to replay", errors.New("Bad execution to replay")
+			}
+		}
+
+		if err == nil && len(execution.ReplayOf) == 0 && (execution.Revision > 0 || arrayContainsString(publishedSources, execution.ExecutionSource)) {
+			publishedWorkflow, err := getPublishedWorkflow(ctx, workflow, execution.Revision)
+			if err != nil {
+				log.Printf("Failed getting published version of %s: %s", workflow.ID, err)
+				return WorkflowExecution{}, fmt.Sprintf("%s", err), err
+			}
+
+			workflow = *publishedWorkflow
+		}
+	}
+
 	if len(workflow.Actions) == 0 {
 		workflow.Actions = []Action{}
 	}
@@ -2116,6 +2459,9 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 	}
 
 	makeNew := true
+	var rerunExecution *WorkflowExecution
+	var foreachParent *WorkflowExecution
+	priority := 0
 	if request.Method == "POST" {
 		body, err := ioutil.ReadAll(request.Body)
 		if err != nil {
@@ -2131,10 +2477,12 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 			//return WorkflowExecution{}, "", err
 		}
 
-		if execution.Start == "" && len(body) > 0 {
+		if execution.Start == "" && !execution.DryRun && len(body) > 0 {
 			execution.ExecutionArgument = string(body)
 		}
 
+		priority = execution.Priority
+
 		// FIXME - this should have "execution_argument" from executeWorkflow frontend
 		//log.Printf("EXEC: %#v", execution)
 		if len(execution.ExecutionArgument) > 0 {
@@ -2145,6 +2493,57 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 			workflowExecution.ExecutionSource = execution.ExecutionSource
 		}
 
+		// Only the parent's own authorization can link an execution to it
+		if len(execution.ParentExecutionId) > 0 {
+			parentExecution, err := getWorkflowExecution(ctx, execution.ParentExecutionId)
+			if err != nil || parentExecution.Authorization != execution.ParentAuthorization || parentExecution.Workflow.OrgId != workflow.OrgId {
+				log.Printf("Bad parent execution %s for subflow of %s", execution.ParentExecutionId, workflow.ID)
+				return WorkflowExecution{}, "Bad parent execution", errors.New("Bad parent execution")
+			}
+
+			workflowExecution.ParentExecutionId = execution.ParentExecutionId
+			workflowExecution.ParentActionId = execution.ParentActionId
+
+			// Items of a for-each node run the nodes under it in the same workflow
+			if execution.ExecutionSource == "foreach" && parentExecution.Workflow.ID == workflow.ID && execution.Start == execution.ParentActionId {
+				foreachParent = parentExecution
+				workflowExecution.ForeachIndex = execution.ForeachIndex
+			}
+		}
+
+		if execution.ExecutionSource == "foreach" && foreachParent == nil {
+			log.Printf("Bad foreach item for %s", workflow.ID)
+			return WorkflowExecution{}, "Bad foreach item", errors.New("Bad foreach item")
+		}
+
+		// Reruns can only use executions of the same workflow
+		if len(execution.RerunOf) > 0 {
+			rerunExecution, err = getWorkflowExecution(ctx, execution.RerunOf)
+			if err != nil || rerunExecution.Workflow.ID != workflow.ID || rerunExecution.Workflow.OrgId != workflow.OrgId {
+				log.Printf("Bad execution %s to rerun for %s", execution.RerunOf, workflow.ID)
+				return WorkflowExecution{}, "Bad execution to rerun", errors.New("Bad execution to rerun")
+			}
+
+			workflowExecution.RerunOf = execution.RerunOf
+		}
+
+		// Checked before the published version was chosen
+		if len(execution.ReplayOf) > 0 {
+			workflowExecution.ReplayOf = execution.ReplayOf
+		}
+
+		if execution.DryRun {
+			for _, mock := range execution.Mocks {
+				if len(mock.Status) > 0 && mock.Status != "SUCCESS" && mock.Status != "FAILURE" {
+					return WorkflowExecution{}, fmt.Sprintf("Mock status for %s has to be SUCCESS or FAILURE", mock.ActionId), errors.New("Bad mock status")
+				}
+			}
+
+			workflowExecution.DryRun = true
+			workflowExecution.Mocks = execution.Mocks
+			workflowExecution.Workflow.Actions = setDryRunExamples(ctx, workflowExecution.Workflow.Actions)
+		}
+
 		//log.Printf("Execution data: %#v", execution)
 		if len(execution.Start) == 36 {
 			log.Printf("[INFO] Should start execution on node %s", execution.Start)
@@ -2284,6 +2683,8 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 		workflowExecution.ProjectId = gceProject
 		workflowExecution.Locations = []string{"europe-west2"}
 		workflowExecution.WorkflowId = workflow.ID
+		workflowExecution.OrgId = workflow.OrgId
+		workflowExecution.WorkflowRevision = workflow.Revision
 		workflowExecution.StartedAt = int64(time.Now().Unix())
 		workflowExecution.CompletedAt = 0
 		workflowExecution.Authorization = uuid.NewV4().String()
@@ -2300,6 +2701,16 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 	}
 
 	workflowExecution.ExecutionVariables = workflow.ExecutionVariables
+	if rerunExecution != nil {
+		for index, variable := range workflowExecution.ExecutionVariables {
+			for _, oldVariable := range rerunExecution.ExecutionVariables {
+				if oldVariable.Name == variable.Name {
+					workflowExecution.ExecutionVariables[index].Value = oldVariable.Value
+					break
+				}
+			}
+		}
+	}
 	// Local authorization for this single workflow used in workers.
 
 	// FIXME: Used for cloud
@@ -2341,7 +2752,7 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 		// FIXME: Authentication parameters
 		if len(action.AuthenticationId) > 0 {
 			if len(allAuths) == 0 {
-				allAuths, err = getAllWorkflowAppAuth(ctx)
+				allAuths, err = getAllWorkflowAppAuth(ctx, workflow.OrgId)
 				if err != nil {
 					log.Printf("Api authentication failed in get all app auth: %s", err)
 					return WorkflowExecution{}, fmt.Sprintf("Api authentication failed in get all app auth: %s", err), err
@@ -2417,6 +2828,16 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 		return WorkflowExecution{}, fmt.Sprintf("Workflow action %s doesn't exist in workflow", workflowExecution.Start), errors.New(fmt.Sprintf("Workflow start node %s doesn't exist. Exiting!", workflowExecution.Start))
 	}
 
+	// Reruns keep what went well before the start node
+	if rerunExecution != nil {
+		defaultResults = getRerunResults(workflowExecution, *rerunExecution, childNodes, defaultResults)
+	}
+
+	if foreachParent != nil {
+		defaultResults = getForeachItemResults(workflowExecution, *foreachParent, childNodes)
+		workflowExecution.ExecutionVariables = foreachParent.ExecutionVariables
+	}
+
 	// Verification for execution environments
 	workflowExecution.Results = defaultResults
 	workflowExecution.Workflow.Actions = newActions
@@ -2448,12 +2869,16 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 		}
 	}
 
-	err = imageCheckBuilder(imageNames)
-	if err != nil {
-		log.Printf("[ERROR] Failed building the required images from %#v: %s", imageNames, err)
-		return WorkflowExecution{}, "Failed building missing Docker images", err
+	// Dry runs don't use the images
+	if !workflowExecution.DryRun {
+		err = imageCheckBuilder(imageNames)
+		if err != nil {
+			log.Printf("[ERROR] Failed building the required images from %#v: %s", imageNames, err)
+			return WorkflowExecution{}, "Failed building missing Docker images", err
+		}
 	}
 
+	workflowExecution.Priority = getExecutionPriority(workflowExecution.Workflow, workflowExecution.Start, priority)
 	err = setWorkflowExecution(ctx, workflowExecution)
 	if err != nil {
 		log.Printf("Error saving workflow execution for updates %s: %s", topic, err)
@@ -2463,37 +2888,12 @@ func handleExecution(id string, workflow Workflow, request *http.Request) (Workf
 	// Adds queue for onprem execution
 	// FIXME - add specifics to executionRequest, e.g. specific environment (can run multi onprem)
 	if onpremExecution {
-		// FIXME - tmp name based on future companyname-companyId
-		for _, environment := range environments {
-			log.Printf("[INFO] Execution: %s should execute onprem with execution environment \"%s\"", workflowExecution.ExecutionId, environment)
-
-			executionRequest := ExecutionRequest{
-				ExecutionId:   workflowExecution.ExecutionId,
-				WorkflowId:    workflowExecution.Workflow.ID,
-				Authorization: workflowExecution.Authorization,
-				Environments:  environments,
-			}
-
-			executionRequestWrapper, err := getWorkflowQueue(ctx, environment)
-			if err != nil {
-				executionRequestWrapper = ExecutionRequestWrapper{
-					Data: []ExecutionRequest{executionRequest},
-				}
-			} else {
-				executionRequestWrapper.Data = append(executionRequestWrapper.Data, executionRequest)
-			}
-
-			//log.Printf("Execution request: %#v", executionRequest)
-			err = setWorkflowQueue(ctx, executionRequestWrapper, environment)
-			if err != nil {
-				log.Printf("Failed adding to db: %s", err)
-			}
-		}
+		queueExecution(ctx, workflowExecution, environments)
 	} else {
 		log.Printf("[ERROR] Cloud not implemented yet")
 	}
 
-	err = increaseStatisticsField(ctx, "workflow_executions", workflow.ID, 1)
+	err = increaseExecutionStatistics(ctx, workflowExecution, "workflow_executions", 1)
 	if err != nil {
 		log.Printf("Failed to increase stats execution stats: %s", err)
 	}
@@ -2544,15 +2944,49 @@ func executeWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
 	// FIXME - admin check like this? idk
-	if user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler" && user.Role != fmt.Sprintf("workflow_%s", fileId) {
+	if (user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler" && user.Role != fmt.Sprintf("workflow_%s", fileId)) || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (execute)", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
 		return
 	}
 
+	// Replays run a draft instead of the published version, so the caller
+	// has to be able to see the execution that's replayed. The priority in
+	// the body is only for admins
+	if request.Method == "POST" && request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+			return
+		}
+
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var execution ExecutionRequest
+		err = json.Unmarshal(body, &execution)
+
+		// Otherwise anyone could put their executions in front of the queue
+		if err == nil && execution.Priority != 0 && user.Role != "admin" {
+			log.Printf("Wrong user (%s) for priority %d in workflow %s", user.Username, execution.Priority, workflow.ID)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Only admins can set the priority"}`))
+			return
+		}
+
+		if err == nil && len(execution.ReplayOf) > 0 {
+			replayExecution, err := getWorkflowExecution(ctx, execution.ReplayOf)
+			if err != nil || replayExecution.Workflow.ID != workflow.ID || !canAccessExecution(user, *replayExecution) {
+				log.Printf("Wrong user (%s) for replay of %s in workflow %s", user.Username, execution.ReplayOf, workflow.ID)
+				resp.WriteHeader(401)
+				resp.Write([]byte(`{"success": false, "reason": "Bad execution to replay"}`))
+				return
+			}
+		}
+	}
+
 	log.Printf("[INFO] Starting execution of %s!", fileId)
 	workflowExecution, executionResp, err := handleExecution(fileId, *workflow, request)
 
@@ -2616,9 +3050,8 @@ func stopSchedule(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
 	// FIXME - admin check like this? idk
-	if user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler" {
+	if (user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (stop schedule)", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2637,6 +3070,8 @@ func stopSchedule(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "schedule.delete", "schedule", scheduleId, map[string]string{"workflow_id": workflow.ID}, nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 	return
@@ -2692,9 +3127,8 @@ func stopScheduleGCP(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
 	// FIXME - admin check like this? idk
-	if user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler" {
+	if (user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (stop schedule)", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2726,6 +3160,8 @@ func stopScheduleGCP(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "schedule.delete", "schedule", scheduleId, map[string]string{"workflow_id": workflow.ID}, nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 	return
@@ -2813,9 +3249,8 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
 	// FIXME - admin check like this? idk
-	if user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler" {
+	if (user.Id != workflow.Owner && user.Role != "admin" && user.Role != "scheduler") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2887,6 +3322,13 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	err = checkPublishedRevision(*workflow, schedule.Revision)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	scheduleArg, err := json.Marshal(schedule.ExecutionArgument)
 	if err != nil {
 		log.Printf("Failed scheduleArg marshal: %s", err)
@@ -2913,6 +3355,8 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		schedule.Name,
 		startNode,
 		schedule.Frequency,
+		workflow.OrgId,
+		schedule.Revision,
 		[]byte(parsedBody),
 	)
 
@@ -2933,6 +3377,8 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "schedule.create", "schedule", schedule.Id, nil, schedule)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 	return
@@ -3002,7 +3448,7 @@ func getSpecificWorkflow(resp http.ResponseWriter, request *http.Request) {
 	// CHECK orgs of user, or if user is owner
 	// FIXME - add org check too, and not just owner
 	// Check workflow.Sharing == private / public / org  too
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (get workflow)", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -3072,6 +3518,7 @@ func setWorkflowExecution(ctx context.Context, workflowExecution WorkflowExecuti
 	}
 
 	key := datastore.NameKey("workflowexecution", workflowExecution.ExecutionId, nil)
+	setConcurrencyFields(&workflowExecution)
 
 	// New struct, to not add body, author etc
 	if _, err := dbclient.Put(ctx, key, &workflowExecution); err != nil {
@@ -3112,9 +3559,9 @@ func getWorkflow(ctx context.Context, id string) (*Workflow, error) {
 	return workflow, nil
 }
 
-func getEnvironments(ctx context.Context) ([]Environment, error) {
+func getEnvironments(ctx context.Context, orgId string) ([]Environment, error) {
 	var environments []Environment
-	q := datastore.NewQuery("Environments")
+	q := datastore.NewQuery("Environments").Filter("org_id =", orgId)
 
 	_, err := dbclient.GetAll(ctx, q, &environments)
 	if err != nil {
@@ -3191,7 +3638,15 @@ func deleteAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 
 	log.Printf("ID: %s", fileId)
 	ctx := context.Background()
-	err := DeleteKey(ctx, "workflowappauth", fileId)
+	appAuth, err := getWorkflowAppAuthDatastore(ctx, fileId)
+	if err != nil || appAuth.OrgId != user.ActiveOrg.Id {
+		log.Printf("Failed getting appauth %s in org %s: %s", fileId, user.ActiveOrg.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = DeleteKey(ctx, "workflowappauth", fileId)
 	if err != nil {
 		log.Printf("Failed deleting workflowapp")
 		resp.WriteHeader(401)
@@ -3199,6 +3654,8 @@ func deleteAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "app_auth.delete", "app_auth", fileId, getAuditAppAuth(*appAuth), nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -3348,6 +3805,8 @@ func deleteWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		log.Printf("Failed to increase total apps loaded stats: %s", err)
 	}
+
+	addAuditLog(ctx, request, user, "app.delete", "app", fileId, map[string]string{"name": app.Name, "app_version": app.AppVersion}, nil)
 	//err = memcache.Delete(request.Context(), sessionToken)
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
@@ -3429,7 +3888,7 @@ func addAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// FIXME - need to be logged in?
-	_, userErr := handleApiAuthentication(resp, request)
+	user, userErr := handleApiAuthentication(resp, request)
 	if userErr != nil {
 		log.Printf("Api authentication failed in get all apps: %s", userErr)
 		resp.WriteHeader(401)
@@ -3454,11 +3913,21 @@ func addAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	ctx := context.Background()
 	if len(appAuth.Id) == 0 {
 		appAuth.Id = uuid.NewV4().String()
+	} else {
+		// Don't allow overwriting auth in another org
+		oldAuth, err := getWorkflowAppAuthDatastore(ctx, appAuth.Id)
+		if err == nil && oldAuth.OrgId != user.ActiveOrg.Id {
+			log.Printf("User %s tried to overwrite auth %s in another org", user.Username, appAuth.Id)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
 	}
 
-	ctx := context.Background()
+	appAuth.OrgId = user.ActiveOrg.Id
 	if len(appAuth.Label) == 0 {
 		resp.WriteHeader(409)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Label can't be empty"}`)))
@@ -3506,6 +3975,8 @@ func addAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "app_auth.set", "app_auth", appAuth.Id, nil, getAuditAppAuth(appAuth))
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -3516,7 +3987,7 @@ func getAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	_, userErr := handleApiAuthentication(resp, request)
+	user, userErr := handleApiAuthentication(resp, request)
 	if userErr != nil {
 		log.Printf("Api authentication failed in get all apps: %s", userErr)
 		resp.WriteHeader(401)
@@ -3532,7 +4003,7 @@ func getAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 	//	return
 	//}
 	ctx := context.Background()
-	allAuths, err := getAllWorkflowAppAuth(ctx)
+	allAuths, err := getAllWorkflowAppAuth(ctx, user.ActiveOrg.Id)
 	if err != nil {
 		log.Printf("Api authentication failed in get all app auth: %s", err)
 		resp.WriteHeader(401)
@@ -3686,6 +4157,7 @@ func updateWorkflowAppConfig(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	before := map[string]interface{}{"sharing": app.Sharing, "sharing_config": app.SharingConfig}
 	if tmpfields.Sharing != app.Sharing {
 		app.Sharing = tmpfields.Sharing
 	}
@@ -3702,6 +4174,8 @@ func updateWorkflowAppConfig(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "app.update", "app", app.ID, before, map[string]interface{}{"sharing": app.Sharing, "sharing_config": app.SharingConfig})
+
 	log.Printf("Changed workflow app %s", app.ID)
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
@@ -4164,7 +4638,7 @@ func deployWebhookFunction(ctx context.Context, name, localization, applocation
 	return nil
 }
 
-func loadGithubWorkflows(url, username, password, userId, branch string) error {
+func loadGithubWorkflows(url, username, password, userId, branch, orgId string) error {
 	fs := memfs.New()
 
 	if strings.Contains(url, "github") || strings.Contains(url, "gitlab") || strings.Contains(url, "bitbucket") {
@@ -4199,7 +4673,7 @@ func loadGithubWorkflows(url, username, password, userId, branch string) error {
 		_ = r
 
 		log.Printf("Starting workflow folder iteration")
-		iterateWorkflowGithubFolders(fs, dir, "", "", userId)
+		iterateWorkflowGithubFolders(fs, dir, "", "", userId, orgId)
 
 	} else if strings.Contains(url, "s3") {
 		//https://docs.aws.amazon.com/sdk-for-go/api/service/s3/
@@ -4274,7 +4748,7 @@ func loadSpecificWorkflows(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// Field3 = branch
-	err = loadGithubWorkflows(tmpBody.URL, tmpBody.Field1, tmpBody.Field2, user.Id, tmpBody.Field3)
+	err = loadGithubWorkflows(tmpBody.URL, tmpBody.Field1, tmpBody.Field2, user.Id, tmpBody.Field3, user.ActiveOrg.Id)
 	if err != nil {
 		log.Printf("Failed to update workflows: %s", err)
 		resp.WriteHeader(401)
@@ -4282,6 +4756,8 @@ func loadSpecificWorkflows(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(context.Background(), request, user, "workflow.import", "workflow", "", nil, map[string]string{"url": tmpBody.URL, "branch": tmpBody.Field3})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
@@ -4325,6 +4801,8 @@ func handleAppHotloadRequest(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(context.Background(), request, user, "app.hotload", "app", "", nil, map[string]string{"location": location})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
@@ -4337,7 +4815,7 @@ func loadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 
 	// Just need to be logged in
 	// FIXME - should have some permissions?
-	_, err := handleApiAuthentication(resp, request)
+	user, err := handleApiAuthentication(resp, request)
 	if err != nil {
 		log.Printf("Api authentication failed in load specific apps: %s", err)
 		resp.WriteHeader(401)
@@ -4430,6 +4908,8 @@ func loadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(context.Background(), request, user, "app.import", "app", "", nil, map[string]interface{}{"url": tmpBody.URL, "force_update": tmpBody.ForceUpdate})
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
@@ -4566,7 +5046,7 @@ func iterateOpenApiGithub(fs billy.Filesystem, dir []os.FileInfo, extra string,
 }
 
 // Onlyname is used to
-func iterateWorkflowGithubFolders(fs billy.Filesystem, dir []os.FileInfo, extra string, onlyname string, userId string) error {
+func iterateWorkflowGithubFolders(fs billy.Filesystem, dir []os.FileInfo, extra string, onlyname string, userId string, orgId string) error {
 	var err error
 
 	for _, file := range dir {
@@ -4585,7 +5065,7 @@ func iterateWorkflowGithubFolders(fs billy.Filesystem, dir []os.FileInfo, extra
 			}
 
 			// Go routine? Hmm, this can be super quick I guess
-			err = iterateWorkflowGithubFolders(fs, dir, tmpExtra, "", userId)
+			err = iterateWorkflowGithubFolders(fs, dir, tmpExtra, "", userId, orgId)
 			if err != nil {
 				continue
 			}
@@ -4617,8 +5097,24 @@ func iterateWorkflowGithubFolders(fs billy.Filesystem, dir []os.FileInfo, extra
 					workflow.Owner = userId
 				}
 
+				// Can't overwrite workflows in other orgs with the same ID
 				ctx := context.Background()
-				err = setWorkflow(ctx, workflow, workflow.ID)
+				oldWorkflow, err := getWorkflow(ctx, workflow.ID)
+				if err == nil && oldWorkflow.OrgId != orgId {
+					log.Printf("Workflow %s already exists in another org. Skipping.", workflow.ID)
+					continue
+				}
+
+				workflow.OrgId = orgId
+				workflow.Published = 0
+				workflow.PublishedRevisions = []int64{}
+
+				user, err := getUser(ctx, userId)
+				if err != nil {
+					user = &User{Id: userId}
+				}
+
+				_, err = setWorkflowRevision(ctx, *user, workflow, fmt.Sprintf("Imported from %s", path))
 				if err != nil {
 					log.Printf("Failed setting (download) workflow: %s", err)
 					continue
@@ -4883,7 +5379,7 @@ func setNewWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 
 	// Just need to be logged in
 	// FIXME - should have some permissions?
-	_, err := handleApiAuthentication(resp, request)
+	user, err := handleApiAuthentication(resp, request)
 	if err != nil {
 		log.Printf("Api authentication failed in set new app: %s", err)
 		resp.WriteHeader(401)
@@ -4960,6 +5456,8 @@ func setNewWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("Added %s:%s to the database", workflowapp.Name, workflowapp.AppVersion)
 	}
 
+	addAuditLog(ctx, request, user, "app.create", "app", workflowapp.ID, nil, map[string]string{"name": workflowapp.Name, "app_version": workflowapp.AppVersion})
+
 	//memcache.Delete(ctx, "all_apps")
 
 	resp.WriteHeader(200)
@@ -5008,8 +5506,7 @@ func getWorkflowExecutions(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if (user.Id != workflow.Owner && user.Role != "admin") || workflow.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s (get execution)", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5044,9 +5541,13 @@ func getWorkflowExecutions(resp http.ResponseWriter, request *http.Request) {
 	resp.Write(newjson)
 }
 
-func getAllSchedules(ctx context.Context) ([]ScheduleOld, error) {
+// Empty orgId = all schedules. Only used during init.
+func getAllSchedules(ctx context.Context, orgId string) ([]ScheduleOld, error) {
 	var schedules []ScheduleOld
 	q := datastore.NewQuery("schedules")
+	if len(orgId) > 0 {
+		q = q.Filter("org =", orgId)
+	}
 
 	_, err := dbclient.GetAll(ctx, q, &schedules)
 	if err != nil {
@@ -5068,9 +5569,13 @@ func getAllWorkflowApps(ctx context.Context) ([]WorkflowApp, error) {
 	return allworkflowapps, nil
 }
 
-func getAllWorkflowAppAuth(ctx context.Context) ([]AppAuthenticationStorage, error) {
+// Empty orgId = all auths. Only used during init.
+func getAllWorkflowAppAuth(ctx context.Context, orgId string) ([]AppAuthenticationStorage, error) {
 	var allworkflowapps []AppAuthenticationStorage
 	q := datastore.NewQuery("workflowappauth")
+	if len(orgId) > 0 {
+		q = q.Filter("org_id =", orgId)
+	}
 
 	_, err := dbclient.GetAll(ctx, q, &allworkflowapps)
 	if err != nil {
@@ -5080,6 +5585,16 @@ func getAllWorkflowAppAuth(ctx context.Context) ([]AppAuthenticationStorage, err
 	return allworkflowapps, nil
 }
 
+func getWorkflowAppAuthDatastore(ctx context.Context, id string) (*AppAuthenticationStorage, error) {
+	key := datastore.NameKey("workflowappauth", id, nil)
+	appAuth := &AppAuthenticationStorage{}
+	if err := dbclient.Get(ctx, key, appAuth); err != nil {
+		return &AppAuthenticationStorage{}, err
+	}
+
+	return appAuth, nil
+}
+
 func setWorkflowAppAuthDatastore(ctx context.Context, workflowappauth AppAuthenticationStorage, id string) error {
 	key := datastore.NameKey("workflowappauth", id, nil)
 
@@ -5149,7 +5664,7 @@ func handleStopHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Id != hook.Owner && user.Role != "admin" {
+	if (user.Id != hook.Owner && user.Role != "admin") || hook.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s", user.Username, hook.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5177,6 +5692,8 @@ func handleStopHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "hook.stop", "hook", fileId, nil, nil)
+
 	image := "webhook"
 
 	// This is here to force stop and remove the old webhook
@@ -5232,7 +5749,7 @@ func handleDeleteHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Id != hook.Owner && user.Role != "admin" {
+	if (user.Id != hook.Owner && user.Role != "admin") || hook.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s", user.Username, hook.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5255,6 +5772,8 @@ func handleDeleteHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "hook.delete", "hook", fileId, map[string]interface{}{"workflows": hook.Workflows}, nil)
+
 	// This is here to force stop and remove the old webhook
 	//image := "webhook"
 	//err = removeWebhookFunction(ctx, fileId)
@@ -5343,7 +5862,7 @@ func handleStartHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Id != hook.Owner && user.Role != "admin" {
+	if (user.Id != hook.Owner && user.Role != "admin") || hook.OrgId != user.ActiveOrg.Id {
 		log.Printf("Wrong user (%s) for workflow %s", user.Username, hook.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -5360,8 +5879,23 @@ func handleStartHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// The webhook only needs to execute its own workflows. The key from
+	// the last time it was started isn't used anymore
+	err = revokeUserApikeys(ctx, user.Id, fmt.Sprintf("webhook_%s", fileId))
+	if err != nil {
+		log.Printf("Failed revoking old apikey for webhook %s: %s", fileId, err)
+	}
+
+	functionApikey, _, err := createUserApikey(ctx, user, fmt.Sprintf("webhook_%s", fileId), []string{"execute"}, hook.Workflows, 0)
+	if err != nil {
+		log.Printf("Failed to generate apikey for webhook %s: %s", fileId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
 	environmentVariables := map[string]string{
-		"FUNCTION_APIKEY": user.ApiKey,
+		"FUNCTION_APIKEY": functionApikey,
 		"CALLBACKURL":     "https://shuffler.io",
 		"HOOKID":          fileId,
 	}
@@ -5385,6 +5919,8 @@ func handleStartHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	addAuditLog(ctx, request, user, "hook.start", "hook", fileId, nil, nil)
+
 	log.Printf("Starting function %s?", fileId)
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true, "reason": "Started webhook"}`))
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	uuid "github.com/satori/go.uuid"
+)
+
+// How long running the tests can take before the unfinished ones fail
+var maxTestDuration = 120
+
+// A dry run of the workflow with an argument and mocked apps, and what the
+// nodes should end up as
+type WorkflowTest struct {
+	Id         string          `json:"id" datastore:"id"`
+	WorkflowId string          `json:"workflow_id" datastore:"workflow_id"`
+	OrgId      string          `json:"org_id" datastore:"org_id"`
+	Name       string          `json:"name" datastore:"name"`
+	Argument   string          `json:"argument" datastore:"argument,noindex"`
+	Mocks      []ActionMock    `json:"mocks" datastore:"mocks,noindex"`
+	Assertions []TestAssertion `json:"assertions" datastore:"assertions,noindex"`
+	Created    int64           `json:"created" datastore:"created"`
+	Edited     int64           `json:"edited" datastore:"edited"`
+}
+
+// Checks the status or result of a node. ActionId can also be the label, and
+// is empty for the execution itself. Path goes into a JSON result the same
+// way as $node.path. Check is equals, not equals or contains
+type TestAssertion struct {
+	ActionId string `json:"action_id" datastore:"action_id"`
+	Field    string `json:"field" datastore:"field"`
+	Path     string `json:"path" datastore:"path"`
+	Check    string `json:"check" datastore:"check"`
+	Value    string `json:"value" datastore:"value,noindex"`
+}
+
+type TestResult struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Passed      bool     `json:"passed"`
+	ExecutionId string   `json:"execution_id"`
+	Status      string   `json:"status"`
+	Failures    []string `json:"failures"`
+}
+
+var testChecks = []string{"", "equals", "not equals", "contains"}
+
+func getWorkflowTest(ctx context.Context, id string) (*WorkflowTest, error) {
+	key := datastore.NameKey("workflow_tests", id, nil)
+	workflowTest := &WorkflowTest{}
+	if err := dbclient.Get(ctx, key, workflowTest); err != nil {
+		return &WorkflowTest{}, err
+	}
+
+	return workflowTest, nil
+}
+
+// Oldest first, so they run in the same order every time
+func getWorkflowTests(ctx context.Context, workflowId string) ([]WorkflowTest, error) {
+	q := datastore.NewQuery("workflow_tests").Filter("workflow_id =", workflowId)
+	var workflowTests []WorkflowTest
+	_, err := dbclient.GetAll(ctx, q, &workflowTests)
+	if err != nil {
+		return []WorkflowTest{}, err
+	}
+
+	sort.Slice(workflowTests, func(i, j int) bool {
+		return workflowTests[i].Created < workflowTests[j].Created
+	})
+
+	return workflowTests, nil
+}
+
+func setWorkflowTest(ctx context.Context, workflowTest WorkflowTest) error {
+	key := datastore.NameKey("workflow_tests", workflowTest.Id, nil)
+	if _, err := dbclient.Put(ctx, key, &workflowTest); err != nil {
+		log.Printf("Error setting workflow test %s: %s", workflowTest.Id, err)
+		return err
+	}
+
+	return nil
+}
+
+func checkWorkflowTest(workflowTest WorkflowTest) error {
+	if len(workflowTest.Name) == 0 {
+		return errors.New("Missing field: name")
+	}
+
+	for _, mock := range workflowTest.Mocks {
+		if len(mock.Status) > 0 && mock.Status != "SUCCESS" && mock.Status != "FAILURE" {
+			return errors.New(fmt.Sprintf("Mock status for %s has to be SUCCESS or FAILURE", mock.ActionId))
+		}
+	}
+
+	for _, assertion := range workflowTest.Assertions {
+		if assertion.Field != "status" && assertion.Field != "result" {
+			return errors.New(fmt.Sprintf("Assertion field for %s has to be status or result", assertion.ActionId))
+		}
+
+		if !arrayContainsString(testChecks, assertion.Check) {
+			return errors.New(fmt.Sprintf("Assertion check for %s has to be equals, not equals or contains", assertion.ActionId))
+		}
+	}
+
+	return nil
+}
+
+// Same paths as $node.path. # is every item in a list
+func getResultPath(data interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return data
+	}
+
+	switch value := data.(type) {
+	case map[string]interface{}:
+		return getResultPath(value[path[0]], path[1:])
+	case []interface{}:
+		if path[0] == "#" {
+			items := []interface{}{}
+			for _, item := range value {
+				items = append(items, getResultPath(item, path[1:]))
+			}
+
+			return items
+		}
+
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(value) {
+			return nil
+		}
+
+		return getResultPath(value[index], path[1:])
+	}
+
+	return nil
+}
+
+func getAssertionResult(result string, path string) string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if len(path) == 0 {
+		return result
+	}
+
+	var parsed interface{}
+	err := json.Unmarshal([]byte(result), &parsed)
+	if err != nil {
+		return ""
+	}
+
+	value := getResultPath(parsed, strings.Split(path, "."))
+	if stringValue, ok := value.(string); ok {
+		return stringValue
+	}
+
+	if value == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+func getAssertionValue(workflowExecution WorkflowExecution, assertion TestAssertion) (string, bool) {
+	if len(assertion.ActionId) == 0 {
+		if assertion.Field == "status" {
+			return workflowExecution.Status, true
+		}
+
+		return getAssertionResult(workflowExecution.Result, assertion.Path), true
+	}
+
+	for _, result := range workflowExecution.Results {
+		if result.Action.ID != assertion.ActionId && !strings.EqualFold(result.Action.Label, assertion.ActionId) {
+			continue
+		}
+
+		if assertion.Field == "status" {
+			return result.Status, true
+		}
+
+		return getAssertionResult(result.Result, assertion.Path), true
+	}
+
+	return "", false
+}
+
+// Returns what didn't go as expected. Executions that don't finish fail,
+// unless the test asserts their status
+func getTestFailures(workflowExecution WorkflowExecution, workflowTest WorkflowTest) []string {
+	failures := []string{}
+	checksStatus := false
+	for _, assertion := range workflowTest.Assertions {
+		name := assertion.ActionId
+		if len(name) == 0 {
+			name = "execution"
+			checksStatus = checksStatus || assertion.Field == "status"
+		}
+
+		if len(assertion.Path) > 0 {
+			name = fmt.Sprintf("%s %s", name, assertion.Path)
+		}
+
+		value, found := getAssertionValue(workflowExecution, assertion)
+		if !found {
+			failures = append(failures, fmt.Sprintf("%s has no result", assertion.ActionId))
+			continue
+		}
+
+		passed := false
+		switch assertion.Check {
+		case "", "equals":
+			passed = value == assertion.Value
+		case "not equals":
+			passed = value != assertion.Value
+		case "contains":
+			passed = strings.Contains(value, assertion.Value)
+		}
+
+		if !passed {
+			check := assertion.Check
+			if len(check) == 0 {
+				check = "equals"
+			}
+
+			failures = append(failures, fmt.Sprintf("%s %s: %s %s %s", name, assertion.Field, value, check, assertion.Value))
+		}
+	}
+
+	if !checksStatus && workflowExecution.Status != "FINISHED" {
+		failures = append(failures, fmt.Sprintf("Execution ended as %s", workflowExecution.Status))
+	}
+
+	return failures
+}
+
+// Starts a dry run for the test
+func startWorkflowTest(workflow Workflow, workflowTest WorkflowTest) (WorkflowExecution, string, error) {
+	executionBody, err := json.Marshal(ExecutionRequest{
+		ExecutionArgument: workflowTest.Argument,
+		ExecutionSource:   "test",
+		DryRun:            true,
+		Mocks:             workflowTest.Mocks,
+	})
+	if err != nil {
+		return WorkflowExecution{}, "Failed making test request", err
+	}
+
+	executionRequest, err := http.NewRequest("POST", fmt.Sprintf("/api/v1/workflows/%s/execute", workflow.ID), bytes.NewReader(executionBody))
+	if err != nil {
+		return WorkflowExecution{}, "Failed making test request", err
+	}
+
+	return handleExecution(workflow.ID, workflow, executionRequest)
+}
+
+// Runs every test at the same time and waits for them to finish
+func runWorkflowTests(ctx context.Context, workflow Workflow, workflowTests []WorkflowTest) []TestResult {
+	testResults := []TestResult{}
+	for _, workflowTest := range workflowTests {
+		testResult := TestResult{
+			Id:       workflowTest.Id,
+			Name:     workflowTest.Name,
+			Failures: []string{},
+		}
+
+		workflowExecution, executionResp, err := startWorkflowTest(workflow, workflowTest)
+		if err != nil {
+			log.Printf("Failed starting test %s: %s", workflowTest.Id, err)
+			testResult.Failures = append(testResult.Failures, fmt.Sprintf("Failed starting: %s", executionResp))
+		} else {
+			testResult.ExecutionId = workflowExecution.ExecutionId
+		}
+
+		testResults = append(testResults, testResult)
+	}
+
+	timeout := time.Now().Add(time.Duration(maxTestDuration) * time.Second)
+	for {
+		running := 0
+		for index, testResult := range testResults {
+			if len(testResult.ExecutionId) == 0 || len(testResult.Status) > 0 {
+				continue
+			}
+
+			workflowExecution, err := getWorkflowExecution(ctx, testResult.ExecutionId)
+			if err != nil || workflowExecution.Status == "EXECUTING" {
+				running += 1
+				continue
+			}
+
+			testResults[index].Status = workflowExecution.Status
+			testResults[index].Failures = getTestFailures(*workflowExecution, workflowTests[index])
+		}
+
+		if running == 0 || time.Now().After(timeout) {
+			break
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+
+	for index, testResult := range testResults {
+		if len(testResult.ExecutionId) > 0 && len(testResult.Status) == 0 {
+			testResults[index].Status = "ABORTED"
+			workflowExecution, err := getWorkflowExecution(ctx, testResult.ExecutionId)
+			if err == nil {
+				_, err = stopExecution(ctx, workflowExecution)
+			}
+
+			if err != nil {
+				log.Printf("Failed aborting test execution %s: %s", testResult.ExecutionId, err)
+			}
+
+			testResults[index].Failures = append(testResults[index].Failures, fmt.Sprintf("Didn't finish in %d seconds", maxTestDuration))
+		}
+
+		testResults[index].Passed = len(testResults[index].Failures) == 0
+	}
+
+	return testResults
+}
+
+// GET /api/v1/workflows/{id}/tests
+func handleGetWorkflowTests(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in get workflow tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting workflow for tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	workflowTests, err := getWorkflowTests(ctx, workflow.ID)
+	if err != nil {
+		log.Printf("Failed getting tests for %s: %s", workflow.ID, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting tests"}`))
+		return
+	}
+
+	newjson, err := json.Marshal(workflowTests)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking tests"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// POST /api/v1/workflows/{id}/tests - new test, or updates the one with the same id
+func handleSetWorkflowTest(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in set workflow test: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting workflow for tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var workflowTest WorkflowTest
+	err = json.Unmarshal(body, &workflowTest)
+	if err != nil {
+		log.Printf("Failed unmarshalling workflow test: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling data"}`))
+		return
+	}
+
+	err = checkWorkflowTest(workflowTest)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	var oldTest *WorkflowTest
+	if len(workflowTest.Id) > 0 {
+		oldTest, err = getWorkflowTest(ctx, workflowTest.Id)
+		if err != nil || oldTest.WorkflowId != workflow.ID {
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Test %s doesn't exist"}`, workflowTest.Id)))
+			return
+		}
+
+		workflowTest.Created = oldTest.Created
+	} else {
+		workflowTest.Id = uuid.NewV4().String()
+		workflowTest.Created = time.Now().Unix()
+	}
+
+	workflowTest.WorkflowId = workflow.ID
+	workflowTest.OrgId = workflow.OrgId
+	workflowTest.Edited = time.Now().Unix()
+	err = setWorkflowTest(ctx, workflowTest)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving the test"}`))
+		return
+	}
+
+	if oldTest != nil {
+		addAuditLog(ctx, request, user, "workflow.test.update", "workflow", workflow.ID, oldTest, workflowTest)
+	} else {
+		addAuditLog(ctx, request, user, "workflow.test.create", "workflow", workflow.ID, nil, workflowTest)
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, workflowTest.Id)))
+}
+
+// DELETE /api/v1/workflows/{id}/tests/{test}
+func handleDeleteWorkflowTest(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in delete workflow test: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	location := strings.Split(request.URL.Path, "/")
+	workflow, err := getRevisionWorkflow(ctx, user, location)
+	if err != nil || len(location) < 7 {
+		log.Printf("Failed getting workflow for tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	workflowTest, err := getWorkflowTest(ctx, location[6])
+	if err != nil || workflowTest.WorkflowId != workflow.ID {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Test %s doesn't exist"}`, location[6])))
+		return
+	}
+
+	err = dbclient.Delete(ctx, datastore.NameKey("workflow_tests", workflowTest.Id, nil))
+	if err != nil {
+		log.Printf("Failed deleting test %s: %s", workflowTest.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed deleting the test"}`))
+		return
+	}
+
+	addAuditLog(ctx, request, user, "workflow.test.delete", "workflow", workflow.ID, workflowTest, nil)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// POST /api/v1/workflows/{id}/tests/run - runs every test against the current
+// workflow. 200 if they all passed, 400 otherwise
+func handleRunWorkflowTests(resp http.ResponseWriter, request *http.Request) {
+	cors := handleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := handleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in run workflow tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := context.Background()
+	workflow, err := getRevisionWorkflow(ctx, user, strings.Split(request.URL.Path, "/"))
+	if err != nil {
+		log.Printf("Failed getting workflow for tests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	workflowTests, err := getWorkflowTests(ctx, workflow.ID)
+	if err != nil {
+		log.Printf("Failed getting tests for %s: %s", workflow.ID, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting tests"}`))
+		return
+	}
+
+	if len(workflowTests) == 0 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "The workflow has no tests"}`))
+		return
+	}
+
+	testResults := runWorkflowTests(ctx, *workflow, workflowTests)
+	passed := 0
+	for _, testResult := range testResults {
+		if testResult.Passed {
+			passed += 1
+		}
+	}
+
+	newjson, err := json.Marshal(testResults)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking test results"}`))
+		return
+	}
+
+	log.Printf("[INFO] %d of %d tests passed for workflow %s", passed, len(testResults), workflow.ID)
+	if passed == len(testResults) {
+		resp.WriteHeader(200)
+	} else {
+		resp.WriteHeader(400)
+	}
+
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "passed": %t, "total": %d, "failed": %d, "tests": %s}`, passed == len(testResults), len(testResults), len(testResults)-passed, string(newjson))))
+}
@@ -224,9 +224,9 @@ const Admin = (props) => {
 		})
     .then((responseJson) => {
 			if (!responseJson.success && responseJson.reason !== undefined) {
-				alert.error("Failed to deactivate user: "+responseJson.reason)
+				alert.error("Failed to remove user from the org: "+responseJson.reason)
 			} else {
-				alert.success("Deactivated user "+data.id)
+				alert.success("Removed user "+data.id+" from the org")
 			}
 		})
 
@@ -636,7 +636,7 @@ const Admin = (props) => {
 					color="primary"
 					onClick={() => deleteUser(selectedUser)}
 				>
-					{selectedUser.active ? "Deactivate" : "Activate"}
+					Remove from org
 				</Button>
 				<Button
 					style={{}}
@@ -700,7 +700,7 @@ const Admin = (props) => {
 					color="primary"
 					onClick={() => deleteUser(selectedUser)}
 				>
-					{selectedUser.active ? "Deactivate" : "Activate"}
+					Remove from org
 				</Button>
 				<Button
 					style={{}}
@@ -15,6 +15,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,6 +45,9 @@ var environment = os.Getenv("ENVIRONMENT_NAME")
 var dockerApiVersion = os.Getenv("DOCKER_API_VERSION")
 var runningMode = strings.ToLower(os.Getenv("RUNNING_MODE"))
 
+// Workers this Orborus runs at the same time. 0 is no limit
+var maxWorkers = 0
+
 type ExecutionRequestWrapper struct {
 	Data []ExecutionRequest `json:"data"`
 }
@@ -54,6 +59,7 @@ type ExecutionRequest struct {
 	Authorization     string `json:"authorization"`
 	Status            string `json:"status"`
 	Type              string `json:"type"`
+	Priority          int    `json:"priority"`
 }
 
 var dockercli *dockerclient.Client
@@ -105,7 +111,7 @@ func getThisContainerId() {
 }
 
 // Deploys the internal worker whenever something happens
-func deployWorker(image string, identifier string, env []string) {
+func deployWorker(image string, identifier string, env []string) error {
 	// Binds is the actual "-v" volume.
 	hostConfig := &container.HostConfig{
 		LogConfig: container.LogConfig{
@@ -139,15 +145,38 @@ func deployWorker(image string, identifier string, env []string) {
 		identifier,
 	)
 
+	if err != nil {
+		// Started before, but the queue wasn't confirmed
+		if strings.Contains(err.Error(), "is already in use") {
+			stats, inspectErr := dockercli.ContainerInspect(context.Background(), identifier)
+			if inspectErr == nil && stats.ContainerJSONBase.State.Status == "running" {
+				log.Printf("[INFO] Worker %s already exists", identifier)
+				return nil
+			}
+
+			// Left over from a paused execution that was resumed
+			log.Printf("[INFO] Worker %s exists but isn't running. Will reset", identifier)
+			stopWorker(identifier)
+			cont, err = dockercli.ContainerCreate(
+				context.Background(),
+				config,
+				hostConfig,
+				nil,
+				nil,
+				identifier,
+			)
+		}
+	}
+
 	if err != nil {
 		log.Println(err)
-		return
+		return err
 	}
 
 	err = dockercli.ContainerStart(context.Background(), cont.ID, types.ContainerStartOptions{})
 	if err != nil {
 		log.Printf("[ERROR] Failed to start container in environment %s: %s", environment, err)
-		return
+		return err
 
 		//stats, err := cli.ContainerInspect(context.Background(), containerName)
 		//if err != nil {
@@ -174,7 +203,50 @@ func deployWorker(image string, identifier string, env []string) {
 		log.Printf("[INFO] Container %s was created under environment %s", cont.ID, environment)
 	}
 
-	return
+	return nil
+}
+
+// Workers that haven't exited yet
+func getRunningWorkers() (int, error) {
+	containers, err := dockercli.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	running := 0
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if strings.HasPrefix(name, "/worker-") {
+				running += 1
+				break
+			}
+		}
+	}
+
+	return running, nil
+}
+
+// Removes the worker and app containers of an aborted execution. Their
+// names all end with the execution ID
+func stopExecution(executionId string) error {
+	containers, err := dockercli.ContainerList(context.Background(), types.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if strings.Contains(name, executionId) {
+				log.Printf("[INFO] Removing %s of aborted execution %s", name, executionId)
+				stopWorker(container.ID)
+				break
+			}
+		}
+	}
+
+	return nil
 }
 
 func stopWorker(containername string) error {
@@ -248,7 +320,7 @@ func main() {
 	}
 
 	if orgId == "" {
-		log.Printf("[ERROR] Org not defined. Set variable ORG_ID based on your org")
+		log.Printf("[ERROR] Org not defined. Set variable ORG_ID to the ID of your org")
 		os.Exit(3)
 	}
 
@@ -256,6 +328,17 @@ func main() {
 	httpProxy := os.Getenv("HTTP_PROXY")
 	httpsProxy := os.Getenv("HTTPS_PROXY")
 
+	if len(os.Getenv("SHUFFLE_MAX_WORKERS")) > 0 {
+		var err error
+		maxWorkers, err = strconv.Atoi(os.Getenv("SHUFFLE_MAX_WORKERS"))
+		if err != nil || maxWorkers < 0 {
+			log.Printf("[ERROR] SHUFFLE_MAX_WORKERS has to be a number")
+			os.Exit(3)
+		}
+
+		log.Printf("[INFO] Running at most %d workers at the same time", maxWorkers)
+	}
+
 	if environment == "" {
 		environment = "onprem"
 		log.Printf("[INFO] Defaulting to environment name %s. Set environment variable ENVIRONMENT_NAME to change. This should be the same as in the frontend action.", environment)
@@ -307,6 +390,7 @@ func main() {
 	zombiecounter := 0
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Org-Id", orgId)
+	req.Header.Add("Environment", environment)
 	log.Printf("[INFO] Waiting for executions at %s", fullUrl)
 	hasStarted := false
 	for {
@@ -374,9 +458,47 @@ func main() {
 			continue
 		}
 
+		// The backend sorts them too, but older backends don't
+		sort.SliceStable(executionRequests.Data, func(i, j int) bool {
+			return executionRequests.Data[i].Priority > executionRequests.Data[j].Priority
+		})
+
+		runningWorkers := 0
+		if maxWorkers > 0 {
+			runningWorkers, err = getRunningWorkers()
+			if err != nil {
+				log.Printf("[WARNING] Failed counting running workers: %s", err)
+			}
+		}
+
 		// New, abortable version. Should check executionid and remove everything else
+		// Executions that aren't started stay in the queue for the next round
 		var toBeRemoved ExecutionRequestWrapper
 		for _, execution := range executionRequests.Data {
+			if execution.Status != "ABORT" {
+				continue
+			}
+
+			err = stopExecution(execution.ExecutionId)
+			if err != nil {
+				log.Printf("[ERROR] Failed stopping aborted execution %s. Trying again later: %s", execution.ExecutionId, err)
+				continue
+			}
+
+			log.Printf("[INFO] Stopped aborted execution %s", execution.ExecutionId)
+			toBeRemoved.Data = append(toBeRemoved.Data, execution)
+		}
+
+		for _, execution := range executionRequests.Data {
+			if execution.Status == "ABORT" {
+				continue
+			}
+
+			if maxWorkers > 0 && runningWorkers >= maxWorkers {
+				log.Printf("[INFO] %d workers are running. Waiting before starting more", runningWorkers)
+				break
+			}
+
 			if len(execution.ExecutionArgument) > 0 {
 				log.Printf("[INFO] Argument: %#v", execution.ExecutionArgument)
 			}
@@ -386,8 +508,8 @@ func main() {
 				continue
 			}
 
-			if execution.Status == "ABORT" || execution.Status == "FAILED" {
-				log.Printf("[INFO] Executionstatus issue: ", execution.Status)
+			if execution.Status == "FAILED" {
+				log.Printf("[INFO] Executionstatus issue: %s", execution.Status)
 			}
 			// Now, how do I execute this one?
 			// FIXME - if error, check the status of the running one. If it's bad, send data back.
@@ -408,10 +530,15 @@ func main() {
 				env = append(env, fmt.Sprintf("DOCKER_API_VERSION=%s", dockerApiVersion))
 			}
 
-			go deployWorker(workerImage, containerName, env)
+			err = deployWorker(workerImage, containerName, env)
+			if err != nil {
+				log.Printf("[ERROR] Failed deploying worker for %s. Trying again later: %s", execution.ExecutionId, err)
+				continue
+			}
 
 			log.Printf("[INFO] %s is deployed and to be removed from queue.", execution.ExecutionId)
 			zombiecounter += 1
+			runningWorkers += 1
 			toBeRemoved.Data = append(toBeRemoved.Data, execution)
 		}
 
@@ -440,6 +567,7 @@ func main() {
 
 			result.Header.Add("Content-Type", "application/json")
 			result.Header.Add("Org-Id", orgId)
+			result.Header.Add("Environment", environment)
 
 			resultResp, err := client.Do(result)
 			if err != nil {
@@ -461,10 +589,8 @@ func main() {
 			// FIXME - remove these
 			//log.Println(string(body))
 			//log.Println(resultResp)
-			if len(toBeRemoved.Data) == len(executionRequests.Data) {
-				//log.Println("Should remove ALL!")
-			} else {
-				log.Printf("[INFO] NOT IMPLEMENTED: Should remove %d workflows from backend because they're executed!", len(toBeRemoved.Data))
+			if len(toBeRemoved.Data) != len(executionRequests.Data) {
+				log.Printf("[INFO] Handled %d of %d queued executions. The rest stay in the queue", len(toBeRemoved.Data), len(executionRequests.Data))
 			}
 		}
 
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -195,12 +197,19 @@ type WorkflowExecution struct {
 	Locations          []string       `json:"locations" datastore:"locations"`
 	Workflow           Workflow       `json:"workflow" datastore:"workflow,noindex"`
 	Results            []ActionResult `json:"results" datastore:"results,noindex"`
+	ParentExecutionId  string         `json:"parent_execution_id,omitempty" datastore:"parent_execution_id"`
+	ParentActionId     string         `json:"parent_action_id,omitempty" datastore:"parent_action_id"`
+	DryRun             bool           `json:"dry_run" datastore:"dry_run"`
+	Mocks              []ActionMock   `json:"mocks,omitempty" datastore:"mocks,noindex"`
 	ExecutionVariables []struct {
 		Description string `json:"description" datastore:"description"`
 		ID          string `json:"id" datastore:"id"`
 		Name        string `json:"name" datastore:"name"`
 		Value       string `json:"value" datastore:"value"`
 	} `json:"execution_variables,omitempty" datastore:"execution_variables,omitempty"`
+
+	// $error for nodes started by an error branch. Only used in the worker
+	ErrorInput string `json:"-"`
 }
 
 // This is for the nodes in a workflow, NOT the app action itself.
@@ -231,6 +240,9 @@ type Action struct {
 		Y float64 `json:"y" datastore:"y"`
 	} `json:"position"`
 	Priority         int    `json:"priority" datastore:"priority"`
+	JoinMode         string `json:"join_mode" datastore:"join_mode"`
+	JoinCount        int    `json:"join_count" datastore:"join_count"`
+	Timeout          int    `json:"timeout" datastore:"timeout"`
 	AuthenticationId string `json:"authentication_id" datastore:"authentication_id"`
 	Example          string `json:"example" datastore:"example"`
 	AuthNotRequired  bool   `json:"auth_not_required" datastore:"auth_not_required" yaml:"auth_not_required"`
@@ -271,10 +283,27 @@ type Branch struct {
 }
 
 // Same format for a lot of stuff
+// Conditions in the same group all have to pass. Any passing group is enough
 type Condition struct {
 	Condition   WorkflowAppActionParameter `json:"condition" datastore:"condition"`
 	Source      WorkflowAppActionParameter `json:"source" datastore:"source"`
 	Destination WorkflowAppActionParameter `json:"destination" datastore:"destination"`
+	Group       int                        `json:"group" datastore:"group"`
+}
+
+// What the worker decided for a branch into a node
+type BranchDecision struct {
+	BranchId string `json:"branch_id" datastore:"branch_id"`
+	SourceId string `json:"source_id" datastore:"source_id"`
+	Active   bool   `json:"active" datastore:"active"`
+	Reason   string `json:"reason" datastore:"reason,noindex"`
+}
+
+// What an action returns in a dry run instead of running the app
+type ActionMock struct {
+	ActionId string `json:"action_id" datastore:"action_id"`
+	Status   string `json:"status" datastore:"status"`
+	Result   string `json:"result" datastore:"result,noindex"`
 }
 
 type Schedule struct {
@@ -290,8 +319,9 @@ type Workflow struct {
 	Triggers      []Trigger  `json:"triggers" datastore:"triggers,noindex"`
 	Schedules     []Schedule `json:"schedules" datastore:"schedules,noindex"`
 	Configuration struct {
-		ExitOnError  bool `json:"exit_on_error" datastore:"exit_on_error"`
-		StartFromTop bool `json:"start_from_top" datastore:"start_from_top"`
+		ExitOnError  bool   `json:"exit_on_error" datastore:"exit_on_error"`
+		StartFromTop bool   `json:"start_from_top" datastore:"start_from_top"`
+		ErrorStatus  string `json:"error_status" datastore:"error_status"`
 	} `json:"configuration,omitempty" datastore:"configuration"`
 	Errors            []string `json:"errors,omitempty" datastore:"errors"`
 	Tags              []string `json:"tags,omitempty" datastore:"tags"`
@@ -318,212 +348,1217 @@ type Workflow struct {
 	} `json:"execution_variables,omitempty" datastore:"execution_variables"`
 }
 
-type ActionResult struct {
-	Action        Action `json:"action" datastore:"action"`
-	ExecutionId   string `json:"execution_id" datastore:"execution_id"`
-	Authorization string `json:"authorization" datastore:"authorization"`
-	Result        string `json:"result" datastore:"result,noindex"`
-	StartedAt     int64  `json:"started_at" datastore:"started_at"`
-	CompletedAt   int64  `json:"completed_at" datastore:"completed_at"`
-	Status        string `json:"status" datastore:"status"`
+type ActionResult struct {
+	Action        Action `json:"action" datastore:"action"`
+	ExecutionId   string `json:"execution_id" datastore:"execution_id"`
+	Authorization string `json:"authorization" datastore:"authorization"`
+	Result        string `json:"result" datastore:"result,noindex"`
+	StartedAt     int64  `json:"started_at" datastore:"started_at"`
+	CompletedAt   int64  `json:"completed_at" datastore:"completed_at"`
+	Status        string `json:"status" datastore:"status"`
+
+	Decisions []BranchDecision `json:"decisions,omitempty" datastore:"decisions,noindex"`
+}
+
+type Authentication struct {
+	Required   bool                   `json:"required" datastore:"required" yaml:"required" `
+	Parameters []AuthenticationParams `json:"parameters" datastore:"parameters" yaml:"parameters"`
+}
+
+type AuthenticationParams struct {
+	Description string           `json:"description" datastore:"description" yaml:"description"`
+	ID          string           `json:"id" datastore:"id" yaml:"id"`
+	Name        string           `json:"name" datastore:"name" yaml:"name"`
+	Example     string           `json:"example" datastore:"example" yaml:"example"`
+	Value       string           `json:"value,omitempty" datastore:"value" yaml:"value"`
+	Multiline   bool             `json:"multiline" datastore:"multiline" yaml:"multiline"`
+	Required    bool             `json:"required" datastore:"required" yaml:"required"`
+	In          string           `json:"in" datastore:"in" yaml:"in"`
+	Schema      SchemaDefinition `json:"schema" datastore:"schema" yaml:"schema"`
+	Scheme      string           `json:"scheme" datastore:"scheme" yaml:"scheme"` // Deprecated
+}
+
+type AuthenticationStore struct {
+	Key   string `json:"key" datastore:"key"`
+	Value string `json:"value" datastore:"value"`
+}
+
+type ExecutionRequestWrapper struct {
+	Data []ExecutionRequest `json:"data"`
+}
+
+// removes every container except itself (worker)
+func shutdown(executionId, workflowId string) {
+	dockercli, err := dockerclient.NewEnvClient()
+	if err != nil {
+		log.Printf("[ERROR] Unable to create docker client: %s", err)
+		os.Exit(3)
+	}
+
+	containerOptions := types.ContainerListOptions{
+		All: true,
+	}
+
+	containers, err := dockercli.ContainerList(context.Background(), containerOptions)
+	if err != nil {
+		panic(err)
+	}
+	_ = containers
+
+	// Orborus removes the worker itself
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if strings.Contains(name, executionId) && !strings.HasPrefix(name, "/worker-") {
+				err = removeContainer(container.ID)
+				if err != nil {
+					log.Printf("Failed removing %s before shutdown.", name)
+				}
+
+				break
+			}
+		}
+	}
+
+	// Nothing is aborted here. The backend ends executions from their
+	// results, and the execution's authorization isn't an API key, so an
+	// abort call would only count as a failed login for Orborus' IP
+
+	log.Printf("[INFO] Finished shutdown.")
+	os.Exit(3)
+}
+
+// Deploys the internal worker whenever something happens
+func deployApp(cli *dockerclient.Client, image string, identifier string, env []string) error {
+	// form basic hostConfig
+	hostConfig := &container.HostConfig{
+		LogConfig: container.LogConfig{
+			Type:   "json-file",
+			Config: map[string]string{},
+		},
+	}
+
+	// form container id and use it as network source if it's not empty
+	if containerId != "" {
+		hostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", containerId))
+	} else {
+		log.Printf("[WARNING] Empty self container id, continue without NetworkMode")
+	}
+
+	config := &container.Config{
+		Image: image,
+		Env:   env,
+	}
+
+	cont, err := cli.ContainerCreate(
+		context.Background(),
+		config,
+		hostConfig,
+		nil,
+		nil,
+		identifier,
+	)
+
+	if err != nil {
+		log.Printf("Container error: %s", err)
+		return err
+	}
+
+	cli.ContainerStart(context.Background(), cont.ID, types.ContainerStartOptions{})
+	log.Printf("[INFO] Container %s is created", cont.ID)
+	return nil
+}
+
+func removeContainer(containername string) error {
+	ctx := context.Background()
+
+	cli, err := dockerclient.NewEnvClient()
+	if err != nil {
+		log.Printf("[INFO] Unable to create docker client: %s", err)
+		return err
+	}
+
+	if err := cli.ContainerStop(ctx, containername, nil); err != nil {
+		log.Printf("Unable to stop container %s - running removal anyway, just in case: %s", containername, err)
+	}
+
+	removeOptions := types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	}
+
+	if err := cli.ContainerRemove(ctx, containername, removeOptions); err != nil {
+		log.Printf("Unable to remove container: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Sends a result the same way the apps do
+func sendResult(client *http.Client, actionResult ActionResult) error {
+	data, err := json.Marshal(actionResult)
+	if err != nil {
+		return err
+	}
+
+	fullUrl := fmt.Sprintf("%s/api/v1/streams", baseUrl)
+	req, err := http.NewRequest(
+		"POST",
+		fullUrl,
+		bytes.NewBuffer(data),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	newresp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(newresp.Body)
+	if err != nil {
+		return err
+	}
+
+	if newresp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("Bad status %d for result: %s", newresp.StatusCode, string(body)))
+	}
+
+	return nil
+}
+
+// Matches with space in the first part, but not in subsequent parts. Same as the app sdk
+var parameterPattern = regexp.MustCompile(`([$]{1}([a-zA-Z0-9 _-]+\.?){1}([a-zA-Z0-9#_-]+\.?){0,})`)
+
+// Walks the path in some JSON. # means every item in a list
+func getJsonPath(data interface{}, path []string) interface{} {
+	for index, value := range path {
+		if len(value) == 0 {
+			return data
+		}
+
+		if value == "#" {
+			list, ok := data.([]interface{})
+			if !ok {
+				return data
+			}
+
+			newList := []interface{}{}
+			for _, item := range list {
+				newList = append(newList, getJsonPath(item, path[index+1:]))
+			}
+
+			return newList
+		}
+
+		jsonMap, ok := data.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+
+		inner, ok := jsonMap[value]
+		if !ok {
+			return fmt.Sprintf("KeyError: Couldn't find key: %s", value)
+		}
+
+		// JSON inside a string
+		if innerString, ok := inner.(string); ok {
+			var parsed interface{}
+			err := json.Unmarshal([]byte(innerString), &parsed)
+			if err != nil {
+				return innerString
+			}
+
+			inner = parsed
+		}
+
+		data = inner
+	}
+
+	return data
+}
+
+// Turns a printed Python dict or list into JSON. Only the quotes around
+// strings change, so apostrophes in the strings are kept
+func getPythonJson(input string) string {
+	output := strings.Builder{}
+	quote := rune(0)
+	escaped := false
+	word := strings.Builder{}
+	flushWord := func() {
+		switch word.String() {
+		case "True":
+			output.WriteString("true")
+		case "False":
+			output.WriteString("false")
+		case "None":
+			output.WriteString("null")
+		default:
+			output.WriteString(word.String())
+		}
+
+		word.Reset()
+	}
+
+	for _, char := range input {
+		if quote == 0 {
+			if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') {
+				word.WriteRune(char)
+				continue
+			}
+
+			flushWord()
+			if char == '\'' || char == '"' {
+				quote = char
+				output.WriteRune('"')
+				continue
+			}
+
+			output.WriteRune(char)
+			continue
+		}
+
+		if escaped {
+			escaped = false
+			if char == '\'' {
+				output.WriteRune(char)
+			} else {
+				output.WriteRune('\\')
+				output.WriteRune(char)
+			}
+
+			continue
+		}
+
+		if char == '\\' {
+			escaped = true
+		} else if char == quote {
+			quote = 0
+			output.WriteRune('"')
+		} else if char == '"' {
+			output.WriteString("\\\"")
+		} else {
+			output.WriteRune(char)
+		}
+	}
+
+	flushWord()
+	return output.String()
+}
+
+// Finds the value of e.g. $exec.field, $node_label.field.#.id or $variable
+func getJsonValue(workflowExecution WorkflowExecution, input string) interface{} {
+	parsersplit := strings.Split(input, ".")
+	actionname := strings.ToLower(strings.Replace(strings.TrimPrefix(parsersplit[0], "$"), " ", "_", -1))
+
+	baseresult := ""
+	if actionname == "exec" {
+		baseresult = workflowExecution.ExecutionArgument
+	} else if actionname == "error" {
+		baseresult = workflowExecution.ErrorInput
+	} else {
+		for _, result := range workflowExecution.Results {
+			if strings.ToLower(strings.Replace(result.Action.Label, " ", "_", -1)) == actionname {
+				baseresult = result.Result
+				break
+			}
+		}
+
+		if len(baseresult) == 0 {
+			for _, variable := range workflowExecution.Workflow.WorkflowVariables {
+				if strings.ToLower(strings.Replace(variable.Name, " ", "_", -1)) == actionname {
+					baseresult = variable.Value
+					break
+				}
+			}
+		}
+
+		if len(baseresult) == 0 {
+			for _, variable := range workflowExecution.ExecutionVariables {
+				if strings.ToLower(strings.Replace(variable.Name, " ", "_", -1)) == actionname {
+					baseresult = variable.Value
+					break
+				}
+			}
+		}
+	}
+
+	if len(baseresult) == 0 || len(parsersplit) == 1 {
+		return baseresult
+	}
+
+	var basejson interface{}
+	err := json.Unmarshal([]byte(baseresult), &basejson)
+	if err != nil {
+		// Python dicts from apps
+		err = json.Unmarshal([]byte(getPythonJson(baseresult)), &basejson)
+		if err != nil {
+			return baseresult
+		}
+	}
+
+	return getJsonPath(basejson, parsersplit[1:])
+}
+
+func getValueString(value interface{}) string {
+	if stringValue, ok := value.(string); ok {
+		return stringValue
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(data)
+}
+
+// Gets the actual value of a parameter, like the app sdk does before running an action
+func parseParameter(workflowExecution WorkflowExecution, param WorkflowAppActionParameter) string {
+	if param.Variant == "WORKFLOW_VARIABLE" {
+		for _, variable := range workflowExecution.Workflow.WorkflowVariables {
+			if variable.Name == param.ActionField {
+				return variable.Value
+			}
+		}
+
+		for _, variable := range workflowExecution.ExecutionVariables {
+			if variable.Name == param.ActionField {
+				return variable.Value
+			}
+		}
+
+		return param.Value
+	}
+
+	if param.Variant == "ACTION_RESULT" {
+		fullname := "$" + param.ActionField
+		if param.ActionField == "Execution Argument" {
+			fullname = "$exec"
+		}
+
+		if strings.HasPrefix(param.Value, "$.") {
+			fullname += param.Value[1:]
+		}
+
+		return getValueString(getJsonValue(workflowExecution, fullname))
+	}
+
+	value := param.Value
+	for _, match := range parameterPattern.FindAllString(param.Value, -1) {
+		value = strings.Replace(value, match, getValueString(getJsonValue(workflowExecution, match)), -1)
+	}
+
+	return value
+}
+
+// Posts to the backend's stream API and returns the body
+func postStream(client *http.Client, path string, data interface{}) ([]byte, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fullUrl := fmt.Sprintf("%s/api/v1/streams/%s", baseUrl, path)
+	req, err := http.NewRequest(
+		"POST",
+		fullUrl,
+		bytes.NewBuffer(body),
+	)
+
+	if err != nil {
+		return []byte{}, err
+	}
+
+	newresp, err := client.Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	respBody, err := ioutil.ReadAll(newresp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if newresp.StatusCode != 200 {
+		return respBody, errors.New(fmt.Sprintf("Bad status %d", newresp.StatusCode))
+	}
+
+	return respBody, nil
+}
+
+// Nodes that wait for other executions are EXECUTING until the backend
+// sets their result. Sent first so a fast child can't finish before it
+func startWaitingNode(client *http.Client, workflowExecution WorkflowExecution, action Action) (ActionResult, error) {
+	actionResult := ActionResult{
+		Action:        action,
+		ExecutionId:   workflowExecution.ExecutionId,
+		Authorization: workflowExecution.Authorization,
+		Result:        "",
+		StartedAt:     int64(time.Now().Unix()),
+		Status:        "EXECUTING",
+	}
+
+	return actionResult, sendResult(client, actionResult)
+}
+
+func finishNode(client *http.Client, actionResult ActionResult, status, result string) {
+	actionResult.Status = status
+	actionResult.Result = result
+	actionResult.CompletedAt = int64(time.Now().Unix())
+
+	err := sendResult(client, actionResult)
+	if err != nil {
+		log.Printf("[ERROR] Failed sending result for %s: %s", actionResult.Action.Label, err)
+	}
+}
+
+// Starts another workflow with an argument from this execution. If it waits,
+// the node stays EXECUTING until the backend gives it the subflow's result
+func runSubflow(client *http.Client, workflowExecution WorkflowExecution, action Action) {
+	workflowId := ""
+	argument := ""
+	wait := false
+	for _, param := range action.Parameters {
+		if param.Name == "workflow_id" {
+			workflowId = parseParameter(workflowExecution, param)
+		} else if param.Name == "argument" {
+			argument = parseParameter(workflowExecution, param)
+		} else if param.Name == "wait" {
+			wait = strings.ToLower(parseParameter(workflowExecution, param)) == "true"
+		}
+	}
+
+	actionResult, err := startWaitingNode(client, workflowExecution, action)
+	if err != nil {
+		log.Printf("[ERROR] Failed starting subflow node %s: %s", action.Label, err)
+		return
+	}
+
+	body, err := postStream(client, "subflow", map[string]string{
+		"execution_id":  workflowExecution.ExecutionId,
+		"authorization": workflowExecution.Authorization,
+		"action_id":     action.ID,
+		"workflow_id":   workflowId,
+		"argument":      argument,
+	})
+
+	if err != nil {
+		log.Printf("[ERROR] Failed starting subflow %s from %s: %s", workflowId, action.Label, err)
+		finishNode(client, actionResult, "FAILURE", fmt.Sprintf(`{"success": false, "reason": "Failed starting subflow %s", "details": %s}`, workflowId, strconv.Quote(string(body))))
+	} else if !wait {
+		finishNode(client, actionResult, "SUCCESS", string(body))
+	}
+}
+
+func isWaitingNode(action Action) bool {
+	return action.AppID == builtinAppId && (action.Name == "run_subflow" || action.Name == "run_foreach" || action.Name == "approval")
+}
+
+// True when every running node waits for other executions and nothing else
+// can start until they're done. Timeouts are kept by the worker, so nodes
+// with one keep it running
+func canRelease(workflowExecution WorkflowExecution) bool {
+	waiting := false
+	for _, result := range workflowExecution.Results {
+		if result.Status != "EXECUTING" {
+			continue
+		}
+
+		if !isWaitingNode(result.Action) || getAction(workflowExecution, result.Action.ID).Timeout > 0 {
+			return false
+		}
+
+		waiting = true
+	}
+
+	if !waiting {
+		return false
+	}
+
+	for _, action := range workflowExecution.Workflow.Actions {
+		if action.Environment != environment || getResult(workflowExecution, action.ID).Action.ID == action.ID || isLoopBody(workflowExecution, action.ID) {
+			continue
+		}
+
+		decisions, join := getBranchDecisions(workflowExecution, action)
+		if len(decisions) > 0 && join != "wait" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Asks the backend to queue the execution again when a waiting node is done
+func releaseExecution(client *http.Client, workflowExecution WorkflowExecution) error {
+	_, err := postStream(client, "release", map[string]string{
+		"execution_id":  workflowExecution.ExecutionId,
+		"authorization": workflowExecution.Authorization,
+		"environment":   environment,
+	})
+
+	return err
+}
+
+// Waits for someone to approve or deny. The backend gives the node its
+// result when they do, or when the approval expires
+func runApproval(client *http.Client, workflowExecution WorkflowExecution, action Action) {
+	request := map[string]string{
+		"execution_id":  workflowExecution.ExecutionId,
+		"authorization": workflowExecution.Authorization,
+		"action_id":     action.ID,
+	}
+
+	for _, param := range action.Parameters {
+		if param.Name == "message" || param.Name == "approvers" || param.Name == "fields" || param.Name == "expiry" || param.Name == "default" {
+			request[param.Name] = parseParameter(workflowExecution, param)
+		}
+	}
+
+	actionResult, err := startWaitingNode(client, workflowExecution, action)
+	if err != nil {
+		log.Printf("[ERROR] Failed starting approval node %s: %s", action.Label, err)
+		return
+	}
+
+	body, err := postStream(client, "approval", request)
+	if err != nil {
+		log.Printf("[ERROR] Failed starting approval for %s: %s", action.Label, err)
+		finishNode(client, actionResult, "FAILURE", fmt.Sprintf(`{"success": false, "reason": "Failed starting approval", "details": %s}`, strconv.Quote(string(body))))
+		return
+	}
+
+	// The links go in the node's result so they can be found while it waits
+	approval := struct {
+		ApprovalId string `json:"approval_id"`
+		Status     string `json:"status"`
+		Expires    int64  `json:"expires"`
+		ApproveUrl string `json:"approve_url"`
+		DenyUrl    string `json:"deny_url"`
+	}{}
+	err = json.Unmarshal(body, &approval)
+	if err != nil {
+		log.Printf("[ERROR] Failed parsing approval for %s: %s", action.Label, err)
+		return
+	}
+
+	result, err := json.Marshal(approval)
+	if err != nil {
+		log.Printf("[ERROR] Failed parsing approval for %s: %s", action.Label, err)
+		return
+	}
+
+	actionResult.Result = string(result)
+	err = sendResult(client, actionResult)
+	if err != nil {
+		log.Printf("[WARNING] Failed sending approval links for %s: %s", action.Label, err)
+	}
+
+	log.Printf("Waiting for approval %s of %s", approval.ApprovalId, action.Label)
+}
+
+// A list is a JSON list or one item per line
+func getListValue(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+
+	stringValue := strings.TrimSpace(getValueString(value))
+	if len(stringValue) == 0 {
+		return []interface{}{}
+	}
+
+	var list []interface{}
+	err := json.Unmarshal([]byte(stringValue), &list)
+	if err == nil {
+		return list
+	}
+
+	list = []interface{}{}
+	for _, line := range strings.Split(stringValue, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			list = append(list, line)
+		}
+	}
+
+	return list
+}
+
+// Gets a parameter without turning it into a string if it's just one reference
+func getParameterValue(workflowExecution WorkflowExecution, param WorkflowAppActionParameter) interface{} {
+	if param.Variant == "" || param.Variant == "STATIC_VALUE" {
+		value := strings.TrimSpace(param.Value)
+		if parameterPattern.FindString(value) == value && len(value) > 0 {
+			return getJsonValue(workflowExecution, value)
+		}
+	}
+
+	return parseParameter(workflowExecution, param)
+}
+
+// Runs the nodes under the node once per item in a list. The backend starts
+// an execution per item, with the item as the node's result, and gives the
+// node all the item results in order
+func runForeach(client *http.Client, workflowExecution WorkflowExecution, action Action) {
+	items := []interface{}{}
+	concurrency := 1
+	for _, param := range action.Parameters {
+		if param.Name == "list" {
+			items = getListValue(getParameterValue(workflowExecution, param))
+		} else if param.Name == "concurrency" {
+			number, err := strconv.Atoi(strings.TrimSpace(parseParameter(workflowExecution, param)))
+			if err == nil {
+				concurrency = number
+			}
+		}
+	}
+
+	actionResult, err := startWaitingNode(client, workflowExecution, action)
+	if err != nil {
+		log.Printf("[ERROR] Failed starting foreach node %s: %s", action.Label, err)
+		return
+	}
+
+	if len(items) == 0 {
+		finishNode(client, actionResult, "SUCCESS", "[]")
+		return
+	}
+
+	stringItems := []string{}
+	for _, item := range items {
+		stringItems = append(stringItems, getValueString(item))
+	}
+
+	log.Printf("Looping over %d items in %s", len(stringItems), action.Label)
+	body, err := postStream(client, "foreach", map[string]interface{}{
+		"execution_id":  workflowExecution.ExecutionId,
+		"authorization": workflowExecution.Authorization,
+		"action_id":     action.ID,
+		"items":         stringItems,
+		"concurrency":   concurrency,
+	})
+
+	if err != nil {
+		log.Printf("[ERROR] Failed starting foreach %s: %s", action.Label, err)
+		finishNode(client, actionResult, "FAILURE", fmt.Sprintf(`{"success": false, "reason": "Failed starting foreach", "details": %s}`, strconv.Quote(string(body))))
+	}
+}
+
+func getChildNodes(workflowExecution WorkflowExecution, nodeId string) []string {
+	children := []string{}
+	next := []string{nodeId}
+	for len(next) > 0 {
+		current := next[0]
+		next = next[1:]
+		for _, branch := range workflowExecution.Workflow.Branches {
+			if branch.SourceID == current && branch.DestinationID != nodeId && !arrayContains(children, branch.DestinationID) {
+				children = append(children, branch.DestinationID)
+				next = append(next, branch.DestinationID)
+			}
+		}
+	}
+
+	return children
+}
+
+// Nodes under a for-each node run in the executions of its items, and the
+// backend gives them their results here. An item's execution starts at its
+// for-each node, so only loops under that are someone else's
+func isLoopBody(workflowExecution WorkflowExecution, actionId string) bool {
+	start := workflowExecution.Start
+	if len(start) == 0 {
+		start = workflowExecution.Workflow.Start
+	}
+
+	startChildren := getChildNodes(workflowExecution, start)
+	for _, action := range workflowExecution.Workflow.Actions {
+		if action.AppID != builtinAppId || action.Name != "run_foreach" || !arrayContains(startChildren, action.ID) {
+			continue
+		}
+
+		if arrayContains(getChildNodes(workflowExecution, action.ID), actionId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Runs a check the same way as branch conditions in the app sdk
+func runValidation(sourcevalue, check, destinationvalue string) bool {
+	check = strings.ToLower(strings.TrimSpace(check))
+	source := strings.ToLower(sourcevalue)
+	destination := strings.ToLower(destinationvalue)
+
+	if check == "is empty" {
+		trimmed := strings.TrimSpace(sourcevalue)
+		return len(trimmed) == 0 || trimmed == "[]" || trimmed == "{}" || trimmed == "null"
+	}
+
+	if check == "=" || check == "equals" {
+		return source == destination
+	} else if check == "!=" || check == "does not equal" {
+		return source != destination
+	} else if check == "startswith" {
+		return strings.HasPrefix(source, destination)
+	} else if check == "endswith" {
+		return strings.HasSuffix(source, destination)
+	} else if check == "contains" {
+		return strings.Contains(source, destination)
+	} else if check == "re" || check == "matches regex" {
+		matched, err := regexp.MatchString(destinationvalue, sourcevalue)
+		if err != nil {
+			log.Printf("Bad regex %s in condition: %s", destinationvalue, err)
+			return false
+		}
+
+		return matched
+	}
+
+	sourceNumber, sourceErr := strconv.ParseFloat(strings.TrimSpace(sourcevalue), 64)
+	destinationNumber, destinationErr := strconv.ParseFloat(strings.TrimSpace(destinationvalue), 64)
+	if sourceErr != nil || destinationErr != nil {
+		log.Printf("Condition %s needs numbers. Got %s and %s", check, sourcevalue, destinationvalue)
+		return false
+	}
+
+	if check == ">" || check == "larger than" {
+		return sourceNumber > destinationNumber
+	} else if check == "<" || check == "smaller than" || check == "less than" {
+		return sourceNumber < destinationNumber
+	} else if check == ">=" {
+		return sourceNumber >= destinationNumber
+	} else if check == "<=" {
+		return sourceNumber <= destinationNumber
+	}
+
+	log.Printf("Condition: can't handle %s", check)
+	return false
+}
+
+func getActionValue(workflowExecution WorkflowExecution, action Action, name string) interface{} {
+	for _, param := range action.Parameters {
+		if param.Name == name {
+			return getParameterValue(workflowExecution, param)
+		}
+	}
+
+	return ""
+}
+
+func getActionString(workflowExecution WorkflowExecution, action Action, name string) string {
+	return getValueString(getActionValue(workflowExecution, action, name))
+}
+
+// Strings with JSON in them are parsed. Anything else stays as it is
+func getJsonInput(value interface{}) interface{} {
+	stringValue, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	var parsed interface{}
+	err := json.Unmarshal([]byte(stringValue), &parsed)
+	if err != nil {
+		return value
+	}
+
+	return parsed
 }
 
-type Authentication struct {
-	Required   bool                   `json:"required" datastore:"required" yaml:"required" `
-	Parameters []AuthenticationParams `json:"parameters" datastore:"parameters" yaml:"parameters"`
+// Keeps the items where field (a path in the item, or the item itself) matches the condition
+func runFilterList(workflowExecution WorkflowExecution, action Action) (string, error) {
+	items := getListValue(getActionValue(workflowExecution, action, "list"))
+	field := getActionString(workflowExecution, action, "field")
+	check := getActionString(workflowExecution, action, "condition")
+	value := getActionString(workflowExecution, action, "value")
+	negate := strings.ToLower(getActionString(workflowExecution, action, "negate")) == "true"
+
+	filtered := []interface{}{}
+	for _, item := range items {
+		source := item
+		if len(field) > 0 {
+			source = getJsonPath(getJsonInput(item), strings.Split(field, "."))
+		}
+
+		if runValidation(getValueString(source), check, value) != negate {
+			filtered = append(filtered, item)
+		}
+	}
+
+	data, err := json.Marshal(filtered)
+	return string(data), err
 }
 
-type AuthenticationParams struct {
-	Description string           `json:"description" datastore:"description" yaml:"description"`
-	ID          string           `json:"id" datastore:"id" yaml:"id"`
-	Name        string           `json:"name" datastore:"name" yaml:"name"`
-	Example     string           `json:"example" datastore:"example" yaml:"example"`
-	Value       string           `json:"value,omitempty" datastore:"value" yaml:"value"`
-	Multiline   bool             `json:"multiline" datastore:"multiline" yaml:"multiline"`
-	Required    bool             `json:"required" datastore:"required" yaml:"required"`
-	In          string           `json:"in" datastore:"in" yaml:"in"`
-	Schema      SchemaDefinition `json:"schema" datastore:"schema" yaml:"schema"`
-	Scheme      string           `json:"scheme" datastore:"scheme" yaml:"scheme"` // Deprecated
+// Replaces "$.path" strings in the template with values from the input
+func applyTemplate(template interface{}, input interface{}) interface{} {
+	switch value := template.(type) {
+	case string:
+		if value == "$" {
+			return input
+		}
+
+		if strings.HasPrefix(value, "$.") {
+			return getJsonPath(input, strings.Split(value[2:], "."))
+		}
+
+		return value
+	case map[string]interface{}:
+		newMap := map[string]interface{}{}
+		for key, inner := range value {
+			newMap[key] = applyTemplate(inner, input)
+		}
+
+		return newMap
+	case []interface{}:
+		newList := []interface{}{}
+		for _, inner := range value {
+			newList = append(newList, applyTemplate(inner, input))
+		}
+
+		return newList
+	}
+
+	return template
 }
 
-type AuthenticationStore struct {
-	Key   string `json:"key" datastore:"key"`
-	Value string `json:"value" datastore:"value"`
+// Picks out a path (with # for every item in a list) and optionally maps
+// the value, or every item in it, into a template
+func runTransform(workflowExecution WorkflowExecution, action Action) (string, error) {
+	input := getJsonInput(getActionValue(workflowExecution, action, "input"))
+	path := getActionString(workflowExecution, action, "path")
+	template := getActionString(workflowExecution, action, "template")
+
+	if len(path) > 0 {
+		input = getJsonPath(input, strings.Split(strings.TrimPrefix(path, "$."), "."))
+	}
+
+	if len(template) > 0 {
+		var parsedTemplate interface{}
+		err := json.Unmarshal([]byte(template), &parsedTemplate)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Template is not valid JSON: %s", err))
+		}
+
+		if list, ok := input.([]interface{}); ok {
+			newList := []interface{}{}
+			for _, item := range list {
+				newList = append(newList, applyTemplate(parsedTemplate, getJsonInput(item)))
+			}
+
+			input = newList
+		} else {
+			input = applyTemplate(parsedTemplate, input)
+		}
+	}
+
+	return getValueString(input), nil
 }
 
-type ExecutionRequestWrapper struct {
-	Data []ExecutionRequest `json:"data"`
+// Every match of the regex. With groups, every match is its groups
+func runRegexExtract(workflowExecution WorkflowExecution, action Action) (string, error) {
+	input := getActionString(workflowExecution, action, "input")
+	pattern := getActionString(workflowExecution, action, "regex")
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Bad regex %s: %s", pattern, err))
+	}
+
+	matches := []interface{}{}
+	for _, match := range re.FindAllStringSubmatch(input, -1) {
+		if len(match) == 1 {
+			matches = append(matches, match[0])
+		} else if len(match) == 2 {
+			matches = append(matches, match[1])
+		} else {
+			matches = append(matches, match[1:])
+		}
+	}
+
+	data, err := json.Marshal(matches)
+	return string(data), err
 }
 
-// removes every container except itself (worker)
-func shutdown(executionId, workflowId string) {
-	dockercli, err := dockerclient.NewEnvClient()
+func runParseJson(workflowExecution WorkflowExecution, action Action) (string, error) {
+	input := strings.TrimSpace(getActionString(workflowExecution, action, "input"))
+
+	var parsed interface{}
+	err := json.Unmarshal([]byte(input), &parsed)
 	if err != nil {
-		log.Printf("[ERROR] Unable to create docker client: %s", err)
-		os.Exit(3)
+		// Python dicts from apps
+		err = json.Unmarshal([]byte(getPythonJson(input)), &parsed)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Input is not valid JSON: %s", err))
+		}
 	}
 
-	containerOptions := types.ContainerListOptions{
-		All: true,
+	data, err := json.Marshal(parsed)
+	return string(data), err
+}
+
+func runFormatJson(workflowExecution WorkflowExecution, action Action) (string, error) {
+	input := getJsonInput(getActionValue(workflowExecution, action, "input"))
+	indent := getActionString(workflowExecution, action, "indent")
+	if len(indent) == 0 {
+		indent = "2"
 	}
 
-	containers, err := dockercli.ContainerList(context.Background(), containerOptions)
+	spaces, err := strconv.Atoi(indent)
 	if err != nil {
-		panic(err)
+		return "", errors.New(fmt.Sprintf("Indent has to be a number, not %s", indent))
 	}
-	_ = containers
 
-	for _, container := range containers {
-		for _, name := range container.Names {
-			if strings.Contains(name, executionId) {
-				// FIXME - reinstate - not here for debugging
-				//err = removeContainer(container.ID)
-				//if err != nil {
-				//	log.Printf("Failed removing %s before shutdown.", name)
-				//}
+	data, err := json.MarshalIndent(input, "", strings.Repeat(" ", spaces))
+	return string(data), err
+}
 
-				break
-			}
+// The backend sets execution variables from the result of the node
+func runSetVariable(workflowExecution WorkflowExecution, action Action) (string, error) {
+	name := getActionString(workflowExecution, action, "name")
+	for _, variable := range workflowExecution.ExecutionVariables {
+		if variable.Name == name {
+			return getActionString(workflowExecution, action, "value"), nil
 		}
-
 	}
 
-	fullUrl := fmt.Sprintf("%s/api/v1/workflows/%s/executions/%s/abort", baseUrl, workflowId, executionId)
-	req, err := http.NewRequest(
-		"GET",
-		fullUrl,
-		nil,
-	)
+	return "", errors.New(fmt.Sprintf("The workflow has no execution variable named %s", name))
+}
+
+var builtinAppId = "0ca8887e-b4af-4e3e-887c-87e9d3bc3d3e"
+
+// Nodes the worker runs itself instead of starting an app container
+var builtinActions = map[string]func(WorkflowExecution, Action) (string, error){
+	"filter_list":   runFilterList,
+	"transform":     runTransform,
+	"regex_extract": runRegexExtract,
+	"parse_json":    runParseJson,
+	"format_json":   runFormatJson,
+	"set_variable":  runSetVariable,
+}
+
+func runFilter(client *http.Client, workflowExecution WorkflowExecution, action Action) {
+	handler, ok := builtinActions[action.Name]
+	if action.Name == "set_variable" {
+		action.ExecutionVariable.Name = getActionString(workflowExecution, action, "name")
+	}
 
+	actionResult, err := startWaitingNode(client, workflowExecution, action)
 	if err != nil {
-		log.Println("[INFO] Failed building request: %s", err)
+		log.Printf("[ERROR] Failed starting %s: %s", action.Label, err)
+		return
 	}
 
-	// FIXME: Add an API call to the backend
-	authorization := os.Getenv("AUTHORIZATION")
-	if len(authorization) > 0 {
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authorization))
-	} else {
-		log.Printf("[ERROR] No authorization specified for abort")
+	if !ok {
+		log.Printf("No handler for filter %s with %d params", action.Name, len(action.Parameters))
+		finishNode(client, actionResult, "FAILURE", fmt.Sprintf("No built-in action named %s", action.Name))
+		return
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: nil,
-		},
+	result, err := handler(workflowExecution, action)
+	if err != nil {
+		log.Printf("[ERROR] Built-in action %s failed in %s: %s", action.Name, action.Label, err)
+		finishNode(client, actionResult, "FAILURE", err.Error())
+		return
 	}
 
-	httpProxy := os.Getenv("HTTP_PROXY")
-	httpsProxy := os.Getenv("HTTPS_PROXY")
-	if (len(httpProxy) > 0 || len(httpsProxy) > 0) && baseUrl != "http://shuffle-backend:5001" {
-		client = &http.Client{}
-	} else {
-		if len(httpProxy) > 0 {
-			log.Printf("[INFO] Running with HTTP proxy %s (env: HTTP_PROXY)", httpProxy)
-		}
-		if len(httpsProxy) > 0 {
-			log.Printf("[INFO] Running with HTTPS proxy %s (env: HTTPS_PROXY)", httpsProxy)
+	finishNode(client, actionResult, "SUCCESS", result)
+}
+
+// The mock a dry run was given for the node, by id or label
+func getMock(workflowExecution WorkflowExecution, action Action) (ActionMock, bool) {
+	for _, mock := range workflowExecution.Mocks {
+		if mock.ActionId == action.ID || strings.EqualFold(mock.ActionId, action.Label) {
+			return mock, true
 		}
 	}
-	_, err = client.Do(req)
+
+	return ActionMock{}, false
+}
+
+// Returns the mock or example of a node instead of running it. The
+// parameters are still filled in, so the result shows what the app would get
+func runDryRun(client *http.Client, workflowExecution WorkflowExecution, action Action) {
+	newParams := []WorkflowAppActionParameter{}
+	for _, param := range action.Parameters {
+		param.Value = parseParameter(workflowExecution, param)
+		newParams = append(newParams, param)
+	}
+
+	action.Parameters = newParams
+	actionResult, err := startWaitingNode(client, workflowExecution, action)
 	if err != nil {
-		log.Printf("[INFO] Failed abort request: %s", err)
+		log.Printf("[ERROR] Failed starting dry run of %s: %s", action.Label, err)
+		return
 	}
 
-	log.Printf("[INFO] Finished shutdown.")
-	os.Exit(3)
+	status := "SUCCESS"
+	result := action.Example
+	if mock, found := getMock(workflowExecution, action); found {
+		if len(mock.Status) > 0 {
+			status = mock.Status
+		}
+
+		result = parseParameter(workflowExecution, WorkflowAppActionParameter{Value: mock.Result})
+	}
+
+	log.Printf("Dry run of %s returns %s", action.Label, status)
+	finishNode(client, actionResult, status, result)
 }
 
-// Deploys the internal worker whenever something happens
-func deployApp(cli *dockerclient.Client, image string, identifier string, env []string) error {
-	// form basic hostConfig
-	hostConfig := &container.HostConfig{
-		LogConfig: container.LogConfig{
-			Type:   "json-file",
-			Config: map[string]string{},
-		},
+// A branch is active if its source succeeded and its conditions pass
+func getBranchDecision(workflowExecution WorkflowExecution, branch Branch) BranchDecision {
+	decision := BranchDecision{
+		BranchId: branch.ID,
+		SourceId: branch.SourceID,
 	}
 
-	// form container id and use it as network source if it's not empty
-	if containerId != "" {
-		hostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", containerId))
-	} else {
-		log.Printf("[WARNING] Empty self container id, continue without NetworkMode")
+	// Error branches are the other way around
+	sourceResult := getResult(workflowExecution, branch.SourceID)
+	if branch.HasError && sourceResult.Status != "FAILURE" {
+		decision.Reason = fmt.Sprintf("Error branch, but %s has status %s", sourceResult.Action.Label, sourceResult.Status)
+		return decision
+	} else if !branch.HasError && sourceResult.Status != "SUCCESS" && sourceResult.Status != "FINISHED" {
+		decision.Reason = fmt.Sprintf("%s has status %s", sourceResult.Action.Label, sourceResult.Status)
+		return decision
 	}
 
-	config := &container.Config{
-		Image: image,
-		Env:   env,
+	if len(branch.Conditions) == 0 {
+		decision.Active = true
+		return decision
 	}
 
-	cont, err := cli.ContainerCreate(
-		context.Background(),
-		config,
-		hostConfig,
-		nil,
-		nil,
-		identifier,
-	)
+	groups := map[int]bool{}
+	reasons := []string{}
+	for _, condition := range branch.Conditions {
+		sourcevalue := parseParameter(workflowExecution, condition.Source)
+		destinationvalue := parseParameter(workflowExecution, condition.Destination)
+		validation := runValidation(sourcevalue, condition.Condition.Value, destinationvalue)
+
+		// Configuration = negated because of WorkflowAppActionParam..
+		check := condition.Condition.Value
+		if condition.Condition.Configuration {
+			validation = !validation
+			check = fmt.Sprintf("not %s", check)
+		}
 
-	if err != nil {
-		log.Printf("Container error: %s", err)
-		return err
+		if passed, ok := groups[condition.Group]; !ok || passed {
+			groups[condition.Group] = validation
+		}
+
+		reasons = append(reasons, fmt.Sprintf("%s %s %s: %t", sourcevalue, check, destinationvalue, validation))
 	}
 
-	cli.ContainerStart(context.Background(), cont.ID, types.ContainerStartOptions{})
-	log.Printf("[INFO] Container %s is created", cont.ID)
-	return nil
+	for _, passed := range groups {
+		if passed {
+			decision.Active = true
+			break
+		}
+	}
+
+	decision.Reason = strings.Join(reasons, ", ")
+	return decision
 }
 
-func removeContainer(containername string) error {
-	ctx := context.Background()
+// What failed before a node started by an error branch, as JSON
+func getErrorInput(workflowExecution WorkflowExecution, actionId string) string {
+	for _, branch := range workflowExecution.Workflow.Branches {
+		if !branch.HasError || branch.DestinationID != actionId {
+			continue
+		}
 
-	cli, err := dockerclient.NewEnvClient()
-	if err != nil {
-		log.Printf("[INFO] Unable to create docker client: %s", err)
-		return err
+		result := getResult(workflowExecution, branch.SourceID)
+		if result.Status != "FAILURE" {
+			continue
+		}
+
+		data, err := json.Marshal(map[string]interface{}{
+			"action_id":    result.Action.ID,
+			"label":        result.Action.Label,
+			"app_name":     result.Action.AppName,
+			"name":         result.Action.Name,
+			"status":       result.Status,
+			"result":       result.Result,
+			"started_at":   result.StartedAt,
+			"completed_at": result.CompletedAt,
+		})
+		if err != nil {
+			return ""
+		}
+
+		return string(data)
 	}
 
-	// FIXME - ucnomment
-	//	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
-	//		All: true,
-	//	})
+	return ""
+}
+
+// Returns "run", "skip" or "wait". Same as in the backend:
+// all (default) needs every branch active, any and first run once on the first
+// active branch and count needs join_count of them
+func getJoinDecision(action Action, active, inactive, pending int) string {
+	total := active + inactive + pending
+	if total == 0 {
+		return "run"
+	}
 
-	_ = ctx
-	_ = cli
-	//if err := cli.ContainerStop(ctx, containername, nil); err != nil {
-	//	log.Printf("Unable to stop container %s - running removal anyway, just in case: %s", containername, err)
-	//}
+	needed := total
+	switch action.JoinMode {
+	case "any", "first":
+		needed = 1
+	case "count":
+		needed = action.JoinCount
+		if needed <= 0 {
+			needed = 1
+		} else if needed > total {
+			needed = total
+		}
+	}
 
-	removeOptions := types.ContainerRemoveOptions{
-		RemoveVolumes: true,
-		Force:         true,
+	if active >= needed {
+		return "run"
 	}
 
-	// FIXME - remove comments etc
-	_ = removeOptions
-	//if err := cli.ContainerRemove(ctx, containername, removeOptions); err != nil {
-	//	log.Printf("Unable to remove container: %s", err)
-	//}
+	if active+pending < needed {
+		return "skip"
+	}
 
-	return nil
+	return "wait"
 }
 
-func runFilter(workflowExecution WorkflowExecution, action Action) {
-	// 1. Get the parameter $.#.id
-	if action.Label == "filter_cases" && len(action.Parameters) > 0 {
-		if action.Parameters[0].Variant == "ACTION_RESULT" {
-			param := action.Parameters[0]
-			value := param.Value
-			_ = value
+// Decides whether a node should run based on the branches into it from other
+// actions and the node's join mode
+func getBranchDecisions(workflowExecution WorkflowExecution, action Action) ([]BranchDecision, string) {
+	decisions := []BranchDecision{}
+	active := 0
+	inactive := 0
+	pending := 0
+	for _, branch := range workflowExecution.Workflow.Branches {
+		if branch.DestinationID != action.ID {
+			continue
+		}
+
+		if getAction(workflowExecution, branch.SourceID).ID != branch.SourceID {
+			continue
+		}
 
-			// Loop cases.. Hmm, that's tricky
+		decision := getBranchDecision(workflowExecution, branch)
+		sourceStatus := getResult(workflowExecution, branch.SourceID).Status
+		if decision.Active {
+			active += 1
+		} else if sourceStatus == "SUCCESS" || sourceStatus == "FINISHED" || sourceStatus == "SKIPPED" || sourceStatus == "FAILURE" || sourceStatus == "ABORTED" {
+			inactive += 1
+		} else {
+			pending += 1
 		}
-	} else {
-		log.Printf("No handler for filter %s with %d params", action.Label, len(action.Parameters))
+
+		decisions = append(decisions, decision)
 	}
 
+	return decisions, getJoinDecision(action, active, inactive, pending)
 }
 
 func handleExecution(client *http.Client, req *http.Request, workflowExecution WorkflowExecution) error {
@@ -625,10 +1660,14 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 	// Process the parents etc. How?
 	visited := []string{}
 	executed := []string{}
+
+	// When nodes were started, for their timeouts
+	startTimes := map[string]int64{}
 	nextActions := []string{startAction}
 	firstIteration := true
 	for {
 		queueNodes := []string{}
+		startedNodes := 0
 
 		if len(workflowExecution.Results) == 0 {
 			nextActions = []string{startAction}
@@ -639,27 +1678,15 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 			appendActions := []string{}
 			for _, item := range workflowExecution.Results {
 
-				// FIXME: Check whether the item should be visited or not
-				// Do the same check as in walkoff.go - are the parents done?
-				// If skipped and both parents are skipped: keep as skipped, otherwise queue
+				// Do the same check as in walkoff.go - can the join mode still run it?
+				// Nodes skipped by their branch conditions stay skipped
 				if item.Status == "SKIPPED" {
 					isSkipped := true
-
-					for _, branch := range workflowExecution.Workflow.Branches {
-						// 1. Finds branches where the destination is our node
-						// 2. Finds results of those branches, and sees the status
-						// 3. If the status isn't skipped or failure, then it will still run this node
-						if branch.DestinationID == item.Action.ID {
-							for _, subresult := range workflowExecution.Results {
-								if subresult.Action.ID == branch.SourceID {
-									if subresult.Status != "SKIPPED" && subresult.Status != "FAILURE" {
-										log.Printf("\n\n\nSUBRESULT PARENT STATUS: %s\n\n\n", subresult.Status)
-										isSkipped = false
-
-										break
-									}
-								}
-							}
+					if len(item.Decisions) == 0 && len(parents[item.Action.ID]) > 0 {
+						_, join := getBranchDecisions(workflowExecution, item.Action)
+						if join != "skip" {
+							log.Printf("%s can still run. Join is %s", item.Action.Label, join)
+							isSkipped = false
 						}
 					}
 
@@ -735,20 +1762,11 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 					visited = append(visited[:outerIndex], visited[outerIndex+1:]...)
 				}
 
-				fixed := 0
-				for _, parent := range parents[item] {
-					parentResult := getResult(workflowExecution, parent)
-					if parentResult.Status == "FINISHED" || parentResult.Status == "SUCCESS" || parentResult.Status == "SKIPPED" || parentResult.Status == "FAILURE" {
-						fixed += 1
-					}
-				}
-
-				if fixed == len(parents[item]) {
+				// Only when the parents have done enough for its join mode
+				_, join := getBranchDecisions(workflowExecution, getAction(workflowExecution, item))
+				if join != "wait" {
 					nextActions = append(nextActions, item)
 				}
-
-				// If it's not executed and not in nextActions
-				// FIXME: Check if the item's parents are finished. If they're not, skip.
 			}
 		}
 
@@ -783,37 +1801,8 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 				continue
 			}
 
-			// check whether the parent is finished executing
-			//log.Printf("%s has %d parents", nextAction, len(parents[nextAction]))
-
-			continueOuter := true
-			if action.IsStartNode {
-				continueOuter = false
-			} else if len(parents[nextAction]) > 0 {
-				// FIXME - wait for parents to finishe executing
-				fixed := 0
-				for _, parent := range parents[nextAction] {
-					parentResult := getResult(workflowExecution, parent)
-					if parentResult.Status == "FINISHED" || parentResult.Status == "SUCCESS" || parentResult.Status == "SKIPPED" || parentResult.Status == "FAILURE" {
-						fixed += 1
-					}
-				}
-
-				if fixed == len(parents[nextAction]) {
-					continueOuter = false
-				}
-			} else {
-				continueOuter = false
-			}
-
-			if continueOuter {
-				//log.Printf("Parents of %s aren't finished: %s", nextAction, strings.Join(parents[nextAction], ", "))
-				//for _, tmpaction := range parents[nextAction] {
-				//	action := getAction(workflowExecution, tmpaction)
-				//	_ = action
-				//	//log.Printf("Parent: %s", action.Label)
-				//}
-				// Find the result of the nodes?
+			if isLoopBody(workflowExecution, action.ID) {
+				log.Printf("%s runs in the items of its loop", action.Label)
 				continue
 			}
 
@@ -826,6 +1815,54 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 				log.Printf("%s:%s has no status result yet. Should execute.", action.Name, action.ID)
 			}
 
+			// Conditions and join modes are checked here instead of in the app
+			decisions := []BranchDecision{}
+			join := "run"
+			if nextAction != startAction && !action.IsStartNode {
+				decisions, join = getBranchDecisions(workflowExecution, action)
+			}
+
+			if join == "wait" {
+				continue
+			}
+
+			if join == "skip" {
+				log.Printf("Skipping %s because of its branches", action.Label)
+				err = sendResult(client, ActionResult{
+					Action:        action,
+					ExecutionId:   workflowExecution.ExecutionId,
+					Authorization: workflowExecution.Authorization,
+					Result:        "Skipped because of branch conditions",
+					StartedAt:     int64(time.Now().Unix()),
+					CompletedAt:   int64(time.Now().Unix()),
+					Status:        "SKIPPED",
+					Decisions:     decisions,
+				})
+				if err != nil {
+					log.Printf("[ERROR] Failed skipping %s: %s", action.Label, err)
+				}
+
+				visited = append(visited, action.ID)
+				executed = append(executed, action.ID)
+				continue
+			}
+
+			// Keeps the decision and start time on the result. The backend holds on
+			// to them when the app reports, and a later worker resumes the timeout from it
+			if len(decisions) > 0 || action.Timeout > 0 {
+				err = sendResult(client, ActionResult{
+					Action:        action,
+					ExecutionId:   workflowExecution.ExecutionId,
+					Authorization: workflowExecution.Authorization,
+					StartedAt:     int64(time.Now().Unix()),
+					Status:        "EXECUTING",
+					Decisions:     decisions,
+				})
+				if err != nil {
+					log.Printf("[ERROR] Failed sending branch decisions for %s: %s", action.Label, err)
+				}
+			}
+
 			appname := action.AppName
 			appversion := action.AppVersion
 			appname = strings.Replace(appname, ".", "-", -1)
@@ -875,9 +1912,40 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 				continue
 			}
 
-			if action.AppID == "0ca8887e-b4af-4e3e-887c-87e9d3bc3d3e" {
-				log.Printf("\nShould run filter: %#v\n\n", action)
-				runFilter(workflowExecution, action)
+			// No container for these
+			if action.AppID == builtinAppId {
+				log.Printf("Running built-in %s for %s", action.Name, action.Label)
+				nodeExecution := workflowExecution
+				nodeExecution.ErrorInput = getErrorInput(workflowExecution, action.ID)
+				_, mocked := getMock(workflowExecution, action)
+				if workflowExecution.DryRun && (action.Name == "approval" || mocked) {
+					runDryRun(client, nodeExecution, action)
+				} else if action.Name == "run_subflow" {
+					runSubflow(client, nodeExecution, action)
+				} else if action.Name == "approval" {
+					runApproval(client, nodeExecution, action)
+				} else if action.Name == "run_foreach" {
+					runForeach(client, nodeExecution, action)
+				} else {
+					runFilter(client, nodeExecution, action)
+				}
+
+				visited = append(visited, action.ID)
+				executed = append(executed, action.ID)
+				startTimes[action.ID] = time.Now().Unix()
+				startedNodes += 1
+				continue
+			}
+
+			// Apps aren't started at all in dry runs
+			if workflowExecution.DryRun {
+				nodeExecution := workflowExecution
+				nodeExecution.ErrorInput = getErrorInput(workflowExecution, action.ID)
+				runDryRun(client, nodeExecution, action)
+
+				visited = append(visited, action.ID)
+				executed = append(executed, action.ID)
+				startedNodes += 1
 				continue
 			}
 
@@ -895,6 +1963,7 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 				fmt.Sprintf("EXECUTIONID=%s", workflowExecution.ExecutionId),
 				fmt.Sprintf("AUTHORIZATION=%s", workflowExecution.Authorization),
 				fmt.Sprintf("CALLBACK_URL=%s", baseUrl),
+				"BRANCHES_CHECKED=true",
 			}
 
 			// Fixes issue:
@@ -911,6 +1980,17 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 			err = deployApp(dockercli, image, identifier, env)
 			if err != nil {
 				log.Printf("[ERROR] Failed deploying %s from image %s: %s", identifier, image, err)
+
+				// Already EXECUTING, so it won't be retried
+				if len(decisions) > 0 {
+					finishNode(client, ActionResult{
+						Action:        action,
+						ExecutionId:   workflowExecution.ExecutionId,
+						Authorization: workflowExecution.Authorization,
+						Decisions:     decisions,
+					}, "FAILURE", fmt.Sprintf("Failed starting app: %s", err))
+				}
+
 				if strings.Contains(err.Error(), "No such image") {
 					log.Printf("[ERROR] Image doesn't exist. Shutting down")
 					shutdown(workflowExecution.ExecutionId, workflowExecution.Workflow.ID)
@@ -921,6 +2001,8 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 
 			visited = append(visited, action.ID)
 			executed = append(executed, action.ID)
+			startTimes[action.ID] = time.Now().Unix()
+			startedNodes += 1
 
 			// If children of action.ID are NOT in executed:
 			// Remove them from visited.
@@ -965,11 +2047,71 @@ func handleExecution(client *http.Client, req *http.Request, workflowExecution W
 		}
 
 		log.Printf("Status: %s, Results: %d, actions: %d", workflowExecution.Status, len(workflowExecution.Results), len(workflowExecution.Workflow.Actions))
+
+		// Shutting down would abort it. Resuming starts a new worker that
+		// continues from the results
+		if workflowExecution.Status == "PAUSED" {
+			log.Printf("Workflow %s is paused. Exiting worker.", workflowExecution.ExecutionId)
+			os.Exit(0)
+		}
+
 		if workflowExecution.Status != "EXECUTING" {
 			log.Printf("Exiting as worker execution has status %s!", workflowExecution.Status)
 			shutdown(workflowExecution.ExecutionId, workflowExecution.Workflow.ID)
 		}
 
+		// Nodes started before a pause or by an earlier worker keep their timeouts
+		for _, result := range workflowExecution.Results {
+			if result.Status != "EXECUTING" || result.StartedAt <= 0 {
+				continue
+			}
+
+			if _, ok := startTimes[result.Action.ID]; ok {
+				continue
+			}
+
+			if getAction(workflowExecution, result.Action.ID).Timeout > 0 {
+				startTimes[result.Action.ID] = result.StartedAt
+			}
+		}
+
+		// Nodes running longer than their timeout fail, so their error branches can run
+		for actionId, started := range startTimes {
+			action := getAction(workflowExecution, actionId)
+			result := getResult(workflowExecution, actionId)
+			if action.Timeout <= 0 || (result.Action.ID == actionId && result.Status != "EXECUTING") {
+				delete(startTimes, actionId)
+				continue
+			}
+
+			if time.Now().Unix()-started < int64(action.Timeout) {
+				continue
+			}
+
+			log.Printf("[WARNING] %s timed out after %d seconds", action.Label, action.Timeout)
+			finishNode(client, ActionResult{
+				Action:        action,
+				ExecutionId:   workflowExecution.ExecutionId,
+				Authorization: workflowExecution.Authorization,
+				StartedAt:     started,
+				Decisions:     result.Decisions,
+			}, "FAILURE", fmt.Sprintf("Timed out after %d seconds", action.Timeout))
+			delete(startTimes, actionId)
+		}
+
+		// Subflows and approvals can take hours, and Orborus removes workers
+		// that run too long. The backend queues the execution again for a new
+		// worker when one of them is done
+		if startedNodes == 0 && canRelease(workflowExecution) {
+			err = releaseExecution(client, workflowExecution)
+			if err == nil {
+				log.Printf("Workflow %s only waits for other executions. Exiting worker.", workflowExecution.ExecutionId)
+				os.Exit(0)
+			}
+
+			log.Printf("Not releasing %s yet: %s", workflowExecution.ExecutionId, err)
+		}
+
 		if len(workflowExecution.Results) == len(workflowExecution.Workflow.Actions) {
 			shutdownCheck := true
 			ctx := context.Background()
@@ -1214,6 +2356,11 @@ func main() {
 			shutdown(executionId, workflowExecution.Workflow.ID)
 		}
 
+		if workflowExecution.Status == "PAUSED" {
+			log.Printf("[INFO] Workflow %s is paused. Exiting worker.", workflowExecution.ExecutionId)
+			os.Exit(0)
+		}
+
 		if workflowExecution.Status == "EXECUTING" || workflowExecution.Status == "RUNNING" {
 			//log.Printf("Status: %s", workflowExecution.Status)
 			err = handleExecution(client, req, workflowExecution)